@@ -3,6 +3,8 @@ package access
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -11,6 +13,30 @@ type UserStore interface {
 	User(context.Context, Username) (*User, error)
 }
 
+// Authenticator is implemented by a UserStore which verifies passwords
+// itself (e.g. by binding to LDAP), rather than providing a PasswordHash.
+type Authenticator interface {
+	Authenticate(ctx context.Context, u Username, password string) (*User, error)
+}
+
+var ErrBadPassword = errors.New("incorrect password")
+
+// Authenticate verifies the user's password with us, if it's an
+// Authenticator, or otherwise against the user's PasswordHash.
+func Authenticate(ctx context.Context, us UserStore, u Username, password string) (*User, error) {
+	if a, ok := us.(Authenticator); ok {
+		return a.Authenticate(ctx, u, password)
+	}
+	user, err := us.User(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.Authenticate(password); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPassword, err)
+	}
+	return user, nil
+}
+
 type Username string
 type GroupName string
 
@@ -23,12 +49,46 @@ type User struct {
 	PasswordHash string `json:"password_hash,omitempty"`
 
 	Groups `json:"groups,omitempty"`
+
+	// Disabled users can't log in, and their sessions stop working.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Parent is only set for guests, by their guest pass, and is the user
+	// who invited them.
+	Parent Username `json:"-"`
+
+	// ParentUser is the current account of Parent, if it was looked up
+	// when the guest pass was used.
+	ParentUser *User `json:"-"`
+}
+
+// parent returns the user who invited guest u. If they weren't looked up,
+// they are rebuilt with u's groups other than GuestGroup, which guests
+// inherit from their parent.
+func (u *User) parent() *User {
+	if u.ParentUser != nil {
+		return u.ParentUser
+	}
+	p := &User{Username: u.Parent, Groups: make(Groups, 0, len(u.Groups))}
+	for _, g := range u.Groups {
+		if g != GuestGroup {
+			p.Groups = append(p.Groups, g)
+		}
+	}
+	return p
 }
 
 func (u *User) Authenticate(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
 }
 
+// AdminGroup members may administer Unlockr, such as viewing all audit records.
+const AdminGroup GroupName = "admin"
+
+func (u *User) IsAdmin() bool {
+	return u.HasGroup(AdminGroup)
+}
+
 func (g Groups) HasGroup(h GroupName) bool {
 	for _, v := range g {
 		if v == h {
@@ -62,27 +122,94 @@ type ACL struct {
 	Deny    List   `json:"deny"`
 	Allow   List   `json:"allow"`
 	Default string `json:"default"`
+
+	// Schedules optionally restrict when allowed users have access.
+	Schedules []Schedule `json:"schedules,omitempty"`
+
+	// Actions optionally restrict individual actions further. Users must be
+	// allowed by this ACL, and also by the ACL for the action, if present.
+	Actions map[Action]*ACL `json:"actions,omitempty"`
 }
 
+type Action string
+
+const (
+	ActionView     Action = "view"      // see the device at all
+	ActionPowerOn  Action = "power/on"  // switch the device on
+	ActionPowerOff Action = "power/off" // switch the device off
+	ActionPulse    Action = "pulse"     // switch the device on, then off
+	ActionState    Action = "state"     // read the device state
+
+	// ActionInviteGuest controls whether guests may access the device.
+	// It is evaluated against the user who invited them, both when the
+	// guest pass is created and whenever it is used.
+	ActionInviteGuest Action = "invite-guest"
+)
+
+// GuestGroup is a member of every guest's groups.
+const GuestGroup GroupName = "guest"
+
 var DefaultACL = &ACL{Default: "allow"}
 
 var ErrAccessDenied = errors.New("access denied")
 
+// UserCanAccess checks if u is allowed by the ACL at the current time.
 func (a *ACL) UserCanAccess(u *User) error {
+	return a.UserCanAccessAt(u, now())
+}
+
+// UserCanAccessAt checks if u is allowed by the ACL at time t.
+// Deny takes precedence, then Allow, then Default. If the user is allowed,
+// any applicable Schedules must also be active at t.
+func (a *ACL) UserCanAccessAt(u *User, t time.Time) error {
 	switch {
 	case a.Deny.HasUser(u):
 		return ErrAccessDenied
 	case a.Allow.HasUser(u):
-		return nil
+		return a.checkSchedules(u, t)
 	case a.Default == "allow" || a.Default == "":
-		return nil
+		return a.checkSchedules(u, t)
 	}
 	return ErrAccessDenied
 }
 
+// UserCan checks if u may perform action at the current time.
+func (a *ACL) UserCan(u *User, action Action) error {
+	return a.UserCanAt(u, action, now())
+}
+
+// UserCanAt checks if u may perform action at time t.
+// The parents of guests must also be allowed by the ActionInviteGuest ACL.
+func (a *ACL) UserCanAt(u *User, action Action, t time.Time) error {
+	if err := a.UserCanAccessAt(u, t); err != nil {
+		return err
+	}
+	if u.Parent != "" {
+		if err := a.action(ActionInviteGuest).UserCanAccessAt(u.parent(), t); err != nil {
+			return err
+		}
+	}
+	if action == ActionView {
+		return nil
+	}
+	return a.action(action).UserCanAccessAt(u, t)
+}
+
+// action returns the ACL for an action, which allows everybody if unset.
+func (a *ACL) action(action Action) *ACL {
+	if acl := a.Actions[action]; acl != nil {
+		return acl
+	}
+	return DefaultACL
+}
+
 type key int
 
-var ctxKey key
+const (
+	ctxKey key = iota
+	ctxParentKey
+	ctxRecheckKey
+)
 
 // NewContext returns a copy of ctx with User attached.
 // Use FromContext to retrieve the User.
@@ -94,3 +221,30 @@ func FromContext(ctx context.Context) (u *User, ok bool) {
 	u, ok = ctx.Value(ctxKey).(*User)
 	return
 }
+
+// NewContextParent returns a copy of ctx with the parent (inviting) user of
+// a guest attached. Use ParentFromContext to retrieve it.
+func NewContextParent(ctx context.Context, parent Username) context.Context {
+	return context.WithValue(ctx, ctxParentKey, parent)
+}
+
+func ParentFromContext(ctx context.Context) (parent Username, ok bool) {
+	parent, ok = ctx.Value(ctxParentKey).(Username)
+	return
+}
+
+// Recheck authenticates a request again, returning its user as they are now.
+// Long-lived requests, such as event streams, use it to find out when the
+// user's session or account stops being valid.
+type Recheck func(ctx context.Context) (*User, error)
+
+// NewContextRecheck returns a copy of ctx with rc attached.
+// Use RecheckFromContext to retrieve it.
+func NewContextRecheck(ctx context.Context, rc Recheck) context.Context {
+	return context.WithValue(ctx, ctxRecheckKey, rc)
+}
+
+func RecheckFromContext(ctx context.Context) (rc Recheck, ok bool) {
+	rc, ok = ctx.Value(ctxRecheckKey).(Recheck)
+	return
+}
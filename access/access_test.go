@@ -1,6 +1,12 @@
 package access
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func sampleUsers() (alice, bob, charlie, kevin, nilbert *User) {
 	const unused = ""
@@ -9,26 +15,41 @@ func sampleUsers() (alice, bob, charlie, kevin, nilbert *User) {
 			"Alice Montague",
 			unused,
 			[]GroupName{"montagues"},
+			false,
+			unused,
+			nil,
 		}, &User{
 			"bob",
 			"Bob Capulet",
 			unused,
 			[]GroupName{"capulets"},
+			false,
+			unused,
+			nil,
 		}, &User{
 			"charlie",
 			"Charlie Rottenweather",
 			unused,
 			[]GroupName{"plebs"},
+			false,
+			unused,
+			nil,
 		}, &User{
 			"kevin",
 			"Kevin Tomatothrower",
 			unused,
 			nil,
+			false,
+			unused,
+			nil,
 		}, &User{
 			"nilbert",
 			"Nilbert Nullingsworth",
 			unused,
 			nil,
+			false,
+			unused,
+			nil,
 		}
 }
 
@@ -84,3 +105,81 @@ func TestACL(t *testing.T) {
 		t.Errorf("UserCanAccess(nilbert), default=%s: got %v, want %v", acl.Default, got, want)
 	}
 }
+
+func TestACLActions(t *testing.T) {
+	alice, bob, charlie, _, _ := sampleUsers()
+	acl := &ACL{
+		Allow: List{Groups: []GroupName{"montagues", "capulets", "plebs"}},
+		Actions: map[Action]*ACL{
+			// plebs may only view:
+			ActionPowerOn: {Deny: List{Groups: []GroupName{"plebs"}}},
+			// capulets may open, but never lock-off:
+			ActionPowerOff: {Deny: List{Groups: []GroupName{"capulets", "plebs"}}},
+			// only montagues' guests are welcome:
+			ActionInviteGuest: {Allow: List{Groups: []GroupName{"montagues"}}, Default: "deny"},
+		},
+		Default: "deny",
+	}
+	guestOf := func(u *User) *User {
+		return &User{"guest", "Guest", "", append(Groups{GuestGroup}, u.Groups...), false, u.Username, nil}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		u      *User
+		action Action
+		want   error
+	}{
+		{"alice", alice, ActionPowerOff, nil},
+		{"bob", bob, ActionPowerOn, nil},
+		{"bob", bob, ActionPowerOff, ErrAccessDenied},
+		{"charlie", charlie, ActionView, nil},
+		{"charlie", charlie, ActionState, nil},
+		{"charlie", charlie, ActionPowerOn, ErrAccessDenied},
+		{"guest of alice", guestOf(alice), ActionPulse, nil},
+		{"guest of bob", guestOf(bob), ActionView, ErrAccessDenied},
+	} {
+		if got := acl.UserCan(tc.u, tc.action); got != tc.want {
+			t.Errorf("UserCan(%s, %s): got %v, want %v", tc.name, tc.action, got, tc.want)
+		}
+	}
+
+	// Guests are checked by who invited them, not by the guest group:
+	acl = &ACL{Actions: map[Action]*ACL{
+		ActionInviteGuest: {Allow: List{Users: []Username{"alice"}}, Default: "deny"},
+	}}
+	if got := acl.UserCan(guestOf(alice), ActionView); got != nil {
+		t.Errorf("UserCan(guest of alice): got %v, want nil", got)
+	}
+	if got := acl.UserCan(guestOf(bob), ActionView); got != ErrAccessDenied {
+		t.Errorf("UserCan(guest of bob): got %v, want %v", got, ErrAccessDenied)
+	}
+	member := &User{Username: "gus", Groups: Groups{GuestGroup}}
+	if got := acl.UserCan(member, ActionView); got != nil {
+		t.Errorf("UserCan(member of guest group): got %v, want nil", got)
+	}
+}
+
+type mapStore Users
+
+func (m mapStore) User(ctx context.Context, u Username) (*User, error) {
+	user, ok := m[u]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return &user, nil
+}
+
+func TestAuthenticateHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("wherefore"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := mapStore{"alice": {Username: "alice", PasswordHash: string(hash)}}
+	if u, err := Authenticate(context.Background(), us, "alice", "wherefore"); err != nil || u.Username != "alice" {
+		t.Errorf("Authenticate: got %+v, %v", u, err)
+	}
+	if _, err := Authenticate(context.Background(), us, "alice", "art thou"); !errors.Is(err, ErrBadPassword) {
+		t.Errorf("Authenticate(bad password): got %v, want %v", err, ErrBadPassword)
+	}
+}
@@ -0,0 +1,34 @@
+package access
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNoOTP = errors.New("user has no OTP configured")
+
+// OTPStore is implemented by a UserStore which can store TOTP secrets.
+type OTPStore interface {
+	// OTP returns ErrNoOTP if the user hasn't enrolled.
+	OTP(ctx context.Context, u Username) (*OTP, error)
+
+	// SaveOTP replaces the user's OTP, or removes it if o is nil.
+	SaveOTP(ctx context.Context, u Username, o *OTP) error
+}
+
+// OTP is a user's time-based one-time password (RFC 6238) configuration.
+type OTP struct {
+	// Secret is base32 encoded, as shown to authenticator apps.
+	Secret string `json:"secret"`
+
+	// Enabled is set once the user has proven they can generate codes.
+	// Until then, logins don't require a code.
+	Enabled bool `json:"enabled"`
+
+	// RecoveryCodes are SHA-256 hashes of unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// LastCounter is the time step of the last accepted code, so that
+	// codes can't be reused.
+	LastCounter int64 `json:"last_counter,omitempty"`
+}
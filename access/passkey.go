@@ -0,0 +1,47 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrNoPasskey = errors.New("passkey not found")
+
+// PasskeyStore is implemented by a UserStore which can store WebAuthn
+// credentials.
+type PasskeyStore interface {
+	// Passkeys returns all of the user's passkeys, which may be none.
+	Passkeys(ctx context.Context, u Username) ([]Passkey, error)
+
+	// SavePasskey adds p, or replaces the user's passkey with the same ID.
+	SavePasskey(ctx context.Context, u Username, p *Passkey) error
+
+	// DeletePasskey returns ErrNoPasskey if the user has no passkey with id.
+	DeletePasskey(ctx context.Context, u Username, id []byte) error
+
+	// PasskeyUser returns the user whose passkeys have the user handle,
+	// or ErrNoPasskey if there is none.
+	PasskeyUser(ctx context.Context, handle []byte) (Username, error)
+}
+
+// Passkey is a WebAuthn public key credential.
+type Passkey struct {
+	// ID is chosen by the authenticator.
+	ID []byte `json:"id"`
+
+	// UserHandle is the random ID given to the authenticator for the
+	// user, which is the same for all of their passkeys.
+	UserHandle []byte `json:"user_handle"`
+
+	// PublicKey is a COSE_Key, which includes its algorithm.
+	PublicKey []byte `json:"public_key"`
+
+	// SignCount is the authenticator's signature counter, if it has one.
+	// It must always increase, otherwise the passkey may have been cloned.
+	SignCount uint32 `json:"sign_count"`
+
+	// Name is chosen by the user, to tell their passkeys apart.
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created"`
+}
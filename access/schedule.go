@@ -0,0 +1,258 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // for Timezone, on systems without a zoneinfo database
+)
+
+var ErrOutsideSchedule = fmt.Errorf("%w: outside of scheduled times", ErrAccessDenied)
+
+// now is replaced by tests.
+var now = time.Now
+
+// Schedule restricts when users may access a device.
+//
+// A schedule applies to the users and groups listed, or everyone if both are
+// empty. If any schedules apply to a user, at least one must be active for
+// access to be allowed. Users without applicable schedules are unaffected.
+//
+// All fields are optional; an empty field doesn't restrict anything.
+type Schedule struct {
+	List
+
+	// Weekdays, e.g. ["tue", "thu"]. For a range which continues past
+	// midnight, this is the day on which it starts.
+	Weekdays []Weekday `json:"weekdays,omitempty"`
+
+	// From and Until are times of day, e.g. "08:00" and "12:00".
+	// From is inclusive, and Until is exclusive. If Until is earlier than
+	// From, the range continues past midnight (e.g. "22:00" until "06:00").
+	From  *TimeOfDay `json:"from,omitempty"`
+	Until *TimeOfDay `json:"until,omitempty"`
+
+	// Timezone is an IANA name, e.g. "Australia/Sydney".
+	// Defaults to the server's local time.
+	Timezone *Location `json:"timezone,omitempty"`
+
+	// Dates are the only date ranges during which the schedule is active.
+	// Like Weekdays, a range past midnight belongs to the day it starts.
+	Dates []DateRange `json:"dates,omitempty"`
+
+	// Except are date ranges when the schedule is inactive, e.g. holidays.
+	// Like Weekdays, a range past midnight belongs to the day it starts.
+	Except []DateRange `json:"except,omitempty"`
+}
+
+// appliesTo is true if the schedule restricts u.
+func (s *Schedule) appliesTo(u *User) bool {
+	if len(s.Users) == 0 && len(s.Groups) == 0 {
+		return true
+	}
+	return s.HasUser(u)
+}
+
+// Active reports whether t falls within the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	if s.Timezone != nil {
+		t = t.In(s.Timezone.Location)
+	} else {
+		t = t.In(time.Local)
+	}
+
+	// day is when the time range started, which is the day before for the
+	// part of a range after midnight:
+	day := t
+	if s.From != nil || s.Until != nil {
+		tod := TimeOfDay(t.Hour()*60 + t.Minute())
+		from, until := TimeOfDay(0), TimeOfDay(24*60)
+		if s.From != nil {
+			from = *s.From
+		}
+		if s.Until != nil {
+			until = *s.Until
+		}
+		if from <= until {
+			if tod < from || tod >= until {
+				return false
+			}
+		} else if tod < from && tod >= until { // wraps past midnight
+			return false
+		} else if tod < until {
+			day = t.AddDate(0, 0, -1)
+		}
+	}
+
+	if len(s.Weekdays) > 0 {
+		found := false
+		for _, wd := range s.Weekdays {
+			if time.Weekday(wd) == day.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(s.Dates) > 0 {
+		found := false
+		for _, dr := range s.Dates {
+			if dr.Contains(day) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, dr := range s.Except {
+		if dr.Contains(day) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSchedules returns nil if u has no applicable schedules, or if any
+// applicable schedule is active at t.
+func (a *ACL) checkSchedules(u *User, t time.Time) error {
+	applicable := false
+	for i := range a.Schedules {
+		s := &a.Schedules[i]
+		if !s.appliesTo(u) {
+			continue
+		}
+		if s.Active(t) {
+			return nil
+		}
+		applicable = true
+	}
+	if applicable {
+		return ErrOutsideSchedule
+	}
+	return nil
+}
+
+// Weekday is a time.Weekday which is configured as a name, e.g. "mon" or "Monday".
+type Weekday time.Weekday
+
+func (w *Weekday) UnmarshalJSON(v []byte) error {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return err
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if l := strings.ToLower(s); l == name || l == name[:3] {
+			*w = Weekday(d)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid weekday: %q", s)
+}
+
+func (w Weekday) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToLower(time.Weekday(w).String()[:3]))
+}
+
+// TimeOfDay is minutes since midnight, configured as "15:04".
+type TimeOfDay int
+
+func (t *TimeOfDay) UnmarshalJSON(v []byte) error {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return err
+	}
+	if s == "24:00" {
+		*t = 24 * 60 // end of day
+		return nil
+	}
+	p, err := time.Parse("15:04", s)
+	if err != nil {
+		return fmt.Errorf("invalid time of day (want HH:MM): %w", err)
+	}
+	*t = TimeOfDay(p.Hour()*60 + p.Minute())
+	return nil
+}
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%02d:%02d", t/60, t%60))
+}
+
+// DateRange is an inclusive range of dates, configured as "2006-01-02".
+// If Until is unset, only the From date is included.
+type DateRange struct {
+	From  Date  `json:"from"`
+	Until *Date `json:"until,omitempty"`
+}
+
+// Contains reports whether the date of t (in its own location) is within the range.
+func (dr *DateRange) Contains(t time.Time) bool {
+	d := Date{t.Year(), t.Month(), t.Day()}
+	until := dr.From
+	if dr.Until != nil {
+		until = *dr.Until
+	}
+	return !d.before(dr.From) && !until.before(d)
+}
+
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+func (d Date) before(e Date) bool {
+	if d.Year != e.Year {
+		return d.Year < e.Year
+	}
+	if d.Month != e.Month {
+		return d.Month < e.Month
+	}
+	return d.Day < e.Day
+}
+
+func (d *Date) UnmarshalJSON(v []byte) error {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return err
+	}
+	p, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return fmt.Errorf("invalid date (want YYYY-MM-DD): %w", err)
+	}
+	*d = Date{p.Year(), p.Month(), p.Day()}
+	return nil
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day))
+}
+
+// Location is a time.Location configured by its IANA name.
+type Location struct {
+	*time.Location
+}
+
+func (l *Location) UnmarshalJSON(v []byte) error {
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return err
+	}
+	l.Location = loc
+	return nil
+}
+
+func (l Location) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
@@ -0,0 +1,148 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	alice, _, charlie, _, _ := sampleUsers()
+	var acl ACL
+	err := json.Unmarshal([]byte(`{
+		"allow": {"groups": ["montagues", "plebs"]},
+		"default": "deny",
+		"schedules": [{
+			"groups": ["plebs"],
+			"weekdays": ["tue"],
+			"from": "08:00",
+			"until": "12:00",
+			"timezone": "UTC",
+			"except": [{"from": "2024-12-24", "until": "2024-12-31"}]
+		}]
+	}`), &acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		time string
+		want error
+	}{
+		{"2024-06-04T08:00:00Z", nil},                // Tuesday, start of range
+		{"2024-06-04T11:59:00Z", nil},                // Tuesday, end of range
+		{"2024-06-04T12:00:00Z", ErrOutsideSchedule}, // Tuesday, until is exclusive
+		{"2024-06-04T07:59:00Z", ErrOutsideSchedule}, // Tuesday, too early
+		{"2024-06-05T09:00:00Z", ErrOutsideSchedule}, // Wednesday
+		{"2024-12-24T09:00:00Z", ErrOutsideSchedule}, // Tuesday, holiday
+		{"2024-06-04T18:00:00+10:00", nil},           // Tuesday 08:00 UTC
+	} {
+		at, err := time.Parse(time.RFC3339, tc.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.UserCanAccessAt(charlie, at); got != tc.want {
+			t.Errorf("UserCanAccessAt(charlie, %s): got %v, want %v", tc.time, got, tc.want)
+		}
+		// alice has no applicable schedule, so is always allowed:
+		if got := acl.UserCanAccessAt(alice, at); got != nil {
+			t.Errorf("UserCanAccessAt(alice, %s): got %v, want nil", tc.time, got)
+		}
+	}
+
+	if !errors.Is(ErrOutsideSchedule, ErrAccessDenied) {
+		t.Errorf("ErrOutsideSchedule should wrap ErrAccessDenied")
+	}
+}
+
+func TestScheduleOvernight(t *testing.T) {
+	from, until := TimeOfDay(22*60), TimeOfDay(6*60)
+	s := Schedule{From: &from, Until: &until, Timezone: &Location{time.UTC}}
+	for _, tc := range []struct {
+		hour int
+		want bool
+	}{
+		{21, false}, {22, true}, {23, true}, {0, true}, {5, true}, {6, false}, {12, false},
+	} {
+		at := time.Date(2024, 6, 4, tc.hour, 0, 0, 0, time.UTC)
+		if got := s.Active(at); got != tc.want {
+			t.Errorf("Active(%02d:00): got %v, want %v", tc.hour, got, tc.want)
+		}
+	}
+}
+
+// Tests that the part of an overnight range after midnight belongs to the
+// weekday on which it started.
+func TestScheduleOvernightWeekday(t *testing.T) {
+	var s Schedule
+	if err := json.Unmarshal([]byte(`{"weekdays": ["tue"], "from": "22:00", "until": "06:00", "timezone": "UTC"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		time string
+		want bool
+	}{
+		{"2024-06-04T23:00:00Z", true},  // Tuesday
+		{"2024-06-05T01:00:00Z", true},  // Wednesday, after Tuesday night
+		{"2024-06-05T06:00:00Z", false}, // Wednesday, until is exclusive
+		{"2024-06-05T23:00:00Z", false}, // Wednesday
+		{"2024-06-04T01:00:00Z", false}, // Tuesday, after Monday night
+	} {
+		at, err := time.Parse(time.RFC3339, tc.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Active(at); got != tc.want {
+			t.Errorf("Active(%s): got %v, want %v", tc.time, got, tc.want)
+		}
+	}
+}
+
+// Tests that the part of an overnight range after midnight is checked against
+// Dates and Except using the date on which it started.
+func TestScheduleOvernightDates(t *testing.T) {
+	var s Schedule
+	if err := json.Unmarshal([]byte(`{"from": "22:00", "until": "06:00", "timezone": "UTC", "except": [{"from": "2024-12-25"}]}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	var dated Schedule
+	if err := json.Unmarshal([]byte(`{"from": "22:00", "until": "06:00", "timezone": "UTC", "dates": [{"from": "2024-12-24"}]}`), &dated); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		s    *Schedule
+		time string
+		want bool
+	}{
+		{&s, "2024-12-24T23:00:00Z", true},  // night before the excepted date
+		{&s, "2024-12-25T01:00:00Z", true},  // still the night before
+		{&s, "2024-12-25T23:00:00Z", false}, // excepted date
+		{&s, "2024-12-26T01:00:00Z", false}, // after midnight on the excepted date
+		{&dated, "2024-12-24T23:00:00Z", true},
+		{&dated, "2024-12-25T01:00:00Z", true}, // after midnight on the listed date
+		{&dated, "2024-12-24T01:00:00Z", false},
+	} {
+		at, err := time.Parse(time.RFC3339, tc.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.s.Active(at); got != tc.want {
+			t.Errorf("Active(%s): got %v, want %v", tc.time, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleParseErrors(t *testing.T) {
+	for _, v := range []string{
+		`{"weekdays": ["funday"]}`,
+		`{"from": "8am"}`,
+		`{"timezone": "Nowhere/Special"}`,
+		`{"dates": [{"from": "24/12/2024"}]}`,
+	} {
+		var s Schedule
+		if err := json.Unmarshal([]byte(v), &s); err == nil {
+			t.Errorf("Unmarshal(%s): got nil, want error", v)
+		}
+	}
+}
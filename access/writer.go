@@ -0,0 +1,30 @@
+package access
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrUserExists = errors.New("user already exists")
+var ErrUserDisabled = errors.New("user disabled")
+
+// UserStoreWriter is implemented by a UserStore which can modify users.
+// Methods return sql.ErrNoRows if the user doesn't exist, where the store
+// can tell.
+type UserStoreWriter interface {
+	// SetPasswordHash replaces the user's PasswordHash.
+	SetPasswordHash(ctx context.Context, u Username, hash string) error
+
+	// Users returns every user, including disabled ones, which User
+	// refuses with ErrUserDisabled.
+	Users(ctx context.Context) (Users, error)
+
+	// AddUser returns ErrUserExists if the username is taken.
+	AddUser(ctx context.Context, u *User) error
+
+	// UpdateUser replaces the nickname, groups and Disabled flag of the
+	// user, but not their PasswordHash.
+	UpdateUser(ctx context.Context, u *User) error
+
+	DeleteUser(ctx context.Context, u Username) error
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+// AuditStore persists a record of every device action.
+type AuditStore interface {
+	SaveRecord(ctx context.Context, r *Record) error
+
+	// Records returns up to limit records older than before for which match
+	// is true, newest first. If match is nil, every record matches.
+	Records(ctx context.Context, before time.Time, limit int, match func(*Record) bool) ([]Record, error)
+}
+
+type Record struct {
+	Time time.Time       `json:"time"`
+	User access.Username `json:"user"`
+	// Parent is set if User is a guest, and is the user who invited them.
+	Parent     access.Username `json:"parent,omitempty"`
+	Device     string          `json:"device"`
+	Action     string          `json:"action"`
+	Status     int             `json:"status"` // HTTP status code of the result
+	Error      string          `json:"error,omitempty"`
+	RemoteAddr string          `json:"remoteaddr"`
+}
+
+// NewRecord returns a Record populated from the user in ctx and r.
+func NewRecord(ctx context.Context, r *http.Request, device, action string) *Record {
+	rec := &Record{
+		Time:       time.Now(),
+		Device:     device,
+		Action:     action,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if u, ok := access.FromContext(ctx); ok {
+		rec.User = u.Username
+	}
+	if parent, ok := access.ParentFromContext(ctx); ok {
+		rec.Parent = parent
+	}
+	return rec
+}
+
+// Save writes rec to the AuditStore in ctx, if any.
+// Errors are logged rather than returned, as the action has already happened.
+func Save(ctx context.Context, rec *Record) {
+	as, ok := FromContext(ctx)
+	if !ok {
+		return
+	}
+	// Save even if the client has gone away:
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := as.SaveRecord(ctx, rec); err != nil {
+		log.Printf("audit: failed saving record %+v: %v", rec, err)
+	}
+}
+
+type key int
+
+var ctxKey key
+
+func NewContext(ctx context.Context, as AuditStore) context.Context {
+	return context.WithValue(ctx, ctxKey, as)
+}
+
+func FromContext(ctx context.Context) (as AuditStore, ok bool) {
+	as, ok = ctx.Value(ctxKey).(AuditStore)
+	return
+}
+
+// Handler puts the AuditStore into the request context, so that
+// handlers further down may record actions with Save.
+type Handler struct {
+	http.Handler
+	AuditStore
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.AuditStore != nil {
+		r = r.WithContext(NewContext(r.Context(), h.AuditStore))
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+// StatusWriter records the status code written to a ResponseWriter.
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (s *StatusWriter) WriteHeader(code int) {
+	if s.Status == 0 {
+		s.Status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *StatusWriter) Write(b []byte) (int, error) {
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *StatusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+const adminUsersPath = "/api/admin/users"
+
+var ErrBadUser = errors.New("invalid user")
+
+// AdminUser is a user as seen by admins.
+type AdminUser struct {
+	Username access.Username `json:"username"`
+	Nickname string          `json:"nickname"`
+	Groups   access.Groups   `json:"groups"`
+	Disabled bool            `json:"disabled,omitempty"`
+
+	// Password is only used when creating a user, and is never returned.
+	// Users without one can't log in until an admin sets one.
+	Password string `json:"password,omitempty"`
+}
+
+func newAdminUser(u *access.User) AdminUser {
+	au := AdminUser{
+		Username: u.Username,
+		Nickname: u.Nickname,
+		Groups:   u.Groups,
+		Disabled: u.Disabled,
+	}
+	if au.Groups == nil {
+		au.Groups = make(access.Groups, 0)
+	}
+	return au
+}
+
+// AdminUserUpdate is the JSON body when updating a user. Fields which are
+// missing are left unchanged.
+type AdminUserUpdate struct {
+	Nickname *string        `json:"nickname,omitempty"`
+	Groups   *access.Groups `json:"groups,omitempty"`
+	Disabled *bool          `json:"disabled,omitempty"`
+}
+
+// ServeAdminUsers lets admins manage users:
+//
+//	GET    /api/admin/users                      lists users
+//	POST   /api/admin/users                      creates a user
+//	GET    /api/admin/users/{username}           gets a user
+//	PATCH  /api/admin/users/{username}           updates a user, e.g. to disable them
+//	DELETE /api/admin/users/{username}           deletes a user
+//	POST   /api/admin/users/{username}/password  resets their password
+//
+// Disabling or deleting a user signs them out, and revokes their API tokens
+// and guest passes. Admins can't disable or delete themselves, nor leave the
+// admin group.
+func (h *PasswordAuthHandler) ServeAdminUsers(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok || !u.IsAdmin() {
+		http.Error(w, "Must be an admin", http.StatusForbidden)
+		return
+	}
+	usw, ok := h.UserStore.(access.UserStoreWriter)
+	if !ok {
+		http.Error(w, "User management not supported by this datastore", http.StatusNotImplemented)
+		return
+	}
+	name, _ := strings.CutPrefix(r.URL.Path, adminUsersPath)
+	name = strings.TrimPrefix(name, "/")
+	if strings.HasSuffix(name, "/password") {
+		h.ServeAdminPassword(w, r)
+		return
+	}
+	if strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	users, err := usw.Users(r.Context())
+	if err != nil {
+		serveAdminError(w, err)
+		return
+	}
+
+	if name == "" {
+		switch r.Method {
+		case "GET":
+			list := make([]AdminUser, 0, len(users))
+			for _, user := range users {
+				list = append(list, newAdminUser(&user))
+			}
+			sort.Slice(list, func(i, j int) bool {
+				return list[i].Username < list[j].Username
+			})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case "POST":
+			var req AdminUser
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Badly formatted user", http.StatusBadRequest)
+				return
+			}
+			user, err := h.addUser(r.Context(), usw, &req)
+			if err != nil {
+				serveAdminError(w, err)
+				return
+			}
+			log.Printf("user %q created by %q", user.Username, u.Username)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(newAdminUser(user))
+		default:
+			http.Error(w, "Must use GET or POST", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	user, ok := users[access.Username(name)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		var req AdminUserUpdate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Badly formatted user", http.StatusBadRequest)
+			return
+		}
+		if req.Nickname != nil {
+			user.Nickname = strings.TrimSpace(*req.Nickname)
+		}
+		if req.Groups != nil {
+			user.Groups = *req.Groups
+		}
+		if req.Disabled != nil {
+			user.Disabled = *req.Disabled
+		}
+		if user.Username == u.Username && (user.Disabled || !user.IsAdmin()) {
+			http.Error(w, "You can't disable yourself or leave the admin group", http.StatusConflict)
+			return
+		}
+		var sessions []session.SessionId
+		if user.Disabled {
+			// Find them first, in case the datastore can't:
+			if sessions, err = h.userSessions(r.Context(), user.Username); err != nil {
+				serveAdminError(w, err)
+				return
+			}
+		}
+		if err := usw.UpdateUser(r.Context(), &user); err != nil {
+			serveAdminError(w, err)
+			return
+		}
+		if err := h.deleteSessions(r.Context(), sessions); err != nil {
+			serveAdminError(w, err)
+			return
+		}
+		log.Printf("user %q updated by %q: %+v", user.Username, u.Username, newAdminUser(&user))
+	case "DELETE":
+		if user.Username == u.Username {
+			http.Error(w, "You can't delete yourself", http.StatusConflict)
+			return
+		}
+		if err := h.deleteUser(r.Context(), usw, user.Username); err != nil {
+			serveAdminError(w, err)
+			return
+		}
+		log.Printf("user %q deleted by %q", user.Username, u.Username)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Must use GET, PATCH or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminUser(&user))
+}
+
+func (h *PasswordAuthHandler) addUser(ctx context.Context, usw access.UserStoreWriter, req *AdminUser) (*access.User, error) {
+	user := &access.User{
+		Username: access.Username(strings.TrimSpace(string(req.Username))),
+		Nickname: strings.TrimSpace(req.Nickname),
+		Groups:   req.Groups,
+		Disabled: req.Disabled,
+	}
+	if !validUsername(user.Username) {
+		return nil, fmt.Errorf("%w: usernames must be up to %d letters, digits, and . _ @ -", ErrBadUser, maxUsernameLen)
+	}
+	if user.Nickname == "" {
+		user.Nickname = string(user.Username)
+	}
+	if req.Password != "" {
+		if err := h.PasswordPolicy.check(user.Username, req.Password); err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = string(hash)
+	}
+	return user, usw.AddUser(ctx, user)
+}
+
+// deleteUser also removes the user's OTP and passkeys, so that they don't
+// pass to a new user of the same name.
+func (h *PasswordAuthHandler) deleteUser(ctx context.Context, usw access.UserStoreWriter, u access.Username) error {
+	// Find them first, in case the datastore can't:
+	sessions, err := h.userSessions(ctx, u)
+	if err != nil {
+		return err
+	}
+	if otps, ok := h.UserStore.(access.OTPStore); ok {
+		if err := otps.SaveOTP(ctx, u, nil); err != nil && !errors.Is(err, store.ErrNoOTPStore) {
+			return err
+		}
+	}
+	if pks, ok := h.UserStore.(access.PasskeyStore); ok {
+		passkeys, err := pks.Passkeys(ctx, u)
+		if err != nil {
+			return err
+		}
+		for _, pk := range passkeys {
+			if err := pks.DeletePasskey(ctx, u, pk.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := usw.DeleteUser(ctx, u); err != nil {
+		return err
+	}
+	return h.deleteSessions(ctx, sessions)
+}
+
+// userSessions returns the IDs of u's sessions, including their API tokens,
+// and of the guest passes they issued. It is called before u is disabled or
+// deleted, so that nothing is changed if the datastore can't find them.
+func (h *PasswordAuthHandler) userSessions(ctx context.Context, u access.Username) ([]session.SessionId, error) {
+	ss := h.SessionStore
+	var ids []session.SessionId
+	for _, find := range []func(context.Context, access.Username) (map[session.SessionId]*session.Session, error){
+		ss.SessionsForUser,
+		ss.SessionsByParent,
+	} {
+		sessions, err := find(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		for id := range sessions {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// deleteSessions signs out the sessions found by userSessions.
+func (h *PasswordAuthHandler) deleteSessions(ctx context.Context, ids []session.SessionId) error {
+	for _, id := range ids {
+		if err := h.SessionStore.DeleteSession(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxUsernameLen is the width of the username columns in schema.sql.
+const maxUsernameLen = 30
+
+func validUsername(u access.Username) bool {
+	if u == "" || len(u) > maxUsernameLen {
+		return false
+	}
+	for _, c := range u {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '@', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func serveAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrBadUser), errors.Is(err, ErrWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, access.ErrUserExists):
+		http.Error(w, "User already exists", http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "No such user", http.StatusNotFound)
+	case errors.Is(err, store.ErrNoUserStoreWriter):
+		http.Error(w, "User management not supported by this datastore", http.StatusNotImplemented)
+	case errors.Is(err, store.ErrNoSessionsForUser), errors.Is(err, store.ErrNoSessionsByParent):
+		http.Error(w, "Signing users out not supported by this datastore", http.StatusNotImplemented)
+	default:
+		log.Printf("user management failed: %v", err)
+		http.Error(w, "Error managing users", http.StatusInternalServerError)
+	}
+}
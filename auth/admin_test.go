@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestAdminUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	users := `{"users":{` +
+		`"alice":{"nickname":"Alice","password_hash":"` + string(hash) + `","groups":["admin"]},` +
+		`"bob":{"nickname":"Bob","password_hash":"` + string(hash) + `"}}}`
+	if err := os.WriteFile(dir+"/users.json", []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := &store.FileStore{Path: dir + "/users.json", OTPPath: dir + "/otp.json"}
+	us := &store.UserStoreCache{UserStore: fs}
+	ss := &store.SessionStoreCache{}
+	h := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    us,
+		SessionStore: ss,
+	}
+	ctx := context.Background()
+	// Bob has signed in, and issued an API token and a guest pass:
+	expiry := time.Now().Add(time.Hour)
+	for id, s := range map[session.SessionId]*session.Session{
+		"bob":      {Username: "bob", Expiry: expiry},
+		"bobtoken": {Username: "bob", Expiry: expiry, Extra: session.Extra(`{"Method":"password"}`)},
+		"bobguest": {Username: "guest", Expiry: expiry, Extra: session.Extra(`{"Parent":"bob"}`)},
+		"carol":    {Username: "carol", Expiry: expiry},
+	} {
+		if err := ss.SaveSession(ctx, id, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signedIn := func(id session.SessionId) bool {
+		_, err := ss.Session(ctx, id)
+		return err == nil
+	}
+	alice, err := us.User(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := us.User(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(as *access.User, method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body)).WithContext(as.NewContext(ctx))
+		w := httptest.NewRecorder()
+		h.ServeAdminUsers(w, r)
+		return w
+	}
+	login := func(username, password string) error {
+		_, err := access.Authenticate(ctx, us, access.Username(username), password)
+		return err
+	}
+
+	for _, tc := range []struct {
+		name         string
+		as           *access.User
+		method, url  string
+		body         string
+		want         int
+		wantUsername access.Username
+	}{
+		{"not admin", bob, "GET", "/api/admin/users", "", http.StatusForbidden, ""},
+		{"bad username", alice, "POST", "/api/admin/users", `{"username":"../carol"}`, http.StatusBadRequest, ""},
+		{"long username", alice, "POST", "/api/admin/users", `{"username":"` + strings.Repeat("c", maxUsernameLen+1) + `"}`, http.StatusBadRequest, ""},
+		{"weak password", alice, "POST", "/api/admin/users", `{"username":"carol","password":"x"}`, http.StatusBadRequest, ""},
+		{"exists", alice, "POST", "/api/admin/users", `{"username":"bob"}`, http.StatusConflict, ""},
+		{"create", alice, "POST", "/api/admin/users", `{"username":"carol","nickname":"Carol","groups":["flatmates"],"password":"correct horse"}`, http.StatusCreated, "carol"},
+		{"get", alice, "GET", "/api/admin/users/carol", "", http.StatusOK, "carol"},
+		{"no such user", alice, "GET", "/api/admin/users/dave", "", http.StatusNotFound, ""},
+		{"disable self", alice, "PATCH", "/api/admin/users/alice", `{"disabled":true}`, http.StatusConflict, ""},
+		{"leave admin", alice, "PATCH", "/api/admin/users/alice", `{"groups":[]}`, http.StatusConflict, ""},
+		{"delete self", alice, "DELETE", "/api/admin/users/alice", "", http.StatusConflict, ""},
+		{"disable", alice, "PATCH", "/api/admin/users/bob", `{"disabled":true}`, http.StatusOK, "bob"},
+	} {
+		w := serve(tc.as, tc.method, tc.url, tc.body)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d %q, want %d", tc.name, w.Code, w.Body.String(), tc.want)
+			continue
+		}
+		if tc.wantUsername == "" {
+			continue
+		}
+		var au AdminUser
+		if err := json.NewDecoder(w.Body).Decode(&au); err != nil || au.Username != tc.wantUsername || au.Password != "" {
+			t.Errorf("%s: got %+v %v", tc.name, au, err)
+		}
+	}
+
+	if err := login("carol", "correct horse"); err != nil {
+		t.Errorf("new user: %v", err)
+	}
+	if err := login("bob", "hunter2"); err == nil {
+		t.Errorf("disabled user logged in")
+	}
+	for _, id := range []session.SessionId{"bob", "bobtoken", "bobguest"} {
+		if signedIn(id) {
+			t.Errorf("disabled user's session %s still valid", id)
+		}
+	}
+	// Disabled users are still listed:
+	var list []AdminUser
+	if err := json.NewDecoder(serve(alice, "GET", "/api/admin/users", "").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	want := []AdminUser{
+		{Username: "alice", Nickname: "Alice", Groups: access.Groups{"admin"}},
+		{Username: "bob", Nickname: "Bob", Groups: access.Groups{}, Disabled: true},
+		{Username: "carol", Nickname: "Carol", Groups: access.Groups{"flatmates"}},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("list: got %+v, want %+v", list, want)
+	}
+
+	// Nothing is changed if the datastore can't find the user's sessions:
+	noFind := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    us,
+		SessionStore: noSessionQueries{ss},
+	}
+	for _, method := range []string{"PATCH", "DELETE"} {
+		r := httptest.NewRequest(method, "/api/admin/users/carol", strings.NewReader(`{"disabled":true}`)).WithContext(alice.NewContext(ctx))
+		w := httptest.NewRecorder()
+		noFind.ServeAdminUsers(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("%s without session queries: got %d %q, want %d", method, w.Code, w.Body.String(), http.StatusNotImplemented)
+		}
+		if err := login("carol", "correct horse"); err != nil {
+			t.Errorf("%s without session queries: user was changed: %v", method, err)
+		}
+	}
+
+	// Deleting a user removes their OTP too:
+	if err := fs.SaveOTP(ctx, "carol", &access.OTP{Secret: "x", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(alice, "DELETE", "/api/admin/users/carol", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %q", w.Code, w.Body.String())
+	}
+	if err := login("carol", "correct horse"); err == nil {
+		t.Errorf("deleted user logged in")
+	}
+	if signedIn("carol") {
+		t.Errorf("deleted user's session still valid")
+	}
+	if _, err := fs.OTP(ctx, "carol"); err != access.ErrNoOTP {
+		t.Errorf("deleted user's OTP: got %v, want %v", err, access.ErrNoOTP)
+	}
+}
+
+// noSessionQueries is a SessionStore which, like a DBStore without the
+// queries configured, can't find a user's sessions.
+type noSessionQueries struct {
+	session.SessionStore
+}
+
+func (noSessionQueries) SessionsForUser(ctx context.Context, u access.Username) (map[session.SessionId]*session.Session, error) {
+	return nil, store.ErrNoSessionsForUser
+}
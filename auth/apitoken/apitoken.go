@@ -0,0 +1,425 @@
+// Package apitoken lets users create long-lived bearer tokens for scripts
+// and home automation, optionally limited to some devices and actions.
+package apitoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/auth"
+	"jeremy.visser.name/go/unlockr/debug"
+	"jeremy.visser.name/go/unlockr/device"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+const key = "apitoken"
+
+// noExpiry is used as the session expiry of tokens which never expire.
+const noExpiry = 100 * 365 * 24 * time.Hour
+
+// SnapshotLifetime is the longest a token may last if its owner can't be
+// looked up in the UserStore (i.e. OAuth and header users), as it acts
+// with a copy of them which can't follow changes to their account.
+const SnapshotLifetime = 30 * 24 * time.Hour
+
+// Extra is stored with the token's session, whose Username is the owner.
+type Extra struct {
+	Type extraType // "apitoken"
+
+	// Parent is the user who created the token, and whom it acts as.
+	// User is a copy of them, for auth methods without a UserStore.
+	Parent access.Username
+	User   *access.User
+
+	// Method is the auth method the owner logged in with. Owners of
+	// "password" tokens are looked up in the UserStore on every use.
+	Method string `json:",omitempty"`
+
+	Name    string
+	Created time.Time
+
+	// Expiry is nil if the token never expires.
+	Expiry *time.Time `json:",omitempty"`
+
+	// Devices and Actions limit what the token may do. Empty means no limit,
+	// beyond the owner's own access.
+	Devices []device.ID     `json:",omitempty"`
+	Actions []access.Action `json:",omitempty"`
+}
+
+func (e Extra) MarshalJSON() ([]byte, error) {
+	e.Type = key
+	return json.Marshal(jsonExtra(e))
+}
+
+func (e *Extra) UnmarshalJSON(data []byte) error {
+	var je jsonExtra
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+	if je.Type != key {
+		return fmt.Errorf("%w: got '%s', want '%s'", ErrType, je.Type, key)
+	}
+	*e = Extra(je)
+	return nil
+}
+
+var _ json.Marshaler = (*Extra)(nil)
+var _ json.Unmarshaler = (*Extra)(nil)
+
+type extraType string
+type jsonExtra Extra // un-implement json.Marshaler/Unmarshaler
+
+var ErrType = errors.New("invalid session extra type")
+var ErrNoUserStore = errors.New("API tokens of password users need a UserStore")
+
+// snapshot is true if the token acts as the copy of its owner in User,
+// rather than looking them up, as auth methods other than "password"
+// don't keep users in the UserStore.
+func (e *Extra) snapshot() bool {
+	return e.Method != "" && e.Method != "password"
+}
+
+// Handler authenticates requests with an API token, and passes the rest
+// to Passthru.
+type Handler struct {
+	Passthru     http.Handler
+	Handler      http.Handler
+	SessionStore session.SessionStore
+
+	// UserStore is required for tokens created by password users, whose
+	// owner is looked up on every use, so that changes to their groups (or
+	// their removal) take effect.
+	UserStore access.UserStore
+
+	// Devices is used to validate device IDs when creating tokens.
+	Devices device.DeviceList
+}
+
+// allowedPaths may be used with an API token. Tokens can't manage tokens,
+// guest passes or the user's credentials.
+var allowedPaths = []string{"/api/index", "/api/device/", "/api/events", "/api/user"}
+
+func allowedPath(p string) bool {
+	for _, a := range allowedPaths {
+		if p == a || (strings.HasSuffix(a, "/") && strings.HasPrefix(p, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isToken(r *http.Request) bool {
+	t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && strings.HasPrefix(t, session.TokenPrefix)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isToken(r) {
+		h.Passthru.ServeHTTP(w, r)
+		return
+	}
+
+	// Tokens are never passed through, even if invalid:
+	ctx, id, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
+	if err != nil {
+		if debug.Debug() {
+			log.Printf("APITokenHandler: session.FromRequest: %v", err)
+		}
+		http.Error(w, "API token not valid", http.StatusUnauthorized)
+		return
+	}
+	var extra Extra
+	if err := json.Unmarshal(s.Extra, &extra); err != nil {
+		log.Printf("APITokenHandler: not an API token: %v", err)
+		http.Error(w, "API token not valid", http.StatusUnauthorized)
+		return
+	}
+	if !allowedPath(r.URL.Path) {
+		http.Error(w, "Not allowed with an API token", http.StatusForbidden)
+		return
+	}
+	u, err := h.user(ctx, s, &extra)
+	if err != nil {
+		log.Printf("APITokenHandler: owner of token %q not valid: %v", extra.Name, err)
+		http.Error(w, "user not valid", http.StatusUnauthorized)
+		return
+	}
+
+	ctx = u.NewContext(ctx)
+	ctx = access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+		s, err := session.Get(ctx, id, h.SessionStore)
+		if err != nil {
+			return nil, err
+		}
+		var extra Extra
+		if err := json.Unmarshal(s.Extra, &extra); err != nil {
+			return nil, err
+		}
+		return h.user(ctx, s, &extra)
+	})
+	if len(extra.Devices) > 0 {
+		ctx = device.NewContextScope(ctx, extra.Devices)
+	}
+	if len(extra.Actions) > 0 {
+		ctx = device.NewContextActions(ctx, extra.Actions)
+	}
+	h.Handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+var errNoOwner = errors.New("token has no owner")
+
+// user returns the user whom the token with session s acts as.
+func (h *Handler) user(ctx context.Context, s *session.Session, extra *Extra) (*access.User, error) {
+	if extra.snapshot() {
+		if extra.User == nil {
+			return nil, errNoOwner
+		}
+		return extra.User, nil
+	}
+	if h.UserStore == nil {
+		return nil, ErrNoUserStore
+	}
+	return h.UserStore.User(ctx, s.Username)
+}
+
+// Request is the JSON body when creating a token.
+type Request struct {
+	Name string `json:"name"`
+
+	// Expiry is optional. Tokens without one last until revoked.
+	Expiry *time.Time `json:"expiry,omitempty"`
+
+	Devices []device.ID     `json:"devices,omitempty"`
+	Actions []access.Action `json:"actions,omitempty"`
+}
+
+var ErrBadRequest = errors.New("invalid API token request")
+
+// Actions which may be given to a token.
+var scopeActions = []access.Action{
+	access.ActionPowerOn,
+	access.ActionPowerOff,
+	access.ActionPulse,
+	access.ActionState,
+}
+
+func (h *Handler) validate(u *access.User, req *Request) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrBadRequest)
+	}
+	if req.Expiry != nil && !req.Expiry.After(time.Now()) {
+		return fmt.Errorf("%w: expiry must be in the future", ErrBadRequest)
+	}
+actions:
+	for _, a := range req.Actions {
+		for _, sa := range scopeActions {
+			if a == sa {
+				continue actions
+			}
+		}
+		return fmt.Errorf("%w: unknown action: %s", ErrBadRequest, a)
+	}
+	if h.Devices == nil {
+		return nil
+	}
+	for _, id := range req.Devices {
+		dev, ok := h.Devices[id]
+		if !ok {
+			return fmt.Errorf("%w: unknown device: %s", ErrBadRequest, id)
+		}
+		if err := dev.GetACL().UserCan(u, access.ActionView); err != nil {
+			return fmt.Errorf("%w: may not access device %s: %w", ErrBadRequest, id, err)
+		}
+	}
+	return nil
+}
+
+// Info describes a token. Token is only returned when it is created.
+type Info struct {
+	Token string  `json:"token,omitempty"`
+	ID    TokenID `json:"id"`
+
+	Name    string          `json:"name"`
+	Created time.Time       `json:"created"`
+	Expiry  *time.Time      `json:"expiry,omitempty"`
+	Devices []device.ID     `json:"devices,omitempty"`
+	Actions []access.Action `json:"actions,omitempty"`
+}
+
+// TokenID identifies a token without revealing it.
+type TokenID string
+
+func newTokenID(id session.SessionId) TokenID {
+	hash := strings.TrimPrefix(string(id), session.TokenPrefix)
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return TokenID(hash)
+}
+
+func newInfo(id session.SessionId, e *Extra) Info {
+	return Info{
+		ID:      newTokenID(id),
+		Name:    e.Name,
+		Created: e.Created,
+		Expiry:  e.Expiry,
+		Devices: e.Devices,
+		Actions: e.Actions,
+	}
+}
+
+const tokensPath = "/api/tokens"
+
+// ServeTokens creates a token with POST /api/tokens, lists the user's
+// tokens with GET, or revokes one with DELETE /api/tokens/{id}.
+func (h *Handler) ServeTokens(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot manage API tokens", http.StatusForbidden)
+		return
+	}
+	tid, _ := strings.CutPrefix(r.URL.Path, tokensPath)
+	tid = strings.TrimPrefix(tid, "/")
+
+	switch {
+	case tid == "" && r.Method == "POST":
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Badly formatted API token request", http.StatusBadRequest)
+			return
+		}
+		if err := h.validate(u, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token, id, extra, err := h.NewToken(r.Context(), u, &req)
+		if err != nil {
+			log.Printf("Error creating API token: %v", err)
+			http.Error(w, "error creating API token", http.StatusInternalServerError)
+			return
+		}
+		info := newInfo(id, extra)
+		info.Token = token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+		return
+	case tid == "" && r.Method == "GET", tid != "" && r.Method == "DELETE":
+	default:
+		http.Error(w, "Must use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokens, err := h.tokens(r.Context(), u.Username)
+	if err != nil {
+		log.Printf("Error listing API tokens: %v", err)
+		http.Error(w, "error listing API tokens", http.StatusInternalServerError)
+		return
+	}
+	if tid == "" {
+		list := make([]Info, 0, len(tokens))
+		for id, e := range tokens {
+			list = append(list, newInfo(id, e))
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Created.Before(list[j].Created)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	for id := range tokens {
+		if newTokenID(id) != TokenID(tid) {
+			continue
+		}
+		if err := h.revoke(r.Context(), id); err != nil {
+			log.Printf("Error revoking API token: %v", err)
+			http.Error(w, "error revoking API token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// NewToken creates a token for u, returning the token itself, which
+// can't be recovered later.
+//
+// Tokens of password users act as them as they are when the token is used.
+// Other users' tokens act as a copy of them, and last SnapshotLifetime at
+// most.
+func (h *Handler) NewToken(ctx context.Context, u *access.User, req *Request) (string, session.SessionId, *Extra, error) {
+	method, _ := auth.MethodFromContext(ctx)
+	extra := &Extra{
+		Parent:  u.Username,
+		User:    u,
+		Method:  method,
+		Name:    strings.TrimSpace(req.Name),
+		Created: time.Now(),
+		Expiry:  req.Expiry,
+		Devices: req.Devices,
+		Actions: req.Actions,
+	}
+	if !extra.snapshot() && h.UserStore == nil {
+		return "", "", nil, ErrNoUserStore
+	}
+	if max := extra.Created.Add(SnapshotLifetime); extra.snapshot() && (extra.Expiry == nil || extra.Expiry.After(max)) {
+		extra.Expiry = &max
+	}
+	data, err := json.Marshal(extra)
+	if err != nil {
+		return "", "", nil, err
+	}
+	s := &session.Session{
+		Username: u.Username,
+		Expiry:   extra.Created.Add(noExpiry),
+		Extra:    data,
+	}
+	if extra.Expiry != nil {
+		s.Expiry = *extra.Expiry
+	}
+	token, id, err := session.NewToken(ctx, s, h.SessionStore)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return token, id, extra, nil
+}
+
+// tokens returns the valid tokens created by u.
+func (h *Handler) tokens(ctx context.Context, u access.Username) (map[session.SessionId]*Extra, error) {
+	sessions, err := h.SessionStore.SessionsByParent(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[session.SessionId]*Extra, len(sessions))
+	for id, s := range sessions {
+		extra := new(Extra)
+		if err := json.Unmarshal(s.Extra, extra); err != nil {
+			continue // not an API token
+		}
+		if s.Username == u && !s.IsExpired() {
+			tokens[id] = extra
+		}
+	}
+	return tokens, nil
+}
+
+// revoke deletes the token's session.
+func (h *Handler) revoke(ctx context.Context, id session.SessionId) error {
+	return h.SessionStore.DeleteSession(ctx, id)
+}
@@ -0,0 +1,225 @@
+package apitoken
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/auth"
+	"jeremy.visser.name/go/unlockr/device"
+	"jeremy.visser.name/go/unlockr/noop"
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestTokens(t *testing.T) {
+	dl := device.DeviceList{
+		"side-gate":  &noop.Device{Base: device.Base{Name: "Side Gate"}},
+		"house-door": &noop.Device{Base: device.Base{Name: "House Door"}},
+	}
+	var mux http.ServeMux
+	mux.Handle("/api/device/", dl)
+	ss := &store.SessionStoreCache{}
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      &mux,
+		SessionStore: ss,
+		Devices:      dl,
+	}
+	mux.HandleFunc("/api/tokens", h.ServeTokens)
+	owner := &access.User{Username: "owner", Nickname: "Owner"}
+	ctx := auth.NewContextMethod(owner.NewContext(context.Background()), "oauth")
+
+	manage := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.ServeTokens(w, r)
+		return w
+	}
+	tokenReq := func(token, method, url string) int {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	for _, body := range []string{
+		`{}`,
+		`{"name":"x","devices":["shed"]}`,
+		`{"name":"x","actions":["invite-guest"]}`,
+		`{"name":"x","expiry":"` + past + `"}`,
+	} {
+		if w := manage("POST", "/api/tokens", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := manage("POST", "/api/tokens", `{"name":"Side gate NFC tag","devices":["side-gate"],"actions":["pulse"]}`)
+	var info Info
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %v", w.Code, err)
+	}
+	if !strings.HasPrefix(info.Token, session.TokenPrefix) {
+		t.Errorf("token %q lacks prefix", info.Token)
+	}
+	// Only a hash of the token is stored:
+	if _, err := ss.Session(ctx, session.SessionId(info.Token)); err == nil {
+		t.Errorf("token stored unhashed")
+	}
+
+	for _, tc := range []struct {
+		method, url string
+		want        int
+	}{
+		{"POST", "/api/device/side-gate/pulse?duration=1ms", http.StatusOK},
+		{"POST", "/api/device/side-gate/power/on", http.StatusForbidden},
+		{"POST", "/api/device/house-door/pulse?duration=1ms", http.StatusNotFound},
+		{"GET", "/api/tokens", http.StatusForbidden},
+		{"GET", "/api/guest/tokens", http.StatusForbidden},
+	} {
+		if code := tokenReq(info.Token, tc.method, tc.url); code != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.url, code, tc.want)
+		}
+	}
+	if code := tokenReq(session.TokenPrefix+"bogus", "GET", "/api/device/"); code != http.StatusUnauthorized {
+		t.Errorf("bogus token: got %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Tokens can't be used as cookies, which would bypass their scope:
+	r := httptest.NewRequest("GET", "/api/device/", nil)
+	r.AddCookie(&http.Cookie{Name: "Unlockr-Session", Value: info.Token})
+	if _, _, _, err := session.FromRequest(r.Context(), r, ss); err == nil {
+		t.Errorf("token accepted as cookie")
+	}
+
+	var list []Info
+	if err := json.NewDecoder(manage("GET", "/api/tokens", "").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != info.ID || list[0].Token != "" || list[0].Name != "Side gate NFC tag" {
+		t.Errorf("list: got %+v", list)
+	}
+
+	if w := manage("DELETE", "/api/tokens/"+string(info.ID), ""); w.Code != http.StatusNoContent {
+		t.Errorf("revoke: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if code := tokenReq(info.Token, "GET", "/api/device/"); code != http.StatusUnauthorized {
+		t.Errorf("revoked: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if w := manage("DELETE", "/api/tokens/"+string(info.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke again: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTokenOwner(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	if err := os.WriteFile(path, []byte(`{"users":{"owner":{"nickname":"Owner"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	us := &store.FileStore{Path: path}
+	var mux http.ServeMux
+	mux.HandleFunc("/api/user", func(w http.ResponseWriter, r *http.Request) {})
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      &mux,
+		SessionStore: &store.SessionStoreCache{},
+		UserStore:    us,
+	}
+	owner := &access.User{Username: "owner", Nickname: "Owner"}
+	newToken := func(method string) (string, *Extra) {
+		ctx := auth.NewContextMethod(owner.NewContext(context.Background()), method)
+		token, _, extra, err := h.NewToken(ctx, owner, &Request{Name: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, extra
+	}
+	use := func(token string) int {
+		r := httptest.NewRequest("GET", "/api/user", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Tokens of users who aren't in the UserStore can't outlive them forever:
+	oauthToken, extra := newToken("oauth")
+	if max := time.Now().Add(SnapshotLifetime); extra.Expiry == nil || extra.Expiry.After(max) {
+		t.Errorf("oauth token expiry: got %v, want at most %v", extra.Expiry, max)
+	}
+
+	// ...whereas password users are looked up, so disabling them stops
+	// their tokens:
+	passwordToken, extra := newToken("password")
+	if extra.Expiry != nil {
+		t.Errorf("password token expiry: got %v, want none", extra.Expiry)
+	}
+	if code := use(passwordToken); code != http.StatusOK {
+		t.Errorf("password token: got %d, want %d", code, http.StatusOK)
+	}
+	if err := us.UpdateUser(context.Background(), &access.User{Username: "owner", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if code := use(passwordToken); code != http.StatusUnauthorized {
+		t.Errorf("disabled owner: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := use(oauthToken); code != http.StatusOK {
+		t.Errorf("oauth token: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+// Tests that tokens are found again when stored in a database, which
+// stores them under a hash of the token.
+func TestTokensDBStore(t *testing.T) {
+	ctx := context.Background()
+	db := &store.SQLiteStore{Path: t.TempDir() + "/unlockr.db"}
+	if err := db.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dl := device.DeviceList{"side-gate": &noop.Device{Base: device.Base{Name: "Side Gate"}}}
+	var mux http.ServeMux
+	mux.Handle("/api/device/", dl)
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      &mux,
+		SessionStore: db,
+		UserStore:    db,
+		Devices:      dl,
+	}
+	owner := &access.User{Username: "owner", Nickname: "Owner"}
+	if err := db.AddUser(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	token, id, _, err := h.NewToken(ctx, owner, &Request{Name: "NFC tag", Devices: []device.ID{"side-gate"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.Session(ctx, id); err != nil || s.Username != "owner" {
+		t.Fatalf("stored token: got %+v %v", s, err)
+	}
+
+	use := func() int {
+		r := httptest.NewRequest("POST", "/api/device/side-gate/pulse?duration=1ms", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := use(); code != http.StatusOK {
+		t.Errorf("use: got %d, want %d", code, http.StatusOK)
+	}
+	if err := h.revoke(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if code := use(); code != http.StatusUnauthorized {
+		t.Errorf("revoked: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -1,5 +1,6 @@
 package auth
 
 const LoginURL string = "/api/login"
+const PasskeyLoginURL string = "/api/login/passkey"
 const LogoutURL string = "/api/logout"
 const OAuthRedirectURL string = "/api/exchange"
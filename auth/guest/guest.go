@@ -2,16 +2,23 @@ package guest
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
+	"jeremy.visser.name/go/unlockr/auth"
 	"jeremy.visser.name/go/unlockr/debug"
+	"jeremy.visser.name/go/unlockr/device"
 	"jeremy.visser.name/go/unlockr/session"
 )
 
@@ -24,7 +31,7 @@ var ctxKey ctxKeyType
 type Config struct {
 	// Lifetime is how long a guest pass can exist for.
 	// Zero value means guest passes are not allowed.
-	Lifetime Lifetime `json:"lifetime"`
+	Lifetime device.Duration `json:"lifetime"`
 }
 
 func (c *Config) Enabled() bool {
@@ -38,50 +45,50 @@ func (c *Config) NewContext(parent context.Context) context.Context {
 	return context.WithValue(parent, ctxKey, c)
 }
 
-type Lifetime time.Duration
-
-func (l *Lifetime) UnmarshalJSON(v []byte) error {
-	var s string
-	err := json.Unmarshal(v, &s)
-	if err != nil {
-		var errU *json.UnmarshalTypeError
-		if errors.As(err, &errU) {
-			if errU.Type.Kind() == reflect.String {
-				// String failed, try again as time.Duration:
-				var li time.Duration
-				if err := json.Unmarshal(v, &li); err == nil {
-					*l = Lifetime(li)
-					return nil
-				}
-				// Return original error if second try failed.
-			}
-		}
-		return err
-	}
-
-	d, err := time.ParseDuration(s)
-	if err != nil {
-		return err
-	}
-
-	*l = Lifetime(d)
-	return nil
-}
-
 type Extra struct {
 	Type extraType // "guest"
 
 	User   *access.User    // User is the guest
 	Parent access.Username // Parent created the guest
 
+	// Method is the auth method the parent logged in with. Parents of
+	// "password" guests are looked up in the UserStore on every use.
+	Method string `json:",omitempty"`
+
 	// Expiry is never renewed:
 	Expiry time.Time
+
+	// Devices limits the guest to a subset of devices. Empty means
+	// the guest may access every device the parent can.
+	Devices []device.ID `json:",omitempty"`
+
+	// NotBefore is when the guest pass starts working, if set.
+	NotBefore *time.Time `json:",omitempty"`
+
+	// Uses is the number of device actions remaining. Nil means unlimited.
+	Uses *int `json:",omitempty"`
+
+	// Label is a reminder for the parent of who the pass was for.
+	Label   string     `json:",omitempty"`
+	Created *time.Time `json:",omitempty"`
 }
 
 func (e *Extra) IsValid() bool {
 	return e.Expiry.After(time.Now())
 }
 
+// IsStarted is false if the guest pass has a NotBefore time in the future.
+func (e *Extra) IsStarted() bool {
+	return e.NotBefore == nil || !time.Now().Before(*e.NotBefore)
+}
+
+// snapshot is true if the guest inherits the copy of its parent's groups in
+// User, rather than looking the parent up, as auth methods other than
+// "password" don't keep users in the UserStore.
+func (e *Extra) snapshot() bool {
+	return e.Method != "" && e.Method != "password"
+}
+
 func (e Extra) MarshalJSON() ([]byte, error) {
 	e.Type = key
 	return json.Marshal(jsonExtra(e))
@@ -112,6 +119,14 @@ type Handler struct {
 	Handler      http.Handler
 	SessionStore session.SessionStore
 	Config       *Config
+
+	// UserStore is optional. If set, the parents of guests of password
+	// users are looked up on every use, so that changes to their groups
+	// (or their removal) take effect.
+	UserStore access.UserStore
+
+	// Devices is used to validate device IDs when creating guest passes.
+	Devices device.DeviceList
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -120,7 +135,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	{
 		// If any failures occur, pass to next handler:
-		ctx, _, s, err := session.FromRequest(ctx, r, h.SessionStore)
+		ctx, id, s, err := session.FromRequest(ctx, r, h.SessionStore)
 		if err != nil {
 			if debug.Debug() {
 				log.Printf("GuestHandler: session.FromRequest: %v", err)
@@ -149,10 +164,49 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		if !extra.IsStarted() {
+			http.Error(w, "Guest pass not yet valid", http.StatusForbidden)
+			return
+		}
+
+		g, err := h.user(ctx, &extra)
+		if err != nil {
+			log.Printf("GuestHandler: parent %q of guest pass not valid: %v", extra.Parent, err)
+			http.Error(w, "Guest pass not valid", http.StatusForbidden)
+			return
+		}
 
 		// Put guest into context and invoke child handler:
-		ctx = extra.User.NewContext(ctx)
-		h.Handler.ServeHTTP(w, r.WithContext(ctx))
+		ctx = g.NewContext(ctx)
+		ctx = access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+			return h.recheck(ctx, id)
+		})
+		ctx = access.NewContextParent(ctx, extra.Parent)
+		if len(extra.Devices) > 0 {
+			ctx = device.NewContextScope(ctx, extra.Devices)
+		}
+		r = r.WithContext(ctx)
+
+		if extra.Uses == nil || !isAction(r) {
+			h.Handler.ServeHTTP(w, r)
+			return
+		}
+		if err := h.takeUse(ctx, id); errors.Is(err, ErrNoUses) {
+			http.Error(w, "Guest pass has been used up", http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("GuestHandler: %v", err)
+			http.Error(w, "error updating guest pass", http.StatusInternalServerError)
+			return
+		}
+		sw := &audit.StatusWriter{ResponseWriter: w}
+		h.Handler.ServeHTTP(sw, r)
+		if sw.Status != 0 && (sw.Status < 200 || sw.Status > 299) {
+			// Failed actions don't count:
+			if err := h.refundUse(ctx, id); err != nil {
+				log.Printf("GuestHandler: %v", err)
+			}
+		}
 		return
 	}
 
@@ -163,9 +217,196 @@ passthru:
 	h.Passthru.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// user returns the guest of a guest pass. Guests of password users inherit
+// the current groups of their parent, and stop working if the parent can't
+// be found or is disabled.
+func (h *Handler) user(ctx context.Context, extra *Extra) (*access.User, error) {
+	g := *extra.User
+	g.Parent = extra.Parent
+	if extra.snapshot() || h.UserStore == nil {
+		return &g, nil
+	}
+	parent, err := h.UserStore.User(ctx, extra.Parent)
+	if err != nil {
+		return nil, err
+	}
+	inherited, err := NewUser(parent)
+	if err != nil {
+		return nil, err
+	}
+	g.Groups = inherited.Groups
+	g.ParentUser = parent
+	return &g, nil
+}
+
+// recheck returns the guest of the guest pass id, if it is still valid.
+func (h *Handler) recheck(ctx context.Context, id session.SessionId) (*access.User, error) {
+	s, err := session.Get(ctx, id, h.SessionStore)
+	if err != nil {
+		return nil, err
+	}
+	var extra Extra
+	if err := json.Unmarshal(s.Extra, &extra); err != nil {
+		return nil, err
+	}
+	if !extra.IsValid() || !extra.IsStarted() {
+		return nil, session.ErrSessionExpired
+	}
+	return h.user(ctx, &extra)
+}
+
+// isAction reports whether r performs a device action, which consumes a use.
+func isAction(r *http.Request) bool {
+	return r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/api/device/")
+}
+
+var ErrNoUses = errors.New("guest pass has no uses remaining")
+
+// takeUse decrements the remaining uses of the guest pass id.
+func (h *Handler) takeUse(ctx context.Context, id session.SessionId) error {
+	return h.updateUses(ctx, id, -1)
+}
+
+// refundUse gives back a use taken by takeUse.
+func (h *Handler) refundUse(ctx context.Context, id session.SessionId) error {
+	return h.updateUses(ctx, id, 1)
+}
+
+// errUnlimited stops session.Update from saving a pass without a use limit.
+var errUnlimited = errors.New("guest pass has unlimited uses")
+
+// updateUses saves a copy of the guest session with delta added to its
+// remaining uses. The stored session may be shared with other requests, so
+// is never modified.
+func (h *Handler) updateUses(ctx context.Context, id session.SessionId, delta int) error {
+	// Update fetches again, as the session may have changed since the
+	// request began:
+	_, err := session.Update(ctx, id, h.SessionStore, func(s *session.Session) error {
+		var extra Extra
+		if err := json.Unmarshal(s.Extra, &extra); err != nil {
+			return fmt.Errorf("decoding guest session: %w", err)
+		}
+		if extra.Uses == nil {
+			return errUnlimited
+		}
+		uses := *extra.Uses + delta
+		if uses < 0 {
+			return ErrNoUses
+		}
+		extra.Uses = &uses
+		data, err := json.Marshal(extra)
+		if err != nil {
+			return err
+		}
+		s.Extra = data
+		return nil
+	})
+	if errors.Is(err, errUnlimited) {
+		return nil
+	}
+	return err
+}
+
 type Info struct {
-	Token  session.SessionId `json:"token"`
-	Expiry time.Time         `json:"expiry"`
+	// Token is only returned when the guest pass is created.
+	Token session.SessionId `json:"token,omitempty"`
+
+	// ID identifies the guest pass when listing or revoking it.
+	ID PassID `json:"id"`
+
+	Label     string      `json:"label,omitempty"`
+	Created   *time.Time  `json:"created,omitempty"`
+	Expiry    time.Time   `json:"expiry"`
+	Devices   []device.ID `json:"devices,omitempty"`
+	NotBefore *time.Time  `json:"notbefore,omitempty"`
+	Uses      *int        `json:"uses,omitempty"`
+}
+
+func newInfo(id session.SessionId, e *Extra) Info {
+	return Info{
+		ID:        NewPassID(id),
+		Label:     e.Label,
+		Created:   e.Created,
+		Expiry:    e.Expiry,
+		Devices:   e.Devices,
+		NotBefore: e.NotBefore,
+		Uses:      e.Uses,
+	}
+}
+
+// PassID identifies a guest pass without revealing its token.
+type PassID string
+
+func NewPassID(id session.SessionId) PassID {
+	sum := sha256.Sum256([]byte(id))
+	return PassID(hex.EncodeToString(sum[:8]))
+}
+
+// Request is the optional JSON body when creating a guest pass.
+type Request struct {
+	// Devices limits the guest to these devices. Empty means all devices.
+	Devices []device.ID `json:"devices,omitempty"`
+
+	// Expiry is when the guest pass stops working. It is capped at
+	// Config.Lifetime after the pass starts. Defaults to the maximum.
+	Expiry *time.Time `json:"expiry,omitempty"`
+
+	// NotBefore is when the guest pass starts working. Defaults to now.
+	NotBefore *time.Time `json:"notbefore,omitempty"`
+
+	// Uses limits the number of device actions. Zero means unlimited.
+	Uses int `json:"uses,omitempty"`
+
+	// Label is shown when listing guest passes.
+	Label string `json:"label,omitempty"`
+}
+
+var ErrBadRequest = errors.New("invalid guest pass request")
+
+// times returns when a guest pass for req starts and expires.
+func (h *Handler) times(req *Request) (notBefore *time.Time, expiry time.Time, err error) {
+	start := time.Now()
+	if req.NotBefore != nil && req.NotBefore.After(start) {
+		start = *req.NotBefore
+		notBefore = &start
+	}
+	expiry = start.Add(time.Duration(h.Config.Lifetime))
+	if req.Expiry != nil {
+		if !req.Expiry.After(start) {
+			return nil, time.Time{}, fmt.Errorf("%w: expiry must be after the start time", ErrBadRequest)
+		}
+		if req.Expiry.Before(expiry) {
+			expiry = *req.Expiry
+		}
+	}
+	return notBefore, expiry, nil
+}
+
+// validate checks that a guest of parent could access every requested device.
+func (h *Handler) validate(parent *access.User, req *Request) error {
+	if req.Uses < 0 {
+		return fmt.Errorf("%w: uses must not be negative", ErrBadRequest)
+	}
+	if _, _, err := h.times(req); err != nil {
+		return err
+	}
+	if len(req.Devices) == 0 || h.Devices == nil {
+		return nil
+	}
+	g, err := NewUser(parent)
+	if err != nil {
+		return err
+	}
+	for _, id := range req.Devices {
+		dev, ok := h.Devices[id]
+		if !ok {
+			return fmt.Errorf("%w: unknown device: %s", ErrBadRequest, id)
+		}
+		if err := dev.GetACL().UserCan(g, access.ActionView); err != nil {
+			return fmt.Errorf("%w: guests may not access device %s: %w", ErrBadRequest, id, err)
+		}
+	}
+	return nil
 }
 
 func (h *Handler) ServeGuestNew(w http.ResponseWriter, r *http.Request) {
@@ -184,30 +425,161 @@ func (h *Handler) ServeGuestNew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, s, err := h.NewSession(r.Context(), u)
+	// The request body is optional:
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Badly formatted guest pass request", http.StatusBadRequest)
+		return
+	}
+	if err := h.validate(u, &req); errors.Is(err, ErrBadRequest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	id, s, err := h.NewSession(r.Context(), u, &req)
 	if err != nil {
 		log.Printf("Error creating guest pass: %v", err)
 		http.Error(w, "error creating guest pass", http.StatusInternalServerError)
 		return
 	}
+	var extra Extra
+	if err := json.Unmarshal(s.Extra, &extra); err != nil {
+		log.Printf("Error decoding guest pass: %v", err)
+		http.Error(w, "error creating guest pass", http.StatusInternalServerError)
+		return
+	}
+	info := newInfo(id, &extra)
+	info.Token = id
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(Info{
-		Token:  id,
-		Expiry: s.Expiry,
+	json.NewEncoder(w).Encode(info)
+}
+
+const tokensPath = "/api/guest/tokens"
+
+// ServeGuestTokens lists the guest passes issued by the user with GET,
+// or revokes one with DELETE /api/guest/tokens/{id}.
+func (h *Handler) ServeGuestTokens(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot manage guest passes", http.StatusForbidden)
+		return
+	}
+	pid, _ := strings.CutPrefix(r.URL.Path, tokensPath)
+	pid = strings.TrimPrefix(pid, "/")
+
+	passes, err := h.passes(r.Context(), u.Username)
+	if err != nil {
+		log.Printf("Error listing guest passes: %v", err)
+		http.Error(w, "error listing guest passes", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case pid == "" && r.Method == "GET":
+		list := make([]Info, 0, len(passes))
+		for id, e := range passes {
+			list = append(list, newInfo(id, e))
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Expiry.Before(list[j].Expiry)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case pid != "" && r.Method == "DELETE":
+		for id := range passes {
+			if NewPassID(id) != PassID(pid) {
+				continue
+			}
+			if err := h.revoke(r.Context(), id); err != nil {
+				log.Printf("Error revoking guest pass: %v", err)
+				http.Error(w, "error revoking guest pass", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "Must use GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// passes returns the valid guest passes issued by parent.
+func (h *Handler) passes(ctx context.Context, parent access.Username) (map[session.SessionId]*Extra, error) {
+	sessions, err := h.SessionStore.SessionsByParent(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	passes := make(map[session.SessionId]*Extra, len(sessions))
+	for id, s := range sessions {
+		extra := new(Extra)
+		if err := json.Unmarshal(s.Extra, extra); err != nil {
+			continue // not a guest session
+		}
+		if extra.Parent == parent && extra.IsValid() {
+			passes[id] = extra
+		}
+	}
+	return passes, nil
+}
+
+// revoke expires the guest pass id immediately.
+func (h *Handler) revoke(ctx context.Context, id session.SessionId) error {
+	_, err := session.Update(ctx, id, h.SessionStore, func(s *session.Session) error {
+		var extra Extra
+		if err := json.Unmarshal(s.Extra, &extra); err != nil {
+			return err
+		}
+		extra.Expiry = time.Time{}
+		data, err := json.Marshal(extra)
+		if err != nil {
+			return err
+		}
+		s.Extra = data
+		s.Expiry = time.Time{}
+		return nil
 	})
+	return err
 }
 
-func (h *Handler) NewSession(ctx context.Context, parent *access.User) (session.SessionId, *session.Session, error) {
+// NewSession creates a guest pass for a guest of parent.
+// req may be nil for a guest with access to all of parent's devices.
+func (h *Handler) NewSession(ctx context.Context, parent *access.User, req *Request) (session.SessionId, *session.Session, error) {
+	if req == nil {
+		req = new(Request)
+	}
 	g, err := NewUser(parent)
 	if err != nil {
 		return "", nil, err
 	}
 
-	expiry := time.Now().Add(time.Duration(h.Config.Lifetime))
+	notBefore, expiry, err := h.times(req)
+	if err != nil {
+		return "", nil, err
+	}
+	var uses *int
+	if req.Uses > 0 {
+		uses = &req.Uses
+	}
+	created := time.Now()
+	method, _ := auth.MethodFromContext(ctx)
 	extra, err := json.Marshal(Extra{
-		User:   g,
-		Parent: parent.Username,
-		Expiry: expiry,
+		User:      g,
+		Parent:    parent.Username,
+		Method:    method,
+		Expiry:    expiry,
+		Devices:   req.Devices,
+		NotBefore: notBefore,
+		Uses:      uses,
+		Label:     req.Label,
+		Created:   &created,
 	})
 	if err != nil {
 		return "", nil, err
@@ -232,13 +604,21 @@ func (h *Handler) NewSession(ctx context.Context, parent *access.User) (session.
 // This ephemeral user is intended to be embedded in a session record, and
 // destroyed once expired.
 func NewUser(parent *access.User) (guest *access.User, err error) {
-	if parent.Username == key {
+	if parent.Parent != "" || parent.Username == key {
 		return nil, ErrNoGatecrashers
 	}
+	// Copy groups, as guests must never administer:
+	groups := make(access.Groups, 0, len(parent.Groups)+1)
+	for _, g := range parent.Groups {
+		if g != access.AdminGroup {
+			groups = append(groups, g)
+		}
+	}
 	guest = &access.User{
 		Username: key,
 		Nickname: fmt.Sprintf("Guest of %s", parent.Nickname),
-		Groups:   append(parent.Groups, key),
+		Groups:   append(groups, access.GuestGroup),
+		Parent:   parent.Username,
 	}
 	return guest, nil
 }
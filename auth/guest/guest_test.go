@@ -1,11 +1,23 @@
 package guest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/auth"
+	"jeremy.visser.name/go/unlockr/device"
+	"jeremy.visser.name/go/unlockr/noop"
+	"jeremy.visser.name/go/unlockr/store"
 )
 
 func TestExtraType(t *testing.T) {
@@ -83,6 +95,7 @@ func TestNewUser(t *testing.T) {
 		Username: "guest",
 		Nickname: "Guest of Parent",
 		Groups:   access.Groups{"one", "two", "guest"},
+		Parent:   "parent",
 	}
 	if !reflect.DeepEqual(guest, &want) {
 		t.Errorf("unexpected guest value:\n\tgot: %#v\n\twant: %#v", guest, want)
@@ -93,3 +106,316 @@ func TestNewUser(t *testing.T) {
 		t.Errorf("gatecrasher succeeded, wanted err\n\t%#v", gatecrasher)
 	}
 }
+
+// Tests that a guest pass limited to some devices can't see or use others.
+func TestScopedGuest(t *testing.T) {
+	dl := device.DeviceList{
+		"side-gate":  &noop.Device{Base: device.Base{Name: "Side Gate"}},
+		"house-door": &noop.Device{Base: device.Base{Name: "House Door"}},
+	}
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      dl,
+		SessionStore: &store.SessionStoreCache{},
+		Config:       &Config{Lifetime: device.Duration(time.Hour)},
+		Devices:      dl,
+	}
+	parent := &access.User{Username: "parent", Nickname: "Parent"}
+	ctx := parent.NewContext(context.Background())
+
+	// Unknown devices are rejected:
+	r := httptest.NewRequest("POST", "/api/guest/token", strings.NewReader(`{"devices":["shed"]}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	h.ServeGuestNew(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown device: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	r = httptest.NewRequest("POST", "/api/guest/token", strings.NewReader(`{"devices":["side-gate"]}`)).WithContext(ctx)
+	w = httptest.NewRecorder()
+	h.ServeGuestNew(w, r)
+	var info Info
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("ServeGuestNew: %d %v", w.Code, err)
+	}
+
+	guestReq := func(method, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer "+string(info.Token))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w = guestReq("GET", "/api/device/")
+	var devices device.DeviceListResponse
+	if err := json.NewDecoder(w.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices["house-door"]; ok || len(devices) != 1 {
+		t.Errorf("device list: got %+v, want only side-gate", devices)
+	}
+	if w := guestReq("POST", "/api/device/side-gate/power/on"); w.Code != http.StatusOK {
+		t.Errorf("side-gate: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := guestReq("POST", "/api/device/house-door/power/on"); w.Code != http.StatusNotFound {
+		t.Errorf("house-door: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// Tests the start time, expiry cap and use limit of guest passes.
+func TestLimitedGuest(t *testing.T) {
+	dl := device.DeviceList{
+		"side-gate": &noop.Device{Base: device.Base{Name: "Side Gate"}},
+	}
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      dl,
+		SessionStore: &store.SessionStoreCache{},
+		Config:       &Config{Lifetime: device.Duration(time.Hour)},
+		Devices:      dl,
+	}
+	parent := &access.User{Username: "parent", Nickname: "Parent"}
+	ctx := parent.NewContext(context.Background())
+
+	newPass := func(req string) (int, Info) {
+		r := httptest.NewRequest("POST", "/api/guest/token", strings.NewReader(req)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.ServeGuestNew(w, r)
+		var info Info
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, info
+	}
+	guestReq := func(info Info, url string) int {
+		r := httptest.NewRequest("POST", url, nil)
+		r.Header.Set("Authorization", "Bearer "+string(info.Token))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code, _ := newPass(`{"uses":-1}`); code != http.StatusBadRequest {
+		t.Errorf("negative uses: got %d, want %d", code, http.StatusBadRequest)
+	}
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if code, _ := newPass(`{"expiry":"` + past + `"}`); code != http.StatusBadRequest {
+		t.Errorf("expiry in past: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Expiry is capped at the lifetime after the start time:
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	req := fmt.Sprintf(`{"notbefore":%q,"expiry":%q}`,
+		start.Format(time.RFC3339), start.Add(48*time.Hour).Format(time.RFC3339))
+	code, info := newPass(req)
+	if code != http.StatusOK {
+		t.Fatalf("future pass: got %d, want %d", code, http.StatusOK)
+	}
+	if want := start.Add(time.Hour); !info.Expiry.Equal(want) {
+		t.Errorf("expiry: got %s, want %s", info.Expiry, want)
+	}
+	if info.NotBefore == nil || !info.NotBefore.Equal(start) {
+		t.Errorf("notbefore: got %v, want %s", info.NotBefore, start)
+	}
+	if code := guestReq(info, "/api/device/side-gate/power/on"); code != http.StatusForbidden {
+		t.Errorf("before start: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	code, info = newPass(`{"uses":2}`)
+	if code != http.StatusOK || info.Uses == nil || *info.Uses != 2 {
+		t.Fatalf("limited pass: got %d %+v", code, info)
+	}
+	// Failed actions don't use up the pass:
+	if code := guestReq(info, "/api/device/shed/power/on"); code != http.StatusNotFound {
+		t.Errorf("unknown device: got %d, want %d", code, http.StatusNotFound)
+	}
+	for i := 0; i < 2; i++ {
+		if code := guestReq(info, "/api/device/side-gate/power/on"); code != http.StatusOK {
+			t.Errorf("use %d: got %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+	if code := guestReq(info, "/api/device/side-gate/power/on"); code != http.StatusForbidden {
+		t.Errorf("used up: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Concurrent actions can't exceed the uses:
+	code, info = newPass(`{"uses":3}`)
+	if code != http.StatusOK {
+		t.Fatalf("limited pass: got %d", code)
+	}
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- guestReq(info, "/api/device/side-gate/power/on")
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	var ok int
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != 3 {
+		t.Errorf("concurrent uses: got %d successes, want 3", ok)
+	}
+}
+
+func TestListRevoke(t *testing.T) {
+	dl := device.DeviceList{
+		"side-gate": &noop.Device{Base: device.Base{Name: "Side Gate"}},
+	}
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      dl,
+		SessionStore: &store.SessionStoreCache{},
+		Config:       &Config{Lifetime: device.Duration(time.Hour)},
+	}
+	parent := &access.User{Username: "parent", Nickname: "Parent"}
+	other := &access.User{Username: "other", Nickname: "Other"}
+	ctx := context.Background()
+
+	plumber, _, err := h.NewSession(ctx, parent, &Request{Label: "Plumber"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.NewSession(ctx, parent, &Request{Label: "Electrician", Uses: 2}); err != nil {
+		t.Fatal(err)
+	}
+	otherID, _, err := h.NewSession(ctx, other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := func(u *access.User, method, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil).WithContext(u.NewContext(ctx))
+		w := httptest.NewRecorder()
+		h.ServeGuestTokens(w, r)
+		return w
+	}
+	list := func() []Info {
+		var infos []Info
+		w := tokens(parent, "GET", "/api/guest/tokens")
+		if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+			t.Fatalf("list: %d %v", w.Code, err)
+		}
+		return infos
+	}
+
+	infos := list()
+	if len(infos) != 2 {
+		t.Fatalf("list: got %+v, want 2 passes", infos)
+	}
+	for _, info := range infos {
+		if info.Token != "" {
+			t.Errorf("list: token of %s was revealed", info.Label)
+		}
+		if info.Created == nil {
+			t.Errorf("list: %s has no creation time", info.Label)
+		}
+	}
+
+	// Can't revoke somebody else's pass:
+	if w := tokens(parent, "DELETE", "/api/guest/tokens/"+string(NewPassID(otherID))); w.Code != http.StatusNotFound {
+		t.Errorf("revoke other: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := tokens(parent, "DELETE", "/api/guest/tokens/"+string(NewPassID(plumber))); w.Code != http.StatusNoContent {
+		t.Errorf("revoke: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if infos := list(); len(infos) != 1 || infos[0].Label != "Electrician" || *infos[0].Uses != 2 {
+		t.Errorf("list after revoke: got %+v, want only Electrician", infos)
+	}
+
+	r := httptest.NewRequest("POST", "/api/device/side-gate/power/on", nil)
+	r.Header.Set("Authorization", "Bearer "+string(plumber))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		t.Errorf("revoked pass still works")
+	}
+}
+
+type userMap map[access.Username]access.User
+
+func (m userMap) User(ctx context.Context, u access.Username) (*access.User, error) {
+	user, ok := m[u]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return &user, nil
+}
+
+// Tests that guests of password users are checked against their parent as
+// they are now, not as they were when the pass was created.
+func TestGuestParentChanged(t *testing.T) {
+	dl := device.DeviceList{
+		"side-gate": &noop.Device{Base: device.Base{Name: "Side Gate", ACL: &access.ACL{
+			Actions: map[access.Action]*access.ACL{
+				access.ActionInviteGuest: {Allow: access.List{Groups: []access.GroupName{"montagues"}}, Default: "deny"},
+			},
+		}}},
+	}
+	users := userMap{"alice": {Username: "alice", Nickname: "Alice", Groups: access.Groups{"montagues"}}}
+	h := &Handler{
+		Passthru:     http.NotFoundHandler(),
+		Handler:      dl,
+		SessionStore: &store.SessionStoreCache{},
+		Config:       &Config{Lifetime: device.Duration(time.Hour)},
+		UserStore:    users,
+		Devices:      dl,
+	}
+	parent, _ := users.User(context.Background(), "alice")
+	ctx := auth.NewContextMethod(parent.NewContext(context.Background()), "password")
+	id, _, err := h.NewSession(ctx, parent, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestReq := func() int {
+		r := httptest.NewRequest("POST", "/api/device/side-gate/power/on", nil)
+		r.Header.Set("Authorization", "Bearer "+string(id))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := guestReq(); code != http.StatusOK {
+		t.Errorf("parent in group: got %d, want %d", code, http.StatusOK)
+	}
+	users["alice"] = access.User{Username: "alice", Nickname: "Alice"}
+	if code := guestReq(); code != http.StatusForbidden {
+		t.Errorf("parent removed from group: got %d, want %d", code, http.StatusForbidden)
+	}
+	delete(users, "alice")
+	if code := guestReq(); code != http.StatusForbidden {
+		t.Errorf("parent deleted: got %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+// Tests that long-lived requests notice when a guest pass is revoked.
+func TestGuestRecheck(t *testing.T) {
+	h := &Handler{
+		SessionStore: &store.SessionStoreCache{},
+		Config:       &Config{Lifetime: device.Duration(time.Hour)},
+	}
+	parent := &access.User{Username: "parent", Nickname: "Parent"}
+	id, _, err := h.NewSession(context.Background(), parent, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := h.recheck(context.Background(), id); err != nil || g.Parent != "parent" {
+		t.Errorf("recheck: got %+v %v, want guest of parent", g, err)
+	}
+	if err := h.revoke(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.recheck(context.Background(), id); err == nil {
+		t.Errorf("recheck after revoke: got no error")
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+const (
+	DefaultUserHeader     = "Remote-User"
+	DefaultGroupsHeader   = "Remote-Groups"
+	DefaultNicknameHeader = "Remote-Name"
+)
+
+// HeaderAuthHandler trusts a reverse proxy (e.g. Authelia or oauth2-proxy)
+// to authenticate users, and to pass the username and groups in headers.
+// No session is created, as the proxy authenticates every request.
+type HeaderAuthHandler struct {
+	http.Handler `json:"-"`
+
+	// TrustedProxies are the CIDRs that headers are accepted from,
+	// e.g. ["127.0.0.1/32", "::1/128"]. Requests from anywhere else
+	// are refused.
+	TrustedProxies []netip.Prefix `json:"trustedproxies"`
+
+	// Header names. Groups are separated by commas.
+	UserHeader     string `json:"userheader,omitempty"`
+	GroupsHeader   string `json:"groupsheader,omitempty"`
+	NicknameHeader string `json:"nicknameheader,omitempty"`
+}
+
+func (h *HeaderAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.trusted(r) {
+		log.Printf("HeaderAuthHandler: request from untrusted address: %s", r.RemoteAddr)
+		http.Error(w, "Untrusted proxy", http.StatusForbidden)
+		return
+	}
+	u, ok := h.user(r)
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	ctx := NewContextMethod(u.NewContext(r.Context()), "header")
+	h.Handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticates is true if a trusted proxy has passed a user.
+func (h *HeaderAuthHandler) authenticates(r *http.Request) bool {
+	_, ok := h.user(r)
+	return ok && h.trusted(r)
+}
+
+// trusted is true if r came directly from a trusted proxy.
+func (h *HeaderAuthHandler) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range h.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HeaderAuthHandler) user(r *http.Request) (*access.User, bool) {
+	username := r.Header.Get(headerOrDefault(h.UserHeader, DefaultUserHeader))
+	if username == "" {
+		return nil, false
+	}
+	u := &access.User{
+		Username: access.Username(username),
+		Nickname: r.Header.Get(headerOrDefault(h.NicknameHeader, DefaultNicknameHeader)),
+		Groups:   make(access.Groups, 0),
+	}
+	if u.Nickname == "" {
+		u.Nickname = username
+	}
+	for _, g := range strings.Split(r.Header.Get(headerOrDefault(h.GroupsHeader, DefaultGroupsHeader)), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			u.Groups = append(u.Groups, access.GroupName(g))
+		}
+	}
+	return u, true
+}
+
+func headerOrDefault(h, def string) string {
+	if h == "" {
+		return def
+	}
+	return h
+}
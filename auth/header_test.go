@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+func TestHeaderAuth(t *testing.T) {
+	var got *access.User
+	h := &HeaderAuthHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = access.FromContext(r.Context())
+		}),
+		TrustedProxies: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		},
+	}
+	req := func(remoteAddr string, headers map[string]string) int {
+		got = nil
+		r := httptest.NewRequest("GET", "/api/index", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	alice := map[string]string{
+		"Remote-User":   "alice",
+		"Remote-Name":   "Alice",
+		"Remote-Groups": "staff, admin",
+	}
+
+	for _, addr := range []string{"10.1.2.3:5000", "[::1]:5000", "[::ffff:10.1.2.3]:5000"} {
+		if code := req(addr, alice); code != http.StatusOK {
+			t.Errorf("%s: got %d, want %d", addr, code, http.StatusOK)
+		}
+		want := &access.User{Username: "alice", Nickname: "Alice", Groups: access.Groups{"staff", "admin"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", addr, got, want)
+		}
+	}
+
+	if code := req("192.0.2.1:5000", alice); code != http.StatusForbidden || got != nil {
+		t.Errorf("untrusted proxy: got %d %+v, want %d", code, got, http.StatusForbidden)
+	}
+	if code := req("10.1.2.3:5000", nil); code != http.StatusUnauthorized || got != nil {
+		t.Errorf("no user header: got %d %+v, want %d", code, got, http.StatusUnauthorized)
+	}
+
+	// Custom headers, and nickname defaults to username:
+	h.UserHeader = "X-Forwarded-User"
+	if code := req("10.1.2.3:5000", map[string]string{"X-Forwarded-User": "bob"}); code != http.StatusOK {
+		t.Errorf("custom header: got %d, want %d", code, http.StatusOK)
+	}
+	if want := (&access.User{Username: "bob", Nickname: "bob", Groups: access.Groups{}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("custom header: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/device"
+)
+
+const (
+	DefaultMaxUserFailures = 5
+	DefaultMaxIPFailures   = 20
+	DefaultLockout         = 15 * time.Minute
+	DefaultBackoff         = 1 * time.Second
+
+	lockoutTrackedLen = 10000 // usernames and addresses, each
+)
+
+// now is replaced by tests.
+var now = time.Now
+
+// LockoutConfig limits failed logins per username and per client address.
+// Each failure doubles the delay before the next attempt is allowed, and
+// too many failures lock logins out entirely for a while.
+type LockoutConfig struct {
+	// MaxUserFailures and MaxIPFailures are the failures allowed before
+	// lockout. Defaults are 5 per username and 20 per address.
+	MaxUserFailures int `json:"maxuserfailures,omitempty"`
+	MaxIPFailures   int `json:"maxipfailures,omitempty"`
+
+	// Duration is how long logins are refused once locked out, and how
+	// long failures are remembered for. Defaults to 15 minutes.
+	Duration device.Duration `json:"duration,omitempty"`
+
+	// Backoff is the delay after the first failure. Defaults to 1 second.
+	Backoff device.Duration `json:"backoff,omitempty"`
+
+	// Allowlist addresses are never limited.
+	Allowlist []netip.Prefix `json:"allowlist,omitempty"`
+
+	// TrustedProxies may set X-Forwarded-For, which is then used as the
+	// client address. Otherwise, every client behind a reverse proxy would
+	// share one address.
+	TrustedProxies []netip.Prefix `json:"trustedproxies,omitempty"`
+
+	once  sync.Once
+	mu    sync.Mutex
+	users *lru.Cache[access.Username, *failures]
+	ips   *lru.Cache[netip.Addr, *failures]
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func (c *LockoutConfig) init() {
+	c.once.Do(func() {
+		var err error
+		if c.users, err = lru.New[access.Username, *failures](lockoutTrackedLen); err != nil {
+			panic(err)
+		}
+		if c.ips, err = lru.New[netip.Addr, *failures](lockoutTrackedLen); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func (c *LockoutConfig) lockout() time.Duration {
+	if c.Duration <= 0 {
+		return DefaultLockout
+	}
+	return time.Duration(c.Duration)
+}
+
+func (c *LockoutConfig) backoff(n int) time.Duration {
+	d := time.Duration(c.Backoff)
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	for i := 1; i < n && d < c.lockout(); i++ {
+		d *= 2
+	}
+	if d > c.lockout() {
+		d = c.lockout()
+	}
+	return d
+}
+
+func (c *LockoutConfig) maxUser() int {
+	if c.MaxUserFailures <= 0 {
+		return DefaultMaxUserFailures
+	}
+	return c.MaxUserFailures
+}
+
+func (c *LockoutConfig) maxIP() int {
+	if c.MaxIPFailures <= 0 {
+		return DefaultMaxIPFailures
+	}
+	return c.MaxIPFailures
+}
+
+// clientAddr returns the address of the client, which may be behind a
+// trusted proxy.
+func (c *LockoutConfig) clientAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !prefixesContain(c.TrustedProxies, addr) {
+		return addr
+	}
+	// The last address was added by our proxy:
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return addr
+	}
+	hops := strings.Split(xff[len(xff)-1], ",")
+	if fwd, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1])); err == nil {
+		return fwd.Unmap()
+	}
+	return addr
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt is a login attempt as u from addr. It counts as a failure from
+// when it begins, so that concurrent attempts can't all pass the same check
+// before any of them fail. It is refunded unless it fails.
+type attempt struct {
+	c    *LockoutConfig
+	u    access.Username
+	addr netip.Addr
+	t    time.Time
+	done bool
+
+	// user and ip are nil if addr is allowlisted. Their last attempt times
+	// before this one are kept for refunds.
+	user, ip         *failures
+	userLast, ipLast time.Time
+}
+
+// begin returns how long the client must wait before trying to log in as u,
+// or if it needn't wait, reserves an attempt. One of the attempt's fail,
+// succeed or cancel methods must be called when it is finished.
+func (c *LockoutConfig) begin(u access.Username, addr netip.Addr) (time.Duration, *attempt) {
+	a := &attempt{c: c, u: u, addr: addr}
+	c.init()
+	if prefixesContain(c.Allowlist, addr) {
+		return 0, a
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a.t = now()
+	fu, _ := c.users.Get(u)
+	fi, _ := c.ips.Get(addr)
+	wait := c.wait(fu, a.t)
+	if d := c.wait(fi, a.t); d > wait {
+		wait = d
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	a.user, a.userLast = c.reserve(fu, a.t)
+	c.users.Add(u, a.user)
+	a.ip, a.ipLast = c.reserve(fi, a.t)
+	c.ips.Add(addr, a.ip)
+	return 0, a
+}
+
+// wait returns how long after t the next attempt counted by f is allowed.
+func (c *LockoutConfig) wait(f *failures, t time.Time) time.Duration {
+	if f == nil {
+		return 0
+	}
+	until := f.last.Add(c.backoff(f.count))
+	if f.lockedUntil.After(until) {
+		until = f.lockedUntil
+	}
+	return until.Sub(t)
+}
+
+// reserve counts an attempt at t against f, which is replaced if nil or
+// forgotten. It returns the record, and its previous last attempt time.
+func (c *LockoutConfig) reserve(f *failures, t time.Time) (*failures, time.Time) {
+	if f == nil || t.Sub(f.last) > c.lockout() {
+		f = new(failures) // forgotten
+	}
+	last := f.last
+	f.count++
+	f.last = t
+	return f, last
+}
+
+// refund takes back an attempt at t counted against f, the record for k in
+// cache, unless it has been forgotten since.
+func refund[K comparable](cache *lru.Cache[K, *failures], k K, f *failures, last, t time.Time) {
+	if cur, ok := cache.Peek(k); !ok || cur != f {
+		return
+	}
+	f.count--
+	if f.count <= 0 {
+		cache.Remove(k)
+		return
+	}
+	if f.last.Equal(t) {
+		f.last = last
+	}
+}
+
+// fail records that the attempt failed, locking out its username or address
+// if they have failed too often.
+func (a *attempt) fail() {
+	if a.done {
+		return
+	}
+	a.done = true
+	if a.user == nil {
+		return // allowlisted
+	}
+	c := a.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := now()
+	lock := func(f *failures, max int, what string) {
+		if f.count >= max && !f.lockedUntil.After(t) {
+			f.lockedUntil = t.Add(c.lockout())
+			log.Printf("LOCKOUT: %s locked out for %s after %d failed logins (last as %q from %s)",
+				what, c.lockout(), f.count, a.u, a.addr)
+		}
+	}
+	lock(a.user, c.maxUser(), "user "+string(a.u))
+	lock(a.ip, c.maxIP(), "address "+a.addr.String())
+}
+
+// succeed forgets failed logins as u. Failures from the address are
+// remembered, so that guessing can't be hidden between valid logins.
+func (a *attempt) succeed() {
+	if a.done {
+		return
+	}
+	a.cancel()
+	a.c.forget(a.u)
+}
+
+// cancel refunds the attempt, if it neither failed nor succeeded (e.g. due
+// to an internal error).
+func (a *attempt) cancel() {
+	if a.done {
+		return
+	}
+	a.done = true
+	if a.user == nil {
+		return // allowlisted
+	}
+	c := a.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refund(c.users, a.u, a.user, a.userLast, a.t)
+	refund(c.ips, a.addr, a.ip, a.ipLast, a.t)
+}
+
+// forget forgets failed logins as u, e.g. when their password is reset.
+func (c *LockoutConfig) forget(u access.Username) {
+	c.init()
+	c.users.Remove(u)
+}
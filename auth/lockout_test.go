@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestLockout(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &PasswordAuthHandler{
+		Handler: http.NotFoundHandler(),
+		UserStore: &otpUserStore{users: access.Users{
+			"alice": {PasswordHash: string(hash)},
+			"bob":   {PasswordHash: string(hash)},
+		}},
+		SessionStore: &store.SessionStoreCache{},
+		Lockout: LockoutConfig{
+			MaxIPFailures:  8,
+			Allowlist:      []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+		},
+	}
+	loginVia := func(remoteAddr, forwardedFor, username, password string) int {
+		r := httptest.NewRequest("POST", LoginURL,
+			strings.NewReader(`{"username":"`+username+`","password":"`+password+`"}`))
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	login := func(remoteAddr, username, password string) int {
+		return loginVia(remoteAddr, "", username, password)
+	}
+	const mallory = "198.51.100.1:1234"
+
+	// Each failure doubles the wait:
+	for i, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if code := login(mallory, "alice", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: got %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+		if code := login(mallory, "alice", "guess"); code != http.StatusTooManyRequests {
+			t.Errorf("guess %d, retried immediately: got %d, want %d", i+1, code, http.StatusTooManyRequests)
+		}
+		clock = clock.Add(wait)
+	}
+	// The fifth failure locks alice out, even with the right password:
+	if code := login(mallory, "alice", "guess"); code != http.StatusUnauthorized {
+		t.Fatalf("guess 5: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	clock = clock.Add(time.Minute)
+	if code := login("203.0.113.9:1234", "alice", "hunter2"); code != http.StatusTooManyRequests {
+		t.Errorf("locked out: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// ...but not from the allowlist:
+	if code := login("192.0.2.1:1234", "alice", "hunter2"); code != http.StatusOK {
+		t.Errorf("allowlisted: got %d, want %d", code, http.StatusOK)
+	}
+
+	// mallory's address is locked out after 8 failures in total:
+	for _, u := range []string{"bob", "carol", "dave"} {
+		clock = clock.Add(2 * time.Minute) // outwait the address's backoff
+		if code := login(mallory, u, "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess as %s: got %d, want %d", u, code, http.StatusUnauthorized)
+		}
+	}
+	clock = clock.Add(2 * time.Minute)
+	if code := login(mallory, "bob", "hunter2"); code != http.StatusTooManyRequests {
+		t.Errorf("address locked out: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// Clients behind a trusted proxy are told apart:
+	if code := loginVia("127.0.0.1:1234", "198.51.100.1, 203.0.113.2", "bob", "hunter2"); code != http.StatusOK {
+		t.Errorf("behind proxy: got %d, want %d", code, http.StatusOK)
+	}
+	// ...but untrusted proxies can't hide the client's address:
+	if code := loginVia(mallory, "203.0.113.3", "bob", "hunter2"); code != http.StatusTooManyRequests {
+		t.Errorf("untrusted proxy: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// Lockouts expire:
+	clock = clock.Add(DefaultLockout)
+	if code := login(mallory, "bob", "hunter2"); code != http.StatusOK {
+		t.Errorf("after lockout: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+// Tests that concurrent guesses can't all be checked before any fail.
+func TestLockoutConcurrent(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    &otpUserStore{users: access.Users{"alice": {PasswordHash: string(hash)}}},
+		SessionStore: &store.SessionStoreCache{},
+	}
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", LoginURL, strings.NewReader(`{"username":"alice","password":"guess"}`))
+			r.RemoteAddr = "198.51.100.1:1234"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	var guesses int
+	for code := range codes {
+		if code == http.StatusUnauthorized {
+			guesses++
+		} else if code != http.StatusTooManyRequests {
+			t.Errorf("got %d, want %d or %d", code, http.StatusUnauthorized, http.StatusTooManyRequests)
+		}
+	}
+	if guesses != 1 {
+		t.Errorf("got %d guesses checked, want 1", guesses)
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MultiAuthHandler lets users authenticate with any of several auth methods,
+// each configured at most once.
+//
+// Logins are routed by method name: /api/login/{method}/... is served by
+// that method as /api/login/..., e.g. /api/login/password/passkey. Other
+// requests go to the first method which recognises their session (or
+// headers), and are otherwise refused with the list of method names.
+type MultiAuthHandler struct {
+	Methods []http.Handler
+}
+
+// authenticator is implemented by auth handlers which can tell whether a
+// request has their credentials, without responding to it.
+type authenticator interface {
+	authenticates(r *http.Request) bool
+}
+
+var (
+	_ authenticator = (*PasswordAuthHandler)(nil)
+	_ authenticator = (*OAuthHandler)(nil)
+	_ authenticator = (*HeaderAuthHandler)(nil)
+)
+
+// MethodName returns the name of an auth handler, as used in
+// /api/login/{method}, or "" if it isn't one.
+func MethodName(h http.Handler) string {
+	switch h.(type) {
+	case *PasswordAuthHandler:
+		return "password"
+	case *OAuthHandler:
+		return "oauth"
+	case *HeaderAuthHandler:
+		return "header"
+	}
+	return ""
+}
+
+// MethodsResponse is returned when no method authenticates the request.
+type MethodsResponse struct {
+	Auth []string `json:"auth"`
+}
+
+func (h *MultiAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	names := h.names()
+	r = r.WithContext(NewContextMethods(r.Context(), names))
+
+	if rest, ok := strings.CutPrefix(r.URL.Path, LoginURL); ok && (rest == "" || rest[0] == '/') {
+		name, sub, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+		if m := h.method(name); m != nil {
+			p := LoginURL
+			if sub != "" {
+				p += "/" + sub
+			}
+			m.ServeHTTP(w, withPath(r, p))
+			return
+		}
+		h.Methods[0].ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == OAuthRedirectURL {
+		if m := h.method(MethodName((*OAuthHandler)(nil))); m != nil {
+			m.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	for _, m := range h.Methods {
+		if a, ok := m.(authenticator); ok && a.authenticates(r) {
+			m.ServeHTTP(w, r)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(MethodsResponse{Auth: names})
+}
+
+func (h *MultiAuthHandler) names() []string {
+	names := make([]string, len(h.Methods))
+	for i, m := range h.Methods {
+		names[i] = MethodName(m)
+	}
+	return names
+}
+
+func (h *MultiAuthHandler) method(name string) http.Handler {
+	for _, m := range h.Methods {
+		if name != "" && MethodName(m) == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// withPath returns a shallow copy of r with a different URL path.
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// NewContextMethods returns a context with the names of the available auth
+// methods, for the index.
+func NewContextMethods(ctx context.Context, names []string) context.Context {
+	return context.WithValue(ctx, ctxMethodsKey, names)
+}
+
+// NewContextMethod returns a context with the name of the auth method
+// which authenticated the request.
+func NewContextMethod(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxMethodKey, name)
+}
+
+// MethodFromContext returns the name of the auth method which
+// authenticated the request, e.g. "password".
+func MethodFromContext(ctx context.Context) (name string, ok bool) {
+	name, ok = ctx.Value(ctxMethodKey).(string)
+	return
+}
+
+// MethodsFromContext returns the names of the available auth methods, if
+// more than one is configured.
+func MethodsFromContext(ctx context.Context) (names []string, ok bool) {
+	names, ok = ctx.Value(ctxMethodsKey).([]string)
+	return
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestMultiAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *access.User
+	var gotMethods []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = access.FromContext(r.Context())
+		gotMethods, _ = MethodsFromContext(r.Context())
+	})
+	h := &MultiAuthHandler{Methods: []http.Handler{
+		&PasswordAuthHandler{
+			Handler: next,
+			UserStore: &passkeyUserStore{
+				FileStore: &store.FileStore{PasskeyPath: t.TempDir() + "/passkeys.json"},
+				users:     access.Users{"alice": {PasswordHash: string(hash)}},
+			},
+			SessionStore: &store.SessionStoreCache{},
+			RPID:         "unlockr.example.com",
+		},
+		&HeaderAuthHandler{
+			Handler:        next,
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+	}}
+	req := func(r *http.Request) *httptest.ResponseRecorder {
+		got, gotMethods = nil, nil
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	wantMethods := []string{"password", "header"}
+
+	// Unauthenticated requests are told the methods:
+	w := req(httptest.NewRequest("GET", "/api/index", nil))
+	var mr MethodsResponse
+	if err := json.NewDecoder(w.Body).Decode(&mr); err != nil || w.Code != http.StatusUnauthorized {
+		t.Fatalf("no credentials: got %d %v", w.Code, err)
+	}
+	if !reflect.DeepEqual(mr.Auth, wantMethods) || got != nil {
+		t.Errorf("no credentials: got %v %+v, want %v", mr.Auth, got, wantMethods)
+	}
+
+	// Logins are routed by method name:
+	for _, path := range []string{"/api/login/password", LoginURL} {
+		w = req(httptest.NewRequest("POST", path, strings.NewReader(`{"username":"alice","password":"hunter2"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %q", path, w.Code, w.Body.String())
+		}
+	}
+	cookies := w.Result().Cookies()
+	if w = req(httptest.NewRequest("GET", "/api/login/password/passkey", nil)); w.Code != http.StatusOK {
+		t.Errorf("passkey login options: got %d %q", w.Code, w.Body.String())
+	}
+
+	// ...and the session is recognised by the password method:
+	r := httptest.NewRequest("GET", "/api/index", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	if w = req(r); w.Code != http.StatusOK || got == nil || got.Username != "alice" {
+		t.Errorf("session: got %d %+v", w.Code, got)
+	}
+	if !reflect.DeepEqual(gotMethods, wantMethods) {
+		t.Errorf("methods in context: got %v, want %v", gotMethods, wantMethods)
+	}
+
+	// Headers are recognised by the header method:
+	r = httptest.NewRequest("GET", "/api/index", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("Remote-User", "bob")
+	if w = req(r); w.Code != http.StatusOK || got == nil || got.Username != "bob" {
+		t.Errorf("header: got %d %+v", w.Code, got)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"golang.org/x/oauth2"
@@ -20,7 +22,17 @@ import (
 )
 
 type csrfTokens struct {
-	cache *lru.Cache[string, struct{}]
+	cache *lru.Cache[string, *loginState]
+}
+
+// loginState is remembered between the login redirect and the exchange,
+// keyed by the CSRF token sent as the OAuth state.
+type loginState struct {
+	nonce    string // OpenID Connect nonce, if the profile needs one
+	verifier string // PKCE code verifier
+
+	// returnPath is where to send the user after logging in.
+	returnPath string
 }
 
 const csrfTokenLength int = 100
@@ -44,6 +56,12 @@ type OAuthProfile interface {
 	user(context.Context, oauth2.TokenSource) (*access.User, error)
 }
 
+// oauthConfigurer is implemented by profiles which discover the OAuth
+// endpoints themselves, and which need a nonce in the login request.
+type oauthConfigurer interface {
+	configure(ctx context.Context, cfg *oauth2.Config) error
+}
+
 type jsonOAuthProfile struct {
 	OAuthProfile
 }
@@ -52,6 +70,7 @@ type profileType string
 
 const (
 	profileWordPress profileType = "wordpress"
+	profileOIDC      profileType = "oidc"
 )
 
 func (j *jsonOAuthProfile) UnmarshalJSON(v []byte) error {
@@ -64,6 +83,8 @@ func (j *jsonOAuthProfile) UnmarshalJSON(v []byte) error {
 	switch t.Type {
 	case profileWordPress:
 		j.OAuthProfile = new(OAuthWordPress)
+	case profileOIDC:
+		j.OAuthProfile = new(OAuthOIDC)
 	default:
 		return fmt.Errorf("unsupported OAuth profile: %v", t)
 	}
@@ -101,6 +122,13 @@ func (h *OAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Token refreshes need the discovered endpoints:
+		if _, err := h.configure(r.Context()); err != nil {
+			log.Printf("OAuthHandler: %v", err)
+			http.Error(w, "Internal error (OAuth discovery failed)", http.StatusInternalServerError)
+			return
+		}
+
 		// Put the Session into Context:
 		ctx, id, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
 		if errors.Is(err, session.ErrNoSession) || errors.Is(err, session.ErrSessionExpired) {
@@ -125,6 +153,14 @@ func (h *OAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			goto errLogin
 		}
 		ctx = u.NewContext(ctx)
+		ctx = NewContextMethod(ctx, "oauth")
+		// Only the session is checked again, as users come from the provider:
+		ctx = access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+			if _, err := session.Get(ctx, id, h.SessionStore); err != nil {
+				return nil, err
+			}
+			return u, nil
+		})
 
 		// Handlers may retrieve the above values from Context:
 		h.Handler.ServeHTTP(w, r.WithContext(ctx))
@@ -136,27 +172,76 @@ errLogin:
 	http.Redirect(w, r, LoginURL, http.StatusSeeOther)
 }
 
+// authenticates is true if r has a session with an OAuth token.
+func (h *OAuthHandler) authenticates(r *http.Request) bool {
+	_, _, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
+	if err != nil {
+		return false
+	}
+	var token oauth2.Token
+	return json.Unmarshal(s.Extra, &token) == nil && token.AccessToken != ""
+}
+
+// configure lets the profile fill in the OAuth config, if it can.
+func (h *OAuthHandler) configure(ctx context.Context) (ok bool, err error) {
+	c, ok := h.Profile.OAuthProfile.(oauthConfigurer)
+	if !ok {
+		return false, nil
+	}
+	return true, c.configure(ctx, h.Config)
+}
+
 func (h *OAuthHandler) RedirectLogin(w http.ResponseWriter, r *http.Request) {
-	ctok, err := h.csrfTokens.New()
+	isOIDC, err := h.configure(r.Context())
+	if err != nil {
+		log.Printf("OAuthHandler: %v", err)
+		http.Error(w, "Internal error (OAuth discovery failed)", http.StatusInternalServerError)
+		return
+	}
+	st := &loginState{
+		verifier: oauth2.GenerateVerifier(),
+	}
+	if p, ok := returnPath(r.FormValue("redirect")); ok {
+		st.returnPath = p
+	}
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOnline,
+		oauth2.S256ChallengeOption(st.verifier),
+	}
+	if isOIDC {
+		if st.nonce, err = randomToken(15); err != nil {
+			http.Error(w, "Internal error (generating nonce)", http.StatusInternalServerError)
+			return
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", st.nonce))
+	}
+	ctok, err := h.csrfTokens.New(st)
 	if err != nil {
 		http.Error(w, "Internal error (generating CSRF token)", http.StatusInternalServerError)
 		return
 	}
-	url := h.Config.AuthCodeURL(ctok, oauth2.AccessTypeOnline)
+	url := h.Config.AuthCodeURL(ctok, opts...)
 	http.Redirect(w, r, url, http.StatusSeeOther)
 }
 
 // ServeExchange gets an OAuth token, looks up the user, and creates a session.
 func (h *OAuthHandler) ServeExchange(w http.ResponseWriter, r *http.Request) {
 	ctok := r.FormValue("state")
-	if ctok == "" || !h.csrfTokens.Valid(ctok) {
+	st, ok := h.csrfTokens.Take(ctok)
+	if ctok == "" || !ok {
 		log.Print("OAuthHandler: exchange: invalid CSRF token")
 		http.Error(w, "Invalid CSRF token", http.StatusBadRequest)
 		return
 	}
+	if _, err := h.configure(r.Context()); err != nil {
+		log.Printf("OAuthHandler: %v", err)
+		http.Error(w, "Internal error (OAuth discovery failed)", http.StatusInternalServerError)
+		return
+	}
+	ctx := newContextNonce(r.Context(), st.nonce)
 
 	code := r.FormValue("code")
-	token, err := h.Config.Exchange(r.Context(), code)
+	token, err := h.Config.Exchange(ctx, code, oauth2.VerifierOption(st.verifier))
 	if err != nil {
 		log.Printf("OAuthHandler: exchange: %v", err)
 		http.Error(w, "Token exchange failed", http.StatusBadRequest)
@@ -164,7 +249,7 @@ func (h *OAuthHandler) ServeExchange(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// We call the OAuth-specific user(), not User(), because we don't know the username yet:
-	user, err := h.Profile.user(r.Context(), oauth2.StaticTokenSource(token))
+	user, err := h.Profile.user(ctx, oauth2.StaticTokenSource(token))
 	if err != nil {
 		log.Printf("OAuthHandler: failed getting user: %v", err)
 		http.Error(w, "Please try logging in again. (User profile failed)", http.StatusInternalServerError)
@@ -186,7 +271,24 @@ func (h *OAuthHandler) ServeExchange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.Redirect(w, r, h.PostRedirectURL, http.StatusSeeOther)
+	redir := h.PostRedirectURL
+	if st.returnPath != "" {
+		redir = st.returnPath
+	}
+	http.Redirect(w, r, redir, http.StatusSeeOther)
+}
+
+// returnPath returns p if it's a path on this site, so that it can't be
+// used to redirect users elsewhere after logging in.
+func returnPath(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "", false
+	}
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "", false
+	}
+	return p, true
 }
 
 func (h *OAuthHandler) ServeLogout(w http.ResponseWriter, r *http.Request) {
@@ -200,7 +302,7 @@ func (h *OAuthHandler) ServeLogout(w http.ResponseWriter, r *http.Request) {
 
 func newCSRFTokens() *csrfTokens {
 	ct := new(csrfTokens)
-	cache, err := lru.New[string, struct{}](csrfTokenLength)
+	cache, err := lru.New[string, *loginState](csrfTokenLength)
 	if err != nil {
 		panic(err)
 	}
@@ -208,21 +310,33 @@ func newCSRFTokens() *csrfTokens {
 	return ct
 }
 
-func (c csrfTokens) Valid(token string) bool {
-	return c.cache.Contains(token)
+// Take returns the state saved with token. Each token may only be used once.
+func (c csrfTokens) Take(token string) (st *loginState, ok bool) {
+	st, ok = c.cache.Get(token)
+	if ok {
+		c.cache.Remove(token)
+	}
+	return
 }
 
-func (c csrfTokens) New() (token string, err error) {
-	buf := make([]byte, 15)
-	_, err = rand.Read(buf)
+func (c csrfTokens) New(st *loginState) (token string, err error) {
+	tok, err := randomToken(15)
 	if err != nil {
 		return "", err
 	}
-	tok := base64.URLEncoding.EncodeToString(buf)
-	c.cache.Add(tok, struct{}{})
+	c.cache.Add(tok, st)
 	return tok, nil
 }
 
+// randomToken returns n random bytes, base64-encoded for use in URLs.
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
 func NewSessionTokenSource(ctx context.Context,
 	id session.SessionId,
 	s *session.Session,
@@ -290,7 +404,12 @@ func (st *SessionTokenSource) Token() (*oauth2.Token, error) {
 
 type key int
 
-var ctxTokenKey key
+const (
+	ctxTokenKey key = iota
+	ctxNonceKey
+	ctxMethodsKey
+	ctxMethodKey
+)
 
 func NewContextToken(ctx context.Context, ts oauth2.TokenSource) context.Context {
 	return context.WithValue(ctx, ctxTokenKey, ts)
@@ -301,5 +420,15 @@ func TokenFromContext(ctx context.Context) (ts oauth2.TokenSource, ok bool) {
 	return
 }
 
+// newContextNonce carries the expected OpenID Connect nonce to the profile.
+func newContextNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, ctxNonceKey, nonce)
+}
+
+func nonceFromContext(ctx context.Context) (nonce string, ok bool) {
+	nonce, ok = ctx.Value(ctxNonceKey).(string)
+	return
+}
+
 // SessionTokenSource implements oauth2.TokenSource. Enforce the interface:
 var _ oauth2.TokenSource = (*SessionTokenSource)(nil)
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/debug"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+// oidcLeeway allows for clock skew between us and the provider.
+const oidcLeeway = 1 * time.Minute
+
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// OAuthOIDC is a generic OpenID Connect profile. Endpoints are discovered
+// from the issuer, and users are taken from verified ID tokens.
+type OAuthOIDC struct {
+	// Issuer is the provider's issuer URL, underneath which
+	// /.well-known/openid-configuration is located.
+	Issuer string `json:"issuer"`
+
+	// Claims to map to the user. Nested claims are separated by dots,
+	// e.g. "realm_access.roles" for Keycloak realm roles.
+	// Defaults are "preferred_username", "name" and "groups".
+	UsernameClaim string `json:"usernameclaim,omitempty"`
+	NicknameClaim string `json:"nicknameclaim,omitempty"`
+	GroupsClaim   string `json:"groupsclaim,omitempty"`
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// configure discovers the provider (once), and fills in any unset endpoints
+// and scopes in cfg.
+func (o *OAuthOIDC) configure(ctx context.Context, cfg *oauth2.Config) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return nil
+	}
+
+	p, err := oidc.NewProvider(ctx, o.Issuer)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if debug.Debug() {
+		log.Printf("OIDC discovery: %+v", p.Endpoint())
+	}
+
+	if cfg.Endpoint.AuthURL == "" {
+		cfg.Endpoint.AuthURL = p.Endpoint().AuthURL
+	}
+	if cfg.Endpoint.TokenURL == "" {
+		cfg.Endpoint.TokenURL = p.Endpoint().TokenURL
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	} else if !contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	o.provider = p
+	o.verifier = p.Verifier(&oidc.Config{
+		ClientID: cfg.ClientID,
+		// Only asymmetric algorithms, as the client secret shouldn't be
+		// able to sign ID tokens:
+		SupportedSigningAlgs: []string{
+			oidc.RS256, oidc.RS384, oidc.RS512,
+			oidc.ES256, oidc.ES384, oidc.ES512,
+			oidc.PS256, oidc.PS384, oidc.PS512,
+		},
+		Now: func() time.Time { return time.Now().Add(-oidcLeeway) },
+	})
+	return nil
+}
+
+// User fetches the user's claims from the userinfo endpoint, using the token
+// in ctx. It's used when the user is no longer cached.
+func (o *OAuthOIDC) User(ctx context.Context, username access.Username) (*access.User, error) {
+	ts, ok := TokenFromContext(ctx)
+	if !ok {
+		return nil, errors.New("token not in context")
+	}
+	o.mu.Lock()
+	p := o.provider
+	o.mu.Unlock()
+	if p == nil || p.UserInfoEndpoint() == "" {
+		return nil, errors.New("OIDC provider has no userinfo endpoint")
+	}
+
+	var claims map[string]any
+	if err := getJSON(ctx, oauth2.NewClient(ctx, ts), p.UserInfoEndpoint(), &claims); err != nil {
+		return nil, err
+	}
+	u, err := o.mapUser(claims)
+	if err != nil {
+		return nil, err
+	}
+	if u.Username != username {
+		return nil, fmt.Errorf("OAuthOIDC.User: got user %s, want %s", u.Username, username)
+	}
+	return u, nil
+}
+
+// user verifies the ID token returned with the OAuth token.
+func (o *OAuthOIDC) user(ctx context.Context, src oauth2.TokenSource) (*access.User, error) {
+	t, err := src.Token()
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := t.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("OAuthOIDC: no id_token in token response (is the openid scope requested?)")
+	}
+	nonce, ok := nonceFromContext(ctx)
+	if !ok || nonce == "" {
+		return nil, errors.New("OAuthOIDC: no nonce in context")
+	}
+	claims, err := o.verify(ctx, raw, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return o.mapUser(claims)
+}
+
+// verify checks the ID token's signature, issuer, audience, expiry and nonce,
+// and returns its claims.
+func (o *OAuthOIDC) verify(ctx context.Context, raw string, nonce string) (map[string]any, error) {
+	o.mu.Lock()
+	v := o.verifier
+	o.mu.Unlock()
+	if v == nil {
+		return nil, errors.New("OIDC provider not discovered")
+	}
+	t, err := v.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if t.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	var claims map[string]any
+	if err := t.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func (o *OAuthOIDC) mapUser(claims map[string]any) (*access.User, error) {
+	usernameClaim := o.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	nicknameClaim := o.NicknameClaim
+	if nicknameClaim == "" {
+		nicknameClaim = "name"
+	}
+	groupsClaim := o.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	username, _ := claim(claims, usernameClaim).(string)
+	if username == "" {
+		return nil, fmt.Errorf("OAuthOIDC: claim %q is missing or empty", usernameClaim)
+	}
+	u := &access.User{
+		Username: access.Username(username),
+		Groups:   make(access.Groups, 0),
+	}
+	u.Nickname, _ = claim(claims, nicknameClaim).(string)
+	if u.Nickname == "" {
+		u.Nickname = username
+	}
+	switch groups := claim(claims, groupsClaim).(type) {
+	case string:
+		u.Groups = append(u.Groups, access.GroupName(groups))
+	case []any:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				u.Groups = append(u.Groups, access.GroupName(g))
+			}
+		}
+	}
+	return u, nil
+}
+
+// claim returns the value at the dot-separated path in claims, or nil.
+func claim(claims map[string]any, path string) any {
+	var v any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if sc := resp.StatusCode; sc == http.StatusUnauthorized || sc == http.StatusForbidden {
+		return fmt.Errorf("%w (HTTP code %d)", session.ErrSessionExpired, sc)
+	} else if sc != http.StatusOK {
+		return fmt.Errorf("got HTTP code %d from %s", sc, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Enforce the interfaces:
+var _ OAuthProfile = (*OAuthOIDC)(nil)
+var _ oauthConfigurer = (*OAuthOIDC)(nil)
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+// testIdP is a minimal OpenID provider.
+type testIdP struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	// claims are included in ID tokens, and returned by userinfo.
+	claims map[string]any
+	// nonces and PKCE challenges are remembered by authorization code.
+	nonces     map[string]string
+	challenges map[string]string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+		claims: map[string]any{
+			"preferred_username": "alice",
+			"name":               "Alice",
+			"realm_access":       map[string]any{"roles": []string{"staff", "admin"}},
+		},
+		nonces:     make(map[string]string),
+		challenges: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa", "use": "sig",
+				"n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC", "kid": "ec", "crv": "P-256",
+				"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.FormValue("code")
+		nonce, ok := idp.nonces[code]
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if challenge, ok := idp.challenges[code]; ok {
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access-" + code,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, "rsa", idp.idClaims("unlockr", nonce, time.Hour)),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer access-") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(idp.claims)
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) idClaims(aud, nonce string, valid time.Duration) map[string]any {
+	c := map[string]any{
+		"iss":   idp.URL,
+		"sub":   "1234",
+		"aud":   aud,
+		"exp":   time.Now().Add(valid).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range idp.claims {
+		c[k] = v
+	}
+	return c
+}
+
+// sign returns a compact JWS of claims, signed by the key with ID kid.
+func (idp *testIdP) sign(t *testing.T, kid string, claims map[string]any) string {
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch kid {
+	case "rsa":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+	case "ec":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	var got *access.User
+	h := &OAuthHandler{
+		Config: &oauth2.Config{ClientID: "unlockr", ClientSecret: "secret"},
+		Profile: &jsonOAuthProfile{&OAuthOIDC{
+			Issuer:      idp.URL,
+			GroupsClaim: "realm_access.roles",
+		}},
+		PostRedirectURL: "/",
+		SessionStore:    &store.SessionStoreCache{},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = access.FromContext(r.Context())
+		}),
+	}
+
+	// Login redirects to the discovered authorization endpoint:
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", LoginURL+"?redirect="+url.QueryEscape("/#/open/front"), nil))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusSeeOther {
+		t.Fatalf("login: got %d %v", w.Code, err)
+	}
+	if want := idp.URL + "/authorize"; !strings.HasPrefix(loc.String(), want) {
+		t.Errorf("login: got redirect %s, want %s", loc, want)
+	}
+	q := loc.Query()
+	if !strings.Contains(q.Get("scope"), "openid") || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("login: missing OIDC parameters: %s", loc)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login: missing PKCE parameters: %s", loc)
+	}
+	idp.nonces["code1"] = q.Get("nonce")
+	idp.challenges["code1"] = q.Get("code_challenge")
+
+	// Exchange verifies the ID token and creates a session, returning
+	// the user to where they were:
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", OAuthRedirectURL+"?code=code1&state="+url.QueryEscape(q.Get("state")), nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/#/open/front" {
+		t.Fatalf("exchange: got %d, %s: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	cookies := w.Result().Cookies()
+
+	r := httptest.NewRequest("GET", "/api/user", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	want := &access.User{Username: "alice", Nickname: "Alice", Groups: access.Groups{"staff", "admin"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("user: got %+v, want %+v", got, want)
+	}
+
+	// The state can't be replayed:
+	idp.nonces["code2"] = q.Get("nonce")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", OAuthRedirectURL+"?code=code2&state="+url.QueryEscape(q.Get("state")), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("replayed state: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Uncached users are fetched from userinfo:
+	ctx := NewContextToken(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access-code1"}))
+	u, err := h.Profile.User(ctx, "alice")
+	if err != nil || !reflect.DeepEqual(u, want) {
+		t.Errorf("userinfo: got %+v, %v, want %+v", u, err, want)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	o := &OAuthOIDC{Issuer: idp.URL}
+	if err := o.configure(context.Background(), &oauth2.Config{ClientID: "unlockr"}); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := idp.sign(t, "rsa", idp.idClaims("unlockr", "n", time.Hour))
+	forged = forged[:strings.LastIndex(forged, ".")] + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 256))
+	audList := idp.idClaims("unlockr", "n", time.Hour)
+	audList["aud"] = []string{"other", "unlockr"}
+	wrongIssuer := idp.idClaims("unlockr", "n", time.Hour)
+	wrongIssuer["iss"] = "https://evil.example"
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + "."
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}{
+		{"rsa", idp.sign(t, "rsa", idp.idClaims("unlockr", "n", time.Hour)), "n", true},
+		{"ec", idp.sign(t, "ec", idp.idClaims("unlockr", "n", time.Hour)), "n", true},
+		{"audience list", idp.sign(t, "rsa", audList), "n", true},
+		{"wrong audience", idp.sign(t, "rsa", idp.idClaims("other", "n", time.Hour)), "n", false},
+		{"wrong nonce", idp.sign(t, "rsa", idp.idClaims("unlockr", "n", time.Hour)), "m", false},
+		{"expired", idp.sign(t, "rsa", idp.idClaims("unlockr", "n", -time.Hour)), "n", false},
+		{"wrong issuer", idp.sign(t, "rsa", wrongIssuer), "n", false},
+		{"forged", forged, "n", false},
+		{"unsigned", unsigned, "n", false},
+	} {
+		_, err := o.verify(context.Background(), tc.token, tc.nonce)
+		if tc.ok && err != nil {
+			t.Errorf("%s: got %v, want nil", tc.name, err)
+		} else if !tc.ok && !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrInvalidToken)
+		}
+	}
+}
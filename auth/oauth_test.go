@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestReturnPath(t *testing.T) {
+	for p, ok := range map[string]bool{
+		"/":                    true,
+		"/#/open/front-door":   true,
+		"/app/?t=abc#/open/x":  true,
+		"":                     false,
+		"front-door":           false,
+		"//evil.example/":      false,
+		"/\\evil.example/":     false,
+		"https://evil.example": false,
+		"javascript:alert(1)":  false,
+	} {
+		if _, got := returnPath(p); got != ok {
+			t.Errorf("returnPath(%q): got %v, want %v", p, got, ok)
+		}
+	}
+}
+
+func TestPKCEMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	h := &OAuthHandler{
+		Config:  &oauth2.Config{ClientID: "unlockr"},
+		Profile: &jsonOAuthProfile{&OAuthOIDC{Issuer: idp.URL}},
+	}
+	h.init()
+	st := &loginState{nonce: "n", verifier: "wrong"}
+	ctok, err := h.csrfTokens.New(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.nonces["code"] = "n"
+	idp.challenges["code"] = "not-the-challenge-for-wrong"
+
+	w := httptest.NewRecorder()
+	h.ServeExchange(w, httptest.NewRequest("GET", OAuthRedirectURL+"?code=code&state="+url.QueryEscape(ctok), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("exchange with wrong verifier: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
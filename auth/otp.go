@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+const (
+	otpIssuer    = "Unlockr"
+	otpDigits    = 6
+	otpPeriod    = 30 * time.Second
+	otpSkew      = 1 // time steps either side of now which are accepted
+	otpSecretLen = 20
+
+	recoveryCodeCount = 10
+	recoveryCodeLen   = 10 // bytes of randomness, before encoding
+)
+
+// OTPRequired is returned by /api/login if the password was correct, but
+// a one-time password is also needed. The client should try again with otp set.
+const OTPRequired = "otp required"
+
+var (
+	ErrOTPRequired = errors.New(OTPRequired)
+	ErrBadOTP      = errors.New("incorrect one-time password")
+)
+
+var otpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// otpMu serialises OTP checks, so that each code is only accepted once.
+var otpMu sync.Mutex
+
+// totp returns the code for secret at time step counter, as per RFC 6238.
+func totp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", otpDigits, code%1_000_000)
+}
+
+func otpCounter(t time.Time) int64 {
+	return t.Unix() / int64(otpPeriod/time.Second)
+}
+
+// verifyOTP checks code, which may be a TOTP or recovery code. If valid,
+// o is updated so that the code can't be used again, and must be saved.
+func verifyOTP(o *access.OTP, code string, t time.Time) bool {
+	code = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+
+	if len(code) == otpDigits {
+		secret, err := otpEncoding.DecodeString(strings.ToUpper(o.Secret))
+		if err != nil {
+			log.Printf("OTP: bad secret: %v", err)
+			return false
+		}
+		now := otpCounter(t)
+		for c := now - otpSkew; c <= now+otpSkew; c++ {
+			if c <= o.LastCounter {
+				continue // already used
+			}
+			if subtle.ConstantTimeCompare([]byte(totp(secret, c)), []byte(code)) == 1 {
+				o.LastCounter = c
+				return true
+			}
+		}
+		return false
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, rc := range o.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(hash)) == 1 {
+			o.RecoveryCodes = append(o.RecoveryCodes[:i:i], o.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns codes to show the user, and their hashes to store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := otpEncoding.EncodeToString(buf)
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkOTP returns nil if u has no OTP enabled, or if code is valid.
+func checkOTP(ctx context.Context, us access.UserStore, u access.Username, code string) error {
+	otps, ok := us.(access.OTPStore)
+	if !ok {
+		return nil
+	}
+	otpMu.Lock()
+	defer otpMu.Unlock()
+	o, err := otps.OTP(ctx, u)
+	if errors.Is(err, access.ErrNoOTP) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !o.Enabled {
+		return nil
+	}
+	if code == "" {
+		return ErrOTPRequired
+	}
+	if !verifyOTP(o, code, time.Now()) {
+		return ErrBadOTP
+	}
+	return otps.SaveOTP(ctx, u, o)
+}
+
+// OTPRequest is the body for /api/user/otp.
+type OTPRequest struct {
+	Code string `json:"code"`
+}
+
+// OTPResponse is returned by /api/user/otp. Fields are only set when relevant.
+type OTPResponse struct {
+	Enabled       bool     `json:"enabled"`
+	Secret        string   `json:"secret,omitempty"`
+	URI           string   `json:"uri,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// ServeOTP manages the user's one-time passwords:
+//
+//   - GET shows whether OTP is enabled.
+//   - POST without a code starts enrolment, returning a new secret.
+//   - POST with a code from the new secret enables OTP, returning recovery codes.
+//   - DELETE with a code (or recovery code) disables OTP.
+func (h *PasswordAuthHandler) ServeOTP(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot use OTP", http.StatusForbidden)
+		return
+	}
+	otps, ok := h.UserStore.(access.OTPStore)
+	if !ok {
+		http.Error(w, "OTP not supported by this datastore", http.StatusNotImplemented)
+		return
+	}
+	var req OTPRequest
+	if r.Method != "GET" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Badly formatted OTP request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	otpMu.Lock()
+	defer otpMu.Unlock()
+	o, err := otps.OTP(r.Context(), u.Username)
+	if errors.Is(err, access.ErrNoOTP) {
+		o = nil
+	} else if err != nil {
+		log.Printf("OTP lookup failed: %v", err)
+		http.Error(w, "OTP lookup failed", http.StatusInternalServerError)
+		return
+	}
+
+	var resp OTPResponse
+	switch r.Method {
+	case "GET":
+		resp.Enabled = o != nil && o.Enabled
+	case "POST":
+		switch {
+		case o != nil && o.Enabled:
+			http.Error(w, "OTP already enabled", http.StatusConflict)
+			return
+		case req.Code == "":
+			secret := make([]byte, otpSecretLen)
+			if _, err := rand.Read(secret); err != nil {
+				http.Error(w, "Internal error (generating secret)", http.StatusInternalServerError)
+				return
+			}
+			o = &access.OTP{Secret: otpEncoding.EncodeToString(secret)}
+			resp.Secret = o.Secret
+			resp.URI = otpURI(u.Username, o.Secret)
+		case o == nil:
+			http.Error(w, "OTP enrolment not started", http.StatusBadRequest)
+			return
+		case !verifyOTP(o, req.Code, time.Now()):
+			http.Error(w, "Incorrect code", http.StatusForbidden)
+			return
+		default:
+			codes, hashes, err := newRecoveryCodes()
+			if err != nil {
+				http.Error(w, "Internal error (generating recovery codes)", http.StatusInternalServerError)
+				return
+			}
+			o.Enabled = true
+			o.RecoveryCodes = hashes
+			resp.Enabled = true
+			resp.RecoveryCodes = codes
+		}
+		if err := otps.SaveOTP(r.Context(), u.Username, o); err != nil {
+			log.Printf("OTP save failed: %v", err)
+			http.Error(w, "OTP save failed", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		if o != nil && o.Enabled && !verifyOTP(o, req.Code, time.Now()) {
+			http.Error(w, "Incorrect code", http.StatusForbidden)
+			return
+		}
+		if err := otps.SaveOTP(r.Context(), u.Username, nil); err != nil {
+			log.Printf("OTP save failed: %v", err)
+			http.Error(w, "OTP save failed", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Must use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// otpURI returns a URI for authenticator apps, usually shown as a QR code.
+func otpURI(u access.Username, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", otpIssuer)
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + otpIssuer + ":" + string(u),
+		RawQuery: q.Encode(),
+	}).String()
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to 6 digits:
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		t    int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if got := totp(secret, otpCounter(time.Unix(tc.t, 0))); got != tc.want {
+			t.Errorf("totp(T=%d): got %s, want %s", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &access.OTP{
+		Secret:        otpEncoding.EncodeToString(secret),
+		Enabled:       true,
+		RecoveryCodes: hashes,
+	}
+	now := time.Unix(1111111111, 0)
+
+	if verifyOTP(o, "000000", now) {
+		t.Errorf("wrong code accepted")
+	}
+	if !verifyOTP(o, "050471", now) {
+		t.Fatalf("correct code rejected")
+	}
+	if verifyOTP(o, "050471", now) {
+		t.Errorf("code accepted twice")
+	}
+	// The previous step is allowed for clock skew, but not once a later code was used:
+	if verifyOTP(o, totp(secret, otpCounter(now)-1), now) {
+		t.Errorf("older code accepted after newer one")
+	}
+	if !verifyOTP(o, totp(secret, otpCounter(now)+1), now) {
+		t.Errorf("next code rejected")
+	}
+
+	// Recovery codes are single use, and may be typed with spaces or dashes:
+	code := strings.ToLower(codes[3][:4] + "-" + codes[3][4:])
+	if !verifyOTP(o, code, now) {
+		t.Errorf("recovery code %q rejected", code)
+	}
+	if verifyOTP(o, codes[3], now) {
+		t.Errorf("recovery code accepted twice")
+	}
+	if len(o.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("got %d recovery codes left, want %d", len(o.RecoveryCodes), recoveryCodeCount-1)
+	}
+}
+
+// otpUserStore is a UserStore which also stores OTPs in memory.
+type otpUserStore struct {
+	users access.Users
+	otps  map[access.Username]access.OTP
+}
+
+func (s *otpUserStore) User(ctx context.Context, u access.Username) (*access.User, error) {
+	user, ok := s.users[u]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user.Username = u
+	return &user, nil
+}
+
+func (s *otpUserStore) OTP(ctx context.Context, u access.Username) (*access.OTP, error) {
+	o, ok := s.otps[u]
+	if !ok {
+		return nil, access.ErrNoOTP
+	}
+	return &o, nil
+}
+
+func (s *otpUserStore) SaveOTP(ctx context.Context, u access.Username, o *access.OTP) error {
+	if o == nil {
+		delete(s.otps, u)
+	} else {
+		s.otps[u] = *o
+	}
+	return nil
+}
+
+func TestOTPLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := &otpUserStore{
+		users: access.Users{
+			"alice": {PasswordHash: string(hash)},
+			"bob":   {PasswordHash: string(hash)},
+		},
+		otps: make(map[access.Username]access.OTP),
+	}
+	secret := []byte("12345678901234567890")
+	us.otps["alice"] = access.OTP{
+		Secret:  otpEncoding.EncodeToString(secret),
+		Enabled: true,
+	}
+	h := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    us,
+		SessionStore: &store.SessionStoreCache{},
+		// Not testing lockouts here (see TestLockout):
+		Lockout: LockoutConfig{Allowlist: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}},
+	}
+
+	login := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", LoginURL, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	code := totp(secret, otpCounter(time.Now()))
+
+	for _, tc := range []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"bad password", `{"username":"alice","password":"x"}`, http.StatusUnauthorized, "Authentication error"},
+		{"bad password with otp", `{"username":"alice","password":"x","otp":"` + code + `"}`, http.StatusUnauthorized, "Authentication error"},
+		{"no otp", `{"username":"alice","password":"hunter2"}`, http.StatusUnauthorized, OTPRequired},
+		{"wrong otp", `{"username":"alice","password":"hunter2","otp":"000000"}`, http.StatusUnauthorized, "Authentication error"},
+		{"otp", `{"username":"alice","password":"hunter2","otp":"` + code + `"}`, http.StatusOK, "ok"},
+		{"replayed otp", `{"username":"alice","password":"hunter2","otp":"` + code + `"}`, http.StatusUnauthorized, "Authentication error"},
+		{"not enrolled", `{"username":"bob","password":"hunter2"}`, http.StatusOK, "ok"},
+	} {
+		w := login(tc.body)
+		if w.Code != tc.wantStatus || strings.TrimSpace(w.Body.String()) != tc.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tc.name, w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+		}
+		if hasCookie := w.Header().Get("Set-Cookie") != ""; hasCookie != (tc.wantStatus == http.StatusOK) {
+			t.Errorf("%s: got session cookie %v", tc.name, hasCookie)
+		}
+	}
+}
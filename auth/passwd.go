@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+const (
+	DefaultMinPasswordLength = 8
+	maxPasswordLength        = 72 // bytes, beyond which bcrypt ignores the rest
+)
+
+var ErrWeakPassword = errors.New("password not allowed")
+
+// PasswordPolicy is enforced when passwords are changed or reset.
+type PasswordPolicy struct {
+	// MinLength is in characters. Defaults to 8.
+	MinLength int `json:"minlength,omitempty"`
+
+	// MinClasses is how many kinds of character must be used, out of
+	// lower case, upper case, digits and others. Defaults to 1.
+	MinClasses int `json:"minclasses,omitempty"`
+}
+
+func (p *PasswordPolicy) check(u access.Username, password string) error {
+	minLength := p.MinLength
+	if minLength <= 0 {
+		minLength = DefaultMinPasswordLength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, minLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("%w: must be at most %d bytes", ErrWeakPassword, maxPasswordLength)
+	}
+	if strings.EqualFold(password, string(u)) {
+		return fmt.Errorf("%w: must not be the username", ErrWeakPassword)
+	}
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if classes := lower + upper + digit + other; classes < p.MinClasses {
+		return fmt.Errorf("%w: must use %d of lower case, upper case, digits and symbols", ErrWeakPassword, p.MinClasses)
+	}
+	return nil
+}
+
+// PasswordRequest is the JSON body when changing a password. Old is not
+// needed when an admin resets someone else's password.
+type PasswordRequest struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// ServePassword changes the user's own password with POST /api/user/password.
+// The user's other sessions and API tokens are signed out.
+func (h *PasswordAuthHandler) ServePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot change passwords", http.StatusForbidden)
+		return
+	}
+	var req PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Badly formatted password request", http.StatusBadRequest)
+		return
+	}
+
+	// Guessing the old password is limited like logins:
+	addr := h.Lockout.clientAddr(r)
+	wait, attempt := h.Lockout.begin(u.Username, addr)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		http.Error(w, "Too many failed attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	defer attempt.cancel() // unless it failed or succeeded
+	if _, err := access.Authenticate(r.Context(), h.UserStore, u.Username, req.Old); errors.Is(err, access.ErrBadPassword) {
+		log.Printf("password change failed for %q: %v", u.Username, err)
+		attempt.fail()
+		http.Error(w, "Incorrect password", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("password change failed for %q: %v", u.Username, err)
+		http.Error(w, "User lookup failed", http.StatusInternalServerError)
+		return
+	}
+	attempt.succeed()
+
+	others, err := h.otherSessions(r, u.Username)
+	if err != nil {
+		servePasswordError(w, u.Username, err)
+		return
+	}
+	if err := h.setPassword(r, u.Username, req.New); err != nil {
+		servePasswordError(w, u.Username, err)
+		return
+	}
+	log.Printf("password changed by %q", u.Username)
+	if err := h.deleteSessions(r.Context(), others); err != nil {
+		log.Printf("signing out other sessions of %q failed: %v", u.Username, err)
+		http.Error(w, "Password changed, but signing out other sessions failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeAdminPassword lets admins reset a user's password with
+// POST /api/admin/users/{username}/password. Old is not needed, and the
+// user's sessions and API tokens are signed out.
+func (h *PasswordAuthHandler) ServeAdminPassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok || !u.IsAdmin() {
+		http.Error(w, "Must be an admin", http.StatusForbidden)
+		return
+	}
+	name, _ := strings.CutPrefix(r.URL.Path, adminUsersPath+"/")
+	name, ok = strings.CutSuffix(name, "/password")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Badly formatted password request", http.StatusBadRequest)
+		return
+	}
+	target := access.Username(name)
+	others, err := h.otherSessions(r, target)
+	if err != nil {
+		servePasswordError(w, target, err)
+		return
+	}
+	if err := h.setPassword(r, target, req.New); err != nil {
+		servePasswordError(w, target, err)
+		return
+	}
+	h.Lockout.forget(target)
+	log.Printf("password of %q reset by %q", target, u.Username)
+	if err := h.deleteSessions(r.Context(), others); err != nil {
+		log.Printf("signing out other sessions of %q failed: %v", target, err)
+		http.Error(w, "Password changed, but signing out other sessions failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PasswordAuthHandler) setPassword(r *http.Request, u access.Username, password string) error {
+	usw, ok := h.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return store.ErrNoUserStoreWriter
+	}
+	if err := h.PasswordPolicy.check(u, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return usw.SetPasswordHash(r.Context(), u, string(hash))
+}
+
+// otherSessions returns u's sessions and API tokens, except the one making
+// the request, so that they can be signed out once the password is changed.
+// They are found first, so that nothing is changed if that fails.
+func (h *PasswordAuthHandler) otherSessions(r *http.Request, u access.Username) ([]session.SessionId, error) {
+	sessions, err := h.SessionStore.SessionsForUser(r.Context(), u)
+	if errors.Is(err, store.ErrNoSessionsForUser) {
+		// Changing the password is still worthwhile:
+		log.Printf("other sessions of %q can't be signed out: %v", u, err)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	current, _ := session.CurrentID(r)
+	var ids []session.SessionId
+	for id := range sessions {
+		if id != current {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func servePasswordError(w http.ResponseWriter, u access.Username, err error) {
+	switch {
+	case errors.Is(err, ErrWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrNoUserStoreWriter):
+		http.Error(w, "Password changes not supported by this datastore", http.StatusNotImplemented)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "No such user", http.StatusNotFound)
+	default:
+		log.Printf("saving password of %q failed: %v", u, err)
+		http.Error(w, "Error saving password", http.StatusInternalServerError)
+	}
+}
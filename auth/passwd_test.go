@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	p := &PasswordPolicy{MinClasses: 3}
+	for _, tc := range []struct {
+		password string
+		ok       bool
+	}{
+		{"Short1!", false},
+		{"alllowercase", false},
+		{"lower and UPPER", true},
+		{"ÜnïcödéΣ9", true},
+		{"Alice123", false},
+		{strings.Repeat("aA1", 25), false},
+	} {
+		if err := p.check("alice123", tc.password); (err == nil) != tc.ok {
+			t.Errorf("%q: got %v, want ok %v", tc.password, err, tc.ok)
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/users.json"
+	users := `{"users":{` +
+		`"alice":{"nickname":"Alice","password_hash":"` + string(hash) + `","groups":["admin"]},` +
+		`"bob":{"nickname":"Bob","password_hash":"` + string(hash) + `"}}}`
+	if err := os.WriteFile(path, []byte(users), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	us := &store.UserStoreCache{UserStore: &store.FileStore{Path: path}}
+	ss := &store.SessionStoreCache{}
+	h := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    us,
+		SessionStore: ss,
+	}
+	// Bob is signed in twice, and has an API token:
+	expiry := time.Now().Add(time.Hour)
+	saveSessions := func() {
+		for _, id := range []session.SessionId{"bob", "bob2", "bobtoken"} {
+			if err := ss.SaveSession(context.Background(), id, &session.Session{Username: "bob", Expiry: expiry}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	saveSessions()
+	signedIn := func(id session.SessionId) bool {
+		_, err := ss.Session(context.Background(), id)
+		return err == nil
+	}
+	serve := func(f http.HandlerFunc, as access.Username, url, body string) int {
+		ctx := context.Background()
+		if as != "" {
+			u, err := us.User(ctx, as)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx = u.NewContext(ctx)
+		}
+		r := httptest.NewRequest("POST", url, strings.NewReader(body)).WithContext(ctx)
+		r.AddCookie(&http.Cookie{Name: "Unlockr-Session", Value: string(as)})
+		w := httptest.NewRecorder()
+		f(w, r)
+		return w.Code
+	}
+	login := func(username, password string) bool {
+		_, err := access.Authenticate(context.Background(), us, access.Username(username), password)
+		return err == nil
+	}
+
+	// Guessing the old password backs off like logins:
+	if code := serve(h.ServePassword, "bob", "/api/user/password", `{"old":"x","new":"correct horse"}`); code != http.StatusForbidden {
+		t.Errorf("wrong password: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := serve(h.ServePassword, "bob", "/api/user/password", `{"old":"hunter2","new":"correct horse"}`); code != http.StatusTooManyRequests {
+		t.Errorf("retried immediately: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	clock = clock.Add(time.Minute)
+
+	for _, tc := range []struct {
+		name string
+		f    http.HandlerFunc
+		as   access.Username
+		url  string
+		body string
+		want int
+	}{
+		{"weak password", h.ServePassword, "bob", "/api/user/password", `{"old":"hunter2","new":"x"}`, http.StatusBadRequest},
+		{"change", h.ServePassword, "bob", "/api/user/password", `{"old":"hunter2","new":"correct horse"}`, http.StatusNoContent},
+		{"not admin", h.ServeAdminPassword, "bob", "/api/admin/users/alice/password", `{"new":"battery staple"}`, http.StatusForbidden},
+		{"no such user", h.ServeAdminPassword, "alice", "/api/admin/users/carol/password", `{"new":"battery staple"}`, http.StatusNotFound},
+		{"bad path", h.ServeAdminPassword, "alice", "/api/admin/users/bob", `{"new":"battery staple"}`, http.StatusNotFound},
+		{"reset", h.ServeAdminPassword, "alice", "/api/admin/users/bob/password", `{"new":"battery staple"}`, http.StatusNoContent},
+	} {
+		if code := serve(tc.f, tc.as, tc.url, tc.body); code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, code, tc.want)
+		}
+		if tc.name == "change" && (login("bob", "hunter2") || !login("bob", "correct horse")) {
+			t.Errorf("%s: password not changed", tc.name)
+		}
+		switch tc.name {
+		case "change":
+			// Only the session making the change is kept:
+			if !signedIn("bob") || signedIn("bob2") || signedIn("bobtoken") {
+				t.Errorf("%s: got signed in bob=%v bob2=%v bobtoken=%v, want only bob", tc.name, signedIn("bob"), signedIn("bob2"), signedIn("bobtoken"))
+			}
+			saveSessions()
+		case "reset":
+			for _, id := range []session.SessionId{"bob", "bob2", "bobtoken"} {
+				if signedIn(id) {
+					t.Errorf("%s: session %s still valid", tc.name, id)
+				}
+			}
+		}
+	}
+	if login("bob", "correct horse") || !login("bob", "battery staple") {
+		t.Errorf("reset: password not changed")
+	}
+	if !login("alice", "hunter2") {
+		t.Errorf("other user's password changed")
+	}
+	if u, err := us.User(context.Background(), "alice"); err != nil || u.Nickname != "Alice" || !u.IsAdmin() {
+		t.Errorf("other user changed: %+v %v", u, err)
+	}
+}
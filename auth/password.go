@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"jeremy.visser.name/go/unlockr/access"
 	"jeremy.visser.name/go/unlockr/session"
@@ -16,6 +18,10 @@ import (
 type AuthRequest struct {
 	access.Username `json:"username"`
 	Password        string `json:"password"`
+
+	// OTP is a one-time password or recovery code, if the user has enabled
+	// OTP. Login requests without one get an OTPRequired error.
+	OTP string `json:"otp,omitempty"`
 }
 
 // PasswordAuthHandler authenticates the request before passing it to the underlying Handler.
@@ -23,6 +29,20 @@ type PasswordAuthHandler struct {
 	http.Handler         `json:"-"`
 	access.UserStore     `json:"-"`
 	session.SessionStore `json:"-"`
+
+	// RPID is the domain passkeys are registered for. Passkeys are
+	// disabled unless it is set.
+	RPID string `json:"rpid,omitempty"`
+
+	// RPOrigins are the origins passkeys may be used from. They default
+	// to https://RPID.
+	RPOrigins []string `json:"rporigins,omitempty"`
+
+	// Lockout limits failed logins. It is always enabled, with defaults.
+	Lockout LockoutConfig `json:"lockout"`
+
+	// PasswordPolicy applies when users change their passwords.
+	PasswordPolicy PasswordPolicy `json:"passwordpolicy"`
 }
 
 func (h *PasswordAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -30,11 +50,14 @@ func (h *PasswordAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	case LoginURL:
 		h.ServeLogin(w, r)
 		return
+	case PasskeyLoginURL:
+		h.ServePasskeyLogin(w, r)
+		return
 	case LogoutURL:
 		h.ServeLogout(w, r)
 		return
 	}
-	ctx, _, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
+	ctx, id, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
 	if err != nil {
 		log.Print("session not valid: ", err)
 		http.Error(w, "session not valid", http.StatusUnauthorized)
@@ -46,10 +69,24 @@ func (h *PasswordAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "user not valid", http.StatusUnauthorized)
 		return
 	}
-	ctx = u.NewContext(ctx)
+	ctx = NewContextMethod(u.NewContext(ctx), "password")
+	ctx = access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+		s, err := session.Get(ctx, id, h.SessionStore)
+		if err != nil {
+			return nil, err
+		}
+		return h.UserStore.User(ctx, s.Username)
+	})
 	h.Handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// authenticates is true if r has a session without extra data, which
+// other auth methods' sessions have.
+func (h *PasswordAuthHandler) authenticates(r *http.Request) bool {
+	_, _, s, err := session.FromRequest(r.Context(), r, h.SessionStore)
+	return err == nil && len(s.Extra) == 0
+}
+
 func (h *PasswordAuthHandler) ServeLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "must be POST", http.StatusMethodNotAllowed)
@@ -61,10 +98,24 @@ func (h *PasswordAuthHandler) ServeLogin(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Badly formatted auth request", http.StatusBadRequest)
 		return
 	}
-	user, err := h.UserStore.User(r.Context(), ar.Username)
+	addr := h.Lockout.clientAddr(r)
+	wait, attempt := h.Lockout.begin(ar.Username, addr)
+	if wait > 0 {
+		log.Printf("login as %q from %s refused for another %s", ar.Username, addr, wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		http.Error(w, "Too many failed logins, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	defer attempt.cancel() // unless it failed or succeeded
+	user, err := access.Authenticate(r.Context(), h.UserStore, ar.Username, ar.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			log.Print("user not found: ", err)
+			attempt.fail()
+			http.Error(w, "Authentication error", http.StatusUnauthorized)
+		} else if errors.Is(err, access.ErrBadPassword) || errors.Is(err, access.ErrUserDisabled) {
+			log.Print("auth failed:", err)
+			attempt.fail()
 			http.Error(w, "Authentication error", http.StatusUnauthorized)
 		} else {
 			log.Print("user lookup failed: ", err)
@@ -72,13 +123,21 @@ func (h *PasswordAuthHandler) ServeLogin(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	err = user.Authenticate(ar.Password)
-	if err != nil {
+	if err := checkOTP(r.Context(), h.UserStore, user.Username, ar.OTP); errors.Is(err, ErrOTPRequired) {
+		http.Error(w, OTPRequired, http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, ErrBadOTP) {
 		log.Print("auth failed:", err)
+		attempt.fail()
 		http.Error(w, "Authentication error", http.StatusUnauthorized)
 		return
+	} else if err != nil {
+		log.Print("OTP lookup failed: ", err)
+		http.Error(w, "Internal server error while logging in", http.StatusInternalServerError)
+		return
 	}
 	// User is successfully authenticated at this point, so create session:
+	attempt.succeed()
 	_, err = session.Register(user.Username, nil, w, r, h.SessionStore)
 	if err != nil {
 		log.Print("session registration failed:", err)
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+const sessionsPath = "/api/sessions"
+
+// SessionsHandler lets users see where they are logged in, and sign out
+// remotely, e.g. from a lost phone.
+type SessionsHandler struct {
+	SessionStore session.SessionStore
+}
+
+// SessionInfo describes a login session. Guest passes and API tokens are
+// managed elsewhere, and not listed.
+type SessionInfo struct {
+	ID       SessionInfoID `json:"id"`
+	Device   string        `json:"device,omitempty"`
+	Addr     string        `json:"addr,omitempty"`
+	LastSeen *time.Time    `json:"lastseen,omitempty"`
+	Expiry   time.Time     `json:"expiry"`
+
+	// Current is true for the session making the request.
+	Current bool `json:"current,omitempty"`
+}
+
+// SessionInfoID identifies a session without revealing it.
+type SessionInfoID string
+
+func newSessionInfoID(id session.SessionId) SessionInfoID {
+	sum := sha256.Sum256([]byte(id))
+	return SessionInfoID(hex.EncodeToString(sum[:8]))
+}
+
+func newSessionInfo(id session.SessionId, s *session.Session) SessionInfo {
+	info := SessionInfo{
+		ID:     newSessionInfoID(id),
+		Device: s.Device,
+		Addr:   s.Addr,
+		Expiry: s.Expiry,
+	}
+	if !s.LastSeen.IsZero() {
+		info.LastSeen = &s.LastSeen
+	}
+	return info
+}
+
+// ServeHTTP lists the user's sessions with GET /api/sessions, signs one out
+// with DELETE /api/sessions/{id}, or signs out all but the current session
+// with DELETE /api/sessions.
+func (h *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot manage sessions", http.StatusForbidden)
+		return
+	}
+	sid, _ := strings.CutPrefix(r.URL.Path, sessionsPath)
+	sid = strings.TrimPrefix(sid, "/")
+	switch {
+	case sid == "" && r.Method == "GET", r.Method == "DELETE":
+	default:
+		http.Error(w, "Must use GET or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions, err := h.sessions(r, u.Username)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		http.Error(w, "error listing sessions", http.StatusInternalServerError)
+		return
+	}
+	current, _ := session.CurrentID(r)
+
+	if r.Method == "GET" {
+		list := make([]SessionInfo, 0, len(sessions))
+		for id, s := range sessions {
+			info := newSessionInfo(id, s)
+			info.Current = id == current
+			list = append(list, info)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Current != list[j].Current {
+				return list[i].Current
+			}
+			return list[i].Expiry.After(list[j].Expiry)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	var found bool
+	for id := range sessions {
+		if sid == "" && id == current || sid != "" && newSessionInfoID(id) != SessionInfoID(sid) {
+			continue
+		}
+		found = true
+		if err := h.SessionStore.DeleteSession(r.Context(), id); err != nil {
+			log.Printf("Error deleting session: %v", err)
+			http.Error(w, "error signing out session", http.StatusInternalServerError)
+			return
+		}
+	}
+	if sid != "" && !found {
+		http.NotFound(w, r)
+		return
+	}
+	if sid == "" {
+		log.Printf("other sessions of %q signed out", u.Username)
+	} else {
+		log.Printf("session %s of %q signed out", sid, u.Username)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessions returns u's login sessions, without guest passes or API tokens.
+func (h *SessionsHandler) sessions(r *http.Request, u access.Username) (map[session.SessionId]*session.Session, error) {
+	sessions, err := h.SessionStore.SessionsForUser(r.Context(), u)
+	if err != nil {
+		return nil, err
+	}
+	for id, s := range sessions {
+		if s.Extra.Parent() != "" || s.IsExpired() {
+			delete(sessions, id)
+		}
+	}
+	return sessions, nil
+}
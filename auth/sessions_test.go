@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+func TestSessions(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &store.SessionStoreCache{}
+	var mux http.ServeMux
+	mux.Handle(sessionsPath, &SessionsHandler{SessionStore: ss})
+	mux.Handle(sessionsPath+"/", &SessionsHandler{SessionStore: ss})
+	h := &PasswordAuthHandler{
+		Handler:      &mux,
+		UserStore:    &otpUserStore{users: access.Users{"alice": {PasswordHash: string(hash)}}},
+		SessionStore: ss,
+	}
+	login := func(device string) []*http.Cookie {
+		r := httptest.NewRequest("POST", LoginURL, strings.NewReader(`{"username":"alice","password":"hunter2"}`))
+		r.Header.Set("User-Agent", device)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login: got %d %q", w.Code, w.Body.String())
+		}
+		return w.Result().Cookies()
+	}
+	serve := func(method, url string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	list := func(cookies []*http.Cookie) []SessionInfo {
+		w := serve("GET", sessionsPath, cookies)
+		var infos []SessionInfo
+		if err := json.NewDecoder(w.Body).Decode(&infos); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("list: got %d %v", w.Code, err)
+		}
+		return infos
+	}
+
+	laptop := login("Laptop")
+	phone := login("Phone")
+	login("Tablet")
+
+	infos := list(laptop)
+	if len(infos) != 3 || !infos[0].Current || infos[0].Device != "Laptop" || infos[0].Addr != "192.0.2.1" || infos[0].LastSeen == nil {
+		t.Fatalf("list: got %+v", infos)
+	}
+
+	// Sign out the phone remotely:
+	var phoneID SessionInfoID
+	for _, info := range infos {
+		if info.Device == "Phone" {
+			phoneID = info.ID
+		}
+	}
+	if w := serve("DELETE", sessionsPath+"/"+string(phoneID), laptop); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("GET", sessionsPath, phone); w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted session: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve("DELETE", sessionsPath+"/"+string(phoneID), laptop); w.Code != http.StatusNotFound {
+		t.Errorf("delete again: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Sign out everywhere else:
+	if w := serve("DELETE", sessionsPath, laptop); w.Code != http.StatusNoContent {
+		t.Errorf("delete others: got %d %q", w.Code, w.Body.String())
+	}
+	if infos := list(laptop); len(infos) != 1 || !infos[0].Current {
+		t.Errorf("after delete others: got %+v", infos)
+	}
+}
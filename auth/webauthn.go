@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+const (
+	passkeyRPName        = "Unlockr"
+	passkeyTimeout       = 5 * time.Minute
+	passkeyChallenges    = 100 // outstanding at once
+	passkeyUserHandleLen = 32
+)
+
+var (
+	ErrBadPasskey         = errors.New("passkey verification failed")
+	ErrPasskeysNotEnabled = errors.New("passkeys not enabled (no rpid configured)")
+)
+
+// passkeyChallenge is remembered between sending options to the browser,
+// and verifying its response.
+type passkeyChallenge struct {
+	user access.Username // registering user; empty when logging in
+	data *webauthn.SessionData
+}
+
+var challenges = func() *lru.Cache[string, *passkeyChallenge] {
+	c, err := lru.New[string, *passkeyChallenge](passkeyChallenges)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+// takeChallenge returns the challenge's state. Each challenge may only be used once.
+func takeChallenge(challenge string) (*passkeyChallenge, bool) {
+	st, ok := challenges.Get(challenge)
+	if !ok {
+		return nil, false
+	}
+	challenges.Remove(challenge)
+	return st, time.Now().Before(st.data.Expires)
+}
+
+// PasskeyRegistration is the body for POST /api/user/passkeys: the
+// PublicKeyCredential from navigator.credentials.create(), and a name.
+type PasskeyRegistration struct {
+	Name string `json:"name"`
+	protocol.CredentialCreationResponse
+}
+
+// PasskeyInfo is returned by GET /api/user/passkeys.
+type PasskeyInfo struct {
+	ID      protocol.URLEncodedBase64 `json:"id"`
+	Name    string                    `json:"name"`
+	Created time.Time                 `json:"created"`
+}
+
+// passkeyUser is a user as seen by WebAuthn. Their handle is random, and
+// shared by all of their passkeys, so that it reveals nothing about them.
+type passkeyUser struct {
+	*access.User
+	handle   []byte
+	passkeys []access.Passkey
+}
+
+func newPasskeyUser(u *access.User, passkeys []access.Passkey) (*passkeyUser, error) {
+	pu := &passkeyUser{User: u, passkeys: passkeys}
+	for _, p := range passkeys {
+		if len(p.UserHandle) > 0 {
+			pu.handle = p.UserHandle
+			return pu, nil
+		}
+	}
+	pu.handle = make([]byte, passkeyUserHandleLen)
+	if _, err := rand.Read(pu.handle); err != nil {
+		return nil, err
+	}
+	return pu, nil
+}
+
+func (u *passkeyUser) WebAuthnID() []byte   { return u.handle }
+func (u *passkeyUser) WebAuthnName() string { return string(u.Username) }
+func (u *passkeyUser) WebAuthnIcon() string { return "" }
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if u.Nickname != "" {
+		return u.Nickname
+	}
+	return string(u.Username)
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, p := range u.passkeys {
+		creds = append(creds, webauthn.Credential{
+			ID:            p.ID,
+			PublicKey:     p.PublicKey,
+			Authenticator: webauthn.Authenticator{SignCount: p.SignCount},
+		})
+	}
+	return creds
+}
+
+// webAuthn returns the relying party for the configured RPID and RPOrigins.
+func (h *PasswordAuthHandler) webAuthn() (*webauthn.WebAuthn, error) {
+	if h.RPID == "" {
+		return nil, ErrPasskeysNotEnabled
+	}
+	origins := h.RPOrigins
+	if len(origins) == 0 {
+		origins = []string{"https://" + h.RPID}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          h.RPID,
+		RPDisplayName: passkeyRPName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyTimeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyTimeout},
+		},
+	})
+}
+
+// passkeyStore returns the datastore's PasskeyStore, and the relying
+// party, or writes an error if passkeys can't be used.
+func (h *PasswordAuthHandler) passkeyStore(w http.ResponseWriter) (access.PasskeyStore, *webauthn.WebAuthn, bool) {
+	pks, ok := h.UserStore.(access.PasskeyStore)
+	if !ok {
+		http.Error(w, "Passkeys not supported by this datastore", http.StatusNotImplemented)
+		return nil, nil, false
+	}
+	wa, err := h.webAuthn()
+	if err != nil {
+		log.Print("passkeys unavailable: ", err)
+		http.Error(w, "Passkeys not enabled", http.StatusNotImplemented)
+		return nil, nil, false
+	}
+	return pks, wa, true
+}
+
+// ServePasskeyLogin logs in with a passkey instead of a password.
+// GET returns options for navigator.credentials.get(), and the resulting
+// PublicKeyCredential is then POSTed back. Users are identified by the
+// passkey's user handle, so no username is needed. Passkeys must verify
+// the user (e.g. with a fingerprint), so they are not also asked for a
+// one-time password.
+func (h *PasswordAuthHandler) ServePasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	pks, wa, ok := h.passkeyStore(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		opts, data, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			log.Print("passkey login options: ", err)
+			http.Error(w, "Internal error (generating challenge)", http.StatusInternalServerError)
+			return
+		}
+		challenges.Add(data.Challenge, &passkeyChallenge{data: data})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(opts)
+		return
+	case "POST":
+	default:
+		http.Error(w, "Must use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pa, err := protocol.ParseCredentialRequestResponseBody(r.Body)
+	if err != nil {
+		log.Print("bad passkey assertion: ", err)
+		http.Error(w, "Badly formatted passkey assertion", http.StatusBadRequest)
+		return
+	}
+	var user *passkeyUser
+	var lookupErr error
+	err = func() error {
+		st, ok := takeChallenge(pa.Response.CollectedClientData.Challenge)
+		if !ok || st.user != "" {
+			return fmt.Errorf("%w: unknown or expired challenge", ErrBadPasskey)
+		}
+		cred, err := wa.ValidateDiscoverableLogin(func(_, handle []byte) (webauthn.User, error) {
+			user, lookupErr = h.findPasskeyUser(r.Context(), pks, handle)
+			return user, lookupErr
+		}, *st.data, pa)
+		if lookupErr != nil {
+			return lookupErr
+		} else if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadPasskey, err)
+		}
+		if cred.Authenticator.CloneWarning {
+			return fmt.Errorf("%w: sign count went backwards (cloned?)", ErrBadPasskey)
+		}
+		for _, p := range user.passkeys {
+			if bytes.Equal(p.ID, cred.ID) && p.SignCount != cred.Authenticator.SignCount {
+				p.SignCount = cred.Authenticator.SignCount
+				return pks.SavePasskey(r.Context(), user.Username, &p)
+			}
+		}
+		return nil
+	}()
+	if errors.Is(err, ErrBadPasskey) || errors.Is(err, access.ErrNoPasskey) {
+		log.Printf("passkey auth failed: %v", err)
+		http.Error(w, "Authentication error", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Print("passkey lookup failed: ", err)
+		http.Error(w, "Internal server error while logging in", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := session.Register(user.Username, nil, w, r, h.SessionStore); err != nil {
+		log.Print("session registration failed:", err)
+		http.Error(w, "Session registration error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// findPasskeyUser finds the user with the passkey user handle. Users who are
+// missing or disabled are reported as ErrBadPasskey.
+func (h *PasswordAuthHandler) findPasskeyUser(ctx context.Context, pks access.PasskeyStore, handle []byte) (*passkeyUser, error) {
+	username, err := pks.PasskeyUser(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	u, err := h.UserStore.User(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("%w: user %q: %w", ErrBadPasskey, username, err)
+	}
+	passkeys, err := pks.Passkeys(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyUser{User: u, handle: handle, passkeys: passkeys}, nil
+}
+
+// ServePasskeys manages the user's passkeys:
+//
+//   - GET lists them.
+//   - POST with an empty body returns options for navigator.credentials.create().
+//   - POST with a PasskeyRegistration saves the new passkey.
+//   - DELETE /api/user/passkeys/{id} removes one.
+func (h *PasswordAuthHandler) ServePasskeys(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := access.ParentFromContext(r.Context()); ok {
+		http.Error(w, "guests cannot use passkeys", http.StatusForbidden)
+		return
+	}
+	pks, wa, ok := h.passkeyStore(w)
+	if !ok {
+		return
+	}
+	passkeys, err := pks.Passkeys(r.Context(), u.Username)
+	if err != nil {
+		log.Printf("passkey lookup failed: %v", err)
+		http.Error(w, "Passkey lookup failed", http.StatusInternalServerError)
+		return
+	}
+	pu, err := newPasskeyUser(u, passkeys)
+	if err != nil {
+		http.Error(w, "Internal error (generating user handle)", http.StatusInternalServerError)
+		return
+	}
+
+	id, hasID := strings.CutPrefix(r.URL.Path, "/api/user/passkeys/")
+	switch {
+	case r.Method == "GET" && !hasID:
+		info := make([]PasskeyInfo, 0, len(passkeys))
+		for _, p := range passkeys {
+			info = append(info, PasskeyInfo{ID: p.ID, Name: p.Name, Created: p.Created})
+		}
+		sort.Slice(info, func(i, j int) bool {
+			return info[i].Created.Before(info[j].Created)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case r.Method == "POST" && !hasID:
+		var reg PasskeyRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil && err != io.EOF {
+			http.Error(w, "Badly formatted passkey registration", http.StatusBadRequest)
+			return
+		}
+		if len(reg.AttestationResponse.AttestationObject) == 0 {
+			servePasskeyOptions(w, wa, pu)
+			return
+		}
+		p, err := registerPasskey(wa, pu, &reg)
+		if err != nil {
+			log.Printf("passkey registration failed for %q: %v", u.Username, err)
+			http.Error(w, "Passkey registration failed", http.StatusBadRequest)
+			return
+		}
+		for _, existing := range passkeys {
+			if bytes.Equal(existing.ID, p.ID) {
+				http.Error(w, "Passkey already registered", http.StatusConflict)
+				return
+			}
+		}
+		if err := pks.SavePasskey(r.Context(), u.Username, p); err != nil {
+			log.Printf("passkey save failed: %v", err)
+			http.Error(w, "Passkey save failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&PasskeyInfo{ID: p.ID, Name: p.Name, Created: p.Created})
+	case r.Method == "DELETE" && hasID:
+		raw, err := base64.RawURLEncoding.DecodeString(id)
+		if err != nil {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		if err := pks.DeletePasskey(r.Context(), u.Username, raw); errors.Is(err, access.ErrNoPasskey) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("passkey delete failed: %v", err)
+			http.Error(w, "Passkey delete failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Must use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func servePasskeyOptions(w http.ResponseWriter, wa *webauthn.WebAuthn, u *passkeyUser) {
+	exclude := make([]protocol.CredentialDescriptor, 0, len(u.passkeys))
+	for _, c := range u.WebAuthnCredentials() {
+		exclude = append(exclude, c.Descriptor())
+	}
+	opts, data, err := wa.BeginRegistration(u,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithConveyancePreference(protocol.PreferNoAttestation),
+		webauthn.WithExclusions(exclude),
+	)
+	if err != nil {
+		log.Print("passkey registration options: ", err)
+		http.Error(w, "Internal error (generating challenge)", http.StatusInternalServerError)
+		return
+	}
+	challenges.Add(data.Challenge, &passkeyChallenge{user: u.Username, data: data})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(opts)
+}
+
+// registerPasskey verifies a new passkey. Attestation statements are only
+// checked if the authenticator sends one, as we ask for none: any
+// authenticator is accepted.
+func registerPasskey(wa *webauthn.WebAuthn, u *passkeyUser, reg *PasskeyRegistration) (*access.Passkey, error) {
+	parsed, err := reg.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPasskey, err)
+	}
+	st, ok := takeChallenge(parsed.Response.CollectedClientData.Challenge)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown or expired challenge", ErrBadPasskey)
+	}
+	if st.user != u.Username {
+		return nil, fmt.Errorf("%w: challenge was for %q", ErrBadPasskey, st.user)
+	}
+	if len(u.passkeys) == 0 {
+		u.handle = st.data.UserID // the new handle given to the authenticator
+	}
+	cred, err := wa.CreateCredential(u, *st.data, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadPasskey, err)
+	}
+	name := strings.TrimSpace(reg.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	return &access.Passkey{
+		ID:         cred.ID,
+		UserHandle: u.handle,
+		PublicKey:  cred.PublicKey,
+		SignCount:  cred.Authenticator.SignCount,
+		Name:       name,
+		Created:    time.Now(),
+	}, nil
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+// testAuthenticator is a software passkey.
+type testAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	user      []byte
+	signCount uint32
+}
+
+func (a *testAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attested {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+	ad := append(rpIDHash[:], byte(flags))
+	ad = binary.BigEndian.AppendUint32(ad, a.signCount)
+	if attested {
+		ad = append(ad, make([]byte, 16)...) // AAGUID
+		ad = binary.BigEndian.AppendUint16(ad, uint16(len(a.id)))
+		ad = append(ad, a.id...)
+		ad = append(ad, mustCBOR(map[int]any{
+			1:  2,  // EC2
+			3:  -7, // ES256
+			-1: 1,  // P-256
+			-2: a.key.X.FillBytes(make([]byte, 32)),
+			-3: a.key.Y.FillBytes(make([]byte, 32)),
+		})...)
+	}
+	return ad
+}
+
+func mustCBOR(v any) []byte {
+	b, err := webauthncbor.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func clientDataJSON(typ protocol.CeremonyType, challenge protocol.URLEncodedBase64, origin string) []byte {
+	cd, _ := json.Marshal(&protocol.CollectedClientData{
+		Type:      typ,
+		Challenge: challenge.String(),
+		Origin:    origin,
+	})
+	return cd
+}
+
+func (a *testAuthenticator) credential() protocol.PublicKeyCredential {
+	return protocol.PublicKeyCredential{
+		Credential: protocol.Credential{ID: base64.RawURLEncoding.EncodeToString(a.id), Type: "public-key"},
+		RawID:      a.id,
+	}
+}
+
+func (a *testAuthenticator) create(opts *protocol.CredentialCreation, origin string) *PasskeyRegistration {
+	a.user, _ = base64.RawURLEncoding.DecodeString(opts.Response.User.ID.(string))
+	return &PasskeyRegistration{
+		Name: "Test key",
+		CredentialCreationResponse: protocol.CredentialCreationResponse{
+			PublicKeyCredential: a.credential(),
+			AttestationResponse: protocol.AuthenticatorAttestationResponse{
+				AuthenticatorResponse: protocol.AuthenticatorResponse{
+					ClientDataJSON: clientDataJSON(protocol.CreateCeremony, opts.Response.Challenge, origin),
+				},
+				AttestationObject: mustCBOR(map[string]any{
+					"fmt":      "none",
+					"attStmt":  map[string]any{},
+					"authData": a.authData(opts.Response.RelyingParty.ID, true),
+				}),
+			},
+		},
+	}
+}
+
+func (a *testAuthenticator) get(opts *protocol.CredentialAssertion, origin string) *protocol.CredentialAssertionResponse {
+	a.signCount++
+	ar := protocol.AuthenticatorAssertionResponse{
+		AuthenticatorResponse: protocol.AuthenticatorResponse{
+			ClientDataJSON: clientDataJSON(protocol.AssertCeremony, opts.Response.Challenge, origin),
+		},
+		AuthenticatorData: a.authData(opts.Response.RelyingPartyID, false),
+		UserHandle:        a.user,
+	}
+	cdHash := sha256.Sum256(ar.ClientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), ar.AuthenticatorData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	ar.Signature = sig
+	return &protocol.CredentialAssertionResponse{
+		PublicKeyCredential: a.credential(),
+		AssertionResponse:   ar,
+	}
+}
+
+func TestPasskeys(t *testing.T) {
+	fs := &store.FileStore{PasskeyPath: t.TempDir() + "/passkeys.json"}
+	us := &passkeyUserStore{FileStore: fs, users: access.Users{"alice": {Nickname: "Alice"}}}
+	h := &PasswordAuthHandler{
+		Handler:      http.NotFoundHandler(),
+		UserStore:    us,
+		SessionStore: &store.SessionStoreCache{},
+		RPID:         "unlockr.example.com",
+	}
+	alice, _ := us.User(context.Background(), "alice")
+	const origin = "https://unlockr.example.com"
+
+	do := func(method, path string, body any, u *access.User) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		r := httptest.NewRequest(method, "https://unlockr.example.com"+path, bytes.NewReader(b))
+		if u != nil {
+			r = r.WithContext(u.NewContext(r.Context()))
+		}
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(path, "/api/user/") {
+			h.ServePasskeys(w, r)
+		} else {
+			h.ServeHTTP(w, r)
+		}
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("decoding %d %q: %v", w.Code, w.Body.String(), err)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authr := &testAuthenticator{key: key, id: []byte("credential-1")}
+
+	// Passkeys need an RPID:
+	h.RPID = ""
+	if w := do("POST", "/api/user/passkeys", nil, alice); w.Code != http.StatusNotImplemented {
+		t.Errorf("no RPID: got %d %q", w.Code, w.Body.String())
+	}
+	h.RPID = "unlockr.example.com"
+
+	// Register:
+	var copts protocol.CredentialCreation
+	decode(do("POST", "/api/user/passkeys", nil, alice), &copts)
+	if copts.Response.RelyingParty.ID != "unlockr.example.com" || copts.Response.User.DisplayName != "Alice" {
+		t.Errorf("unexpected creation options: %+v", copts)
+	}
+	reg := authr.create(&copts, "https://evil.example.net")
+	if w := do("POST", "/api/user/passkeys", reg, alice); w.Code != http.StatusBadRequest {
+		t.Errorf("register from wrong origin: got %d %q", w.Code, w.Body.String())
+	}
+	decode(do("POST", "/api/user/passkeys", nil, alice), &copts)
+	reg = authr.create(&copts, origin)
+	if w := do("POST", "/api/user/passkeys", reg, alice); w.Code != http.StatusCreated {
+		t.Fatalf("register: got %d %q", w.Code, w.Body.String())
+	}
+	// The user handle is random, and kept for the user's other passkeys:
+	if len(authr.user) != passkeyUserHandleLen || bytes.Contains(authr.user, []byte("alice")) {
+		t.Errorf("user handle: got %q", authr.user)
+	}
+	decode(do("POST", "/api/user/passkeys", nil, alice), &copts)
+	if id := copts.Response.User.ID.(string); id != base64.RawURLEncoding.EncodeToString(authr.user) {
+		t.Errorf("second passkey's user handle: got %q, want %x", id, authr.user)
+	}
+	if w := do("POST", "/api/user/passkeys", reg, alice); w.Code != http.StatusBadRequest {
+		t.Errorf("register with reused challenge: got %d %q", w.Code, w.Body.String())
+	}
+	var list []PasskeyInfo
+	decode(do("GET", "/api/user/passkeys", nil, alice), &list)
+	if len(list) != 1 || list[0].Name != "Test key" || !bytes.Equal(list[0].ID, authr.id) {
+		t.Errorf("list: got %+v", list)
+	}
+
+	// Log in:
+	login := func(origin string, modify func(*protocol.CredentialAssertionResponse)) *httptest.ResponseRecorder {
+		var ropts protocol.CredentialAssertion
+		decode(do("GET", PasskeyLoginURL, nil, nil), &ropts)
+		pa := authr.get(&ropts, origin)
+		if modify != nil {
+			modify(pa)
+		}
+		return do("POST", PasskeyLoginURL, pa, nil)
+	}
+	if w := login(origin, nil); w.Code != http.StatusOK || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("login: got %d %q", w.Code, w.Body.String())
+	}
+	for name, modify := range map[string]func(*protocol.CredentialAssertionResponse){
+		"bad signature": func(pa *protocol.CredentialAssertionResponse) {
+			pa.AssertionResponse.Signature[len(pa.AssertionResponse.Signature)-1] ^= 1
+		},
+		"other user": func(pa *protocol.CredentialAssertionResponse) {
+			pa.AssertionResponse.UserHandle = []byte("alice")
+		},
+		"unknown passkey": func(pa *protocol.CredentialAssertionResponse) {
+			pa.RawID = []byte("credential-2")
+			pa.ID = base64.RawURLEncoding.EncodeToString(pa.RawID)
+		},
+		"user not present": func(pa *protocol.CredentialAssertionResponse) {
+			pa.AssertionResponse.AuthenticatorData[32] = 0
+		},
+	} {
+		if w := login(origin, modify); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d %q", name, w.Code, w.Body.String())
+		}
+	}
+	if w := login("http://unlockr.example.com", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("insecure origin: got %d %q", w.Code, w.Body.String())
+	}
+	// A cloned authenticator would reuse sign counts:
+	saved := authr.signCount
+	authr.signCount = 0
+	if w := login(origin, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("old sign count: got %d %q", w.Code, w.Body.String())
+	}
+	authr.signCount = saved
+
+	// Remove:
+	id := base64.RawURLEncoding.EncodeToString(authr.id)
+	if w := do("DELETE", "/api/user/passkeys/"+id, nil, alice); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %q", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/api/user/passkeys/"+id, nil, alice); w.Code != http.StatusNotFound {
+		t.Errorf("delete again: got %d %q", w.Code, w.Body.String())
+	}
+	if w := login(origin, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("login after delete: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// passkeyUserStore has users in memory, and passkeys in a FileStore.
+type passkeyUserStore struct {
+	*store.FileStore
+	users access.Users
+}
+
+func (s *passkeyUserStore) User(ctx context.Context, u access.Username) (*access.User, error) {
+	return (&otpUserStore{users: s.users}).User(ctx, u)
+}
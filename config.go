@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
@@ -10,13 +12,16 @@ import (
 	"os"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
 	"jeremy.visser.name/go/unlockr/auth"
 	"jeremy.visser.name/go/unlockr/auth/guest"
 	"jeremy.visser.name/go/unlockr/debug"
 	"jeremy.visser.name/go/unlockr/device"
 	"jeremy.visser.name/go/unlockr/ewelink"
+	"jeremy.visser.name/go/unlockr/gpio"
 	"jeremy.visser.name/go/unlockr/mqtt"
 	"jeremy.visser.name/go/unlockr/noop"
+	"jeremy.visser.name/go/unlockr/rest"
 	"jeremy.visser.name/go/unlockr/session"
 	"jeremy.visser.name/go/unlockr/store"
 )
@@ -31,16 +36,20 @@ type Config struct {
 		Ewelink map[device.ID]*ewelink.Device `json:"ewelink"`
 		Mqtt    map[device.ID]*mqtt.Device    `json:"mqtt"`
 		Noop    map[device.ID]*noop.Device    `json:"noop"`
+		HTTP    map[device.ID]*rest.Device    `json:"http"`
+		Gpio    map[device.ID]*gpio.Device    `json:"gpio"`
 	} `json:"devices"`
 	Credentials struct {
 		Ewelink *ewelink.Ewelink `json:"ewelink"`
 		Mqtt    *mqtt.Mqtt       `json:"mqtt"`
 	} `json:"credentials"`
 	DataStore struct {
-		File *store.FileStore `json:"file"`
-		DB   *store.DBStore   `json:"db"`
+		File   *store.FileStore   `json:"file"`
+		DB     *store.DBStore     `json:"db"`
+		SQLite *store.SQLiteStore `json:"sqlite"`
+		LDAP   *store.LDAPStore   `json:"ldap"`
 	} `json:"datastore"`
-	Auth  *jsonAuthType `json:"auth"`
+	Auth  jsonAuthTypes `json:"auth"`
 	Guest *guest.Config `json:"guest,omitempty"`
 }
 
@@ -53,6 +62,7 @@ type AuthType string
 const (
 	Password AuthType = "password"
 	OAuth    AuthType = "oauth"
+	Header   AuthType = "header"
 )
 
 func (a *jsonAuthType) UnmarshalJSON(v []byte) error {
@@ -65,6 +75,8 @@ func (a *jsonAuthType) UnmarshalJSON(v []byte) error {
 		a.Handler = new(auth.OAuthHandler)
 	case Password:
 		a.Handler = new(auth.PasswordAuthHandler)
+	case Header:
+		a.Handler = new(auth.HeaderAuthHandler)
 	default:
 		return fmt.Errorf("invalid auth type: %s", v)
 	}
@@ -89,10 +101,67 @@ func (a *jsonAuthType) MarshalJSON() ([]byte, error) {
 			Password,
 			ah,
 		})
+	case *auth.HeaderAuthHandler:
+		return json.Marshal(struct {
+			Type AuthType
+			*auth.HeaderAuthHandler
+		}{
+			Header,
+			ah,
+		})
 	}
 	return json.Marshal(nil)
 }
 
+// jsonAuthTypes is a single auth method, or a list of them, each of a
+// different type.
+type jsonAuthTypes []*jsonAuthType
+
+func (a *jsonAuthTypes) UnmarshalJSON(v []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(v), []byte("[")) {
+		at := new(jsonAuthType)
+		if err := json.Unmarshal(v, at); err != nil {
+			return err
+		}
+		*a = jsonAuthTypes{at}
+		return nil
+	}
+	var list []*jsonAuthType
+	if err := json.Unmarshal(v, &list); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, at := range list {
+		name := auth.MethodName(at.Handler)
+		if seen[name] {
+			return fmt.Errorf("auth type configured more than once: %s", name)
+		}
+		seen[name] = true
+	}
+	*a = list
+	return nil
+}
+
+func (a jsonAuthTypes) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]*jsonAuthType(a))
+}
+
+// Handler returns the auth handler, which is a MultiAuthHandler if several
+// methods are configured.
+func (a jsonAuthTypes) Handler() http.Handler {
+	if len(a) == 1 {
+		return a[0].Handler
+	}
+	m := &auth.MultiAuthHandler{}
+	for _, at := range a {
+		m.Methods = append(m.Methods, at.Handler)
+	}
+	return m
+}
+
 func (c *Config) Load(filename string) error {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -126,6 +195,8 @@ func (c *Config) GetDevices() device.DeviceList {
 	device.AddDevices(dl, c.Devices.Ewelink)
 	device.AddDevices(dl, c.Devices.Mqtt)
 	device.AddDevices(dl, c.Devices.Noop)
+	device.AddDevices(dl, c.Devices.HTTP)
+	device.AddDevices(dl, c.Devices.Gpio)
 	if debug.Debug() {
 		log.Printf("  %#v", dl)
 	}
@@ -136,14 +207,45 @@ func (c *Config) GetDevices() device.DeviceList {
 func (c *Config) GetDataStores() (access.UserStore, session.SessionStore, error) {
 	switch {
 	case c.DataStore.File != nil:
-		return &store.UserStoreCache{UserStore: c.DataStore.File},
-			&store.SessionStoreCache{SessionStore: nil}, // memory-only
-			nil
+		ss := &store.SessionStoreCache{SessionStore: nil} // memory-only
+		if c.DataStore.File.SessionPath != "" {
+			ss.SessionStore = c.DataStore.File
+		}
+		return &store.UserStoreCache{UserStore: c.DataStore.File}, ss, nil
 	case c.DataStore.DB != nil:
 		return &store.UserStoreCache{UserStore: c.DataStore.DB},
 			&store.SessionStoreCache{SessionStore: c.DataStore.DB},
 			nil
+	case c.DataStore.SQLite != nil:
+		if err := c.DataStore.SQLite.Open(context.Background()); err != nil {
+			return nil, nil, err
+		}
+		return &store.UserStoreCache{UserStore: c.DataStore.SQLite},
+			&store.SessionStoreCache{SessionStore: c.DataStore.SQLite},
+			nil
+	case c.DataStore.LDAP != nil:
+		return &store.UserStoreCache{UserStore: c.DataStore.LDAP},
+			&store.SessionStoreCache{SessionStore: nil}, // memory-only
+			nil
 	default:
 		return nil, nil, errors.New("no datastore configured")
 	}
 }
+
+// GetAuditStore returns the audit log of the first datastore configured,
+// or nil if it has none.
+func (c *Config) GetAuditStore() audit.AuditStore {
+	switch {
+	case c.DataStore.File != nil:
+		if c.DataStore.File.AuditPath != "" {
+			return c.DataStore.File
+		}
+	case c.DataStore.DB != nil:
+		if q := c.DataStore.DB.Queries; q != nil && q.AuditSave != "" {
+			return c.DataStore.DB
+		}
+	case c.DataStore.SQLite != nil:
+		return c.DataStore.SQLite
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ServeAudit returns audit records as JSON, newest first.
+// Admins see every record; other users only see records for devices they are
+// allowed to access. Guests see nothing. Requests limited to some devices,
+// such as with an API token, only see those devices' records.
+//
+// Optional query parameters: device, user, before (RFC 3339), limit.
+func (d DeviceList) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u, ok := access.FromContext(ctx)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, isGuest := access.ParentFromContext(ctx); isGuest {
+		http.Error(w, "Guests may not view the audit log", http.StatusForbidden)
+		return
+	}
+	as, ok := audit.FromContext(ctx)
+	if !ok {
+		http.Error(w, "Audit log not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Must use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	before := time.Now()
+	if v := q.Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "before must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		before = t
+	}
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	wantDevice, wantUser := q.Get("device"), access.Username(q.Get("user"))
+	_, scoped := ScopeFromContext(ctx)
+	d = d.InScope(ctx)
+
+	records, err := as.Records(ctx, before, limit, func(rec *audit.Record) bool {
+		if wantDevice != "" && rec.Device != wantDevice {
+			return false
+		}
+		if wantUser != "" && rec.User != wantUser && rec.Parent != wantUser {
+			return false
+		}
+		if _, ok := d[ID(rec.Device)]; scoped && !ok {
+			return false
+		}
+		return u.IsAdmin() || d.userCan(ID(rec.Device), u, access.ActionView)
+	})
+	if err != nil {
+		log.Print("audit: retrieving records failed: ", err)
+		http.Error(w, "Error retrieving audit log", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = make([]audit.Record, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,111 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
+)
+
+type memAudit struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+func (m *memAudit) SaveRecord(ctx context.Context, r *audit.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, *r)
+	return nil
+}
+
+func (m *memAudit) Records(ctx context.Context, before time.Time, limit int, match func(*audit.Record) bool) ([]audit.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []audit.Record
+	for _, r := range m.records {
+		if r.Time.Before(before) && (match == nil || match(&r)) {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func TestAudit(t *testing.T) {
+	dl := DeviceList{
+		"public": &powerDevice{Base: Base{Name: "Public"}},
+		"secret": &powerDevice{Base: Base{Name: "Secret", ACL: &access.ACL{
+			Allow:   access.List{Users: []access.Username{"root"}},
+			Default: "deny",
+		}}},
+	}
+	as := new(memAudit)
+	alice := &access.User{Username: "alice"}
+	root := &access.User{Username: "root", Groups: access.Groups{access.AdminGroup}}
+
+	serve := func(h http.Handler, ctx context.Context, method, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		(&audit.Handler{Handler: h, AuditStore: as}).ServeHTTP(w, r)
+		return w
+	}
+
+	guestCtx := access.NewContextParent(alice.NewContext(context.Background()), "alice")
+	serve(dl, root.NewContext(context.Background()), "POST", "/api/device/secret/power/on")
+	serve(dl, alice.NewContext(context.Background()), "POST", "/api/device/secret/power/on")
+	serve(dl, guestCtx, "POST", "/api/device/public/power/off")
+
+	if got, want := len(as.records), 3; got != want {
+		t.Fatalf("records: got %d, want %d", got, want)
+	}
+	if r := as.records[1]; r.User != "alice" || r.Status != http.StatusForbidden || r.Error == "" {
+		t.Errorf("denied record: got %+v", r)
+	}
+	if r := as.records[2]; r.Parent != "alice" || r.Action != "power/off" || r.Status != http.StatusOK {
+		t.Errorf("guest record: got %+v", r)
+	}
+
+	list := func(ctx context.Context, url string) (records []audit.Record) {
+		w := serve(http.HandlerFunc(dl.ServeAudit), ctx, "GET", url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d", url, w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&records); err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	// alice can't access the secret device, so can't see its records:
+	if got := list(alice.NewContext(context.Background()), "/api/audit"); len(got) != 1 || got[0].Device != "public" {
+		t.Errorf("alice: got %+v, want only the public record", got)
+	}
+	if got := list(root.NewContext(context.Background()), "/api/audit"); len(got) != 3 {
+		t.Errorf("root: got %d records, want 3", len(got))
+	}
+	if got := list(root.NewContext(context.Background()), "/api/audit?limit=1&device=secret"); len(got) != 1 || got[0].User != "alice" {
+		t.Errorf("root, filtered: got %+v, want alice's secret record", got)
+	}
+
+	// Even admins only see the devices their request is limited to:
+	scopedCtx := NewContextScope(root.NewContext(context.Background()), []ID{"public"})
+	if got := list(scopedCtx, "/api/audit"); len(got) != 1 || got[0].Device != "public" {
+		t.Errorf("root, scoped: got %+v, want only the public record", got)
+	}
+
+	w := serve(http.HandlerFunc(dl.ServeAudit), guestCtx, "GET", "/api/audit")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("guest: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
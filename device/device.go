@@ -3,19 +3,26 @@ package device
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
 )
 
 type Device interface {
 	GetName() Name
 	GetACL() *access.ACL
+	GetPulse() time.Duration
 }
 
+// PowerControl is implemented by devices which can be switched on and off.
+// Devices with PowerControl can also be pulsed (see Pulse).
 type PowerControl interface {
 	Power(ctx context.Context, on bool) error
 }
@@ -26,6 +33,10 @@ type Name string
 type Base struct {
 	Name `json:"name"`
 	ACL  *access.ACL `json:"acl,omitempty"`
+
+	// Pulse is the default duration for the pulse action.
+	// If set, the web interface pulses the device rather than powering it on.
+	Pulse Duration `json:"pulse,omitempty"`
 }
 
 func (b *Base) GetName() Name {
@@ -39,13 +50,20 @@ func (b *Base) GetACL() *access.ACL {
 	return b.ACL
 }
 
+// GetPulse returns the configured pulse duration, or zero if unset.
+func (b *Base) GetPulse() time.Duration {
+	return time.Duration(b.Pulse)
+}
+
 type DeviceList map[ID]Device
 
 type DeviceListResponse map[ID]DeviceResponse
 
 // DeviceResponse is a subset of Base that is relevant to the user.
 type DeviceResponse struct {
-	Name `json:"name"`
+	Name  `json:"name"`
+	Pulse Duration     `json:"pulse,omitempty"`
+	State *DeviceState `json:"state,omitempty"`
 }
 
 // AddDevices appends a map of T type devices to a generic DeviceList.
@@ -65,6 +83,7 @@ func (d DeviceList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("prefix /api/device/ not found: misconfigured handler")
 	}
 	id, args, _ := strings.Cut(path, "/")
+	d = d.InScope(r.Context())
 	if id != "" {
 		d.ServeDevice(r.Context(), w, r, ID(id), args)
 		return
@@ -76,14 +95,26 @@ func (d DeviceList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (d DeviceList) ForUser(u *access.User) (ud DeviceListResponse) {
 	ud = make(DeviceListResponse)
 	for id := range d {
-		if err := d[id].GetACL().UserCanAccess(u); err != nil {
+		if err := d[id].GetACL().UserCan(u, access.ActionView); err != nil {
 			continue
 		}
-		ud[id] = DeviceResponse{Name: d[id].GetName()}
+		ud[id] = DeviceResponse{
+			Name:  d[id].GetName(),
+			Pulse: Duration(d[id].GetPulse()),
+		}
 	}
 	return ud
 }
 
+// userCan reports whether u may perform action on the device with id.
+func (d DeviceList) userCan(id ID, u *access.User, action access.Action) bool {
+	dev, ok := d[id]
+	if !ok {
+		return false
+	}
+	return dev.GetACL().UserCan(u, action) == nil
+}
+
 func (d DeviceList) ServeList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	u, ok := access.FromContext(ctx)
 	if !ok {
@@ -91,6 +122,7 @@ func (d DeviceList) ServeList(ctx context.Context, w http.ResponseWriter, r *htt
 		return
 	}
 	l := d.ForUser(u)
+	d.withState(ctx, l, u)
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(l)
 	if err != nil {
@@ -100,6 +132,15 @@ func (d DeviceList) ServeList(ctx context.Context, w http.ResponseWriter, r *htt
 }
 
 func (d DeviceList) ServeDevice(ctx context.Context, w http.ResponseWriter, r *http.Request, id ID, args string) {
+	// Every invocation is recorded, including failures:
+	rec := audit.NewRecord(ctx, r, string(id), args)
+	sw := &audit.StatusWriter{ResponseWriter: w}
+	w = sw
+	defer func() {
+		rec.Status = sw.Status
+		audit.Save(ctx, rec)
+	}()
+
 	dev, ok := d[id]
 	if !ok {
 		http.NotFound(w, r)
@@ -110,11 +151,28 @@ func (d DeviceList) ServeDevice(ctx context.Context, w http.ResponseWriter, r *h
 		http.NotFound(w, r)
 		return
 	}
-	if err := dev.GetACL().UserCanAccess(u); err != nil {
+	if err := dev.GetACL().UserCan(u, access.ActionView); err != nil {
 		log.Printf("Device[%s]: user[%s] not allowed by ACL", dev.GetName(), u.Username)
+		rec.Error = err.Error()
 		http.Error(w, "Not allowed to access device", http.StatusForbidden)
 		return
 	}
+	// allowed checks the specific action, and writes an error if not allowed:
+	allowed := func(action access.Action) bool {
+		if !actionInScope(ctx, action) {
+			log.Printf("Device[%s]: user[%s] not allowed to %s by scope", dev.GetName(), u.Username, action)
+			rec.Error = "action not in scope"
+			http.Error(w, "Not allowed to "+string(action)+" device", http.StatusForbidden)
+			return false
+		}
+		if err := dev.GetACL().UserCan(u, action); err != nil {
+			log.Printf("Device[%s]: user[%s] not allowed to %s by ACL", dev.GetName(), u.Username, action)
+			rec.Error = err.Error()
+			http.Error(w, "Not allowed to "+string(action)+" device", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
 	action, sub, _ := strings.Cut(args, "/")
 	switch action {
 	case "power":
@@ -135,13 +193,85 @@ func (d DeviceList) ServeDevice(ctx context.Context, w http.ResponseWriter, r *h
 			http.Error(w, "must be 'power/on' or 'power/off'", http.StatusBadRequest)
 			return
 		}
-		if err := dev.(PowerControl).Power(r.Context(), on); err != nil {
+		if !allowed(access.Action(action + "/" + sub)) {
+			return
+		}
+		err := dev.(PowerControl).Power(r.Context(), on)
+		publishAction(ctx, id, action+"/"+sub, err)
+		if err != nil {
+			rec.Error = err.Error()
 			log.Print("power: error from device: ", err)
 			http.Error(w, "Error controlling device", http.StatusInternalServerError)
 			return
 		}
 		io.WriteString(w, "ok")
 		return
+	case "pulse":
+		pc, ok := dev.(PowerControl)
+		if !ok {
+			log.Printf("Device[%s] doesn't have PowerControl", id)
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Must use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowed(access.ActionPulse) {
+			return
+		}
+		d := dev.GetPulse()
+		if d <= 0 {
+			d = DefaultPulse
+		}
+		if q := r.URL.Query().Get("duration"); q != "" {
+			var err error
+			d, err = time.ParseDuration(q)
+			if err != nil || d <= 0 || d > MaxPulse {
+				http.Error(w, fmt.Sprintf("duration must be between 0s and %s", MaxPulse), http.StatusBadRequest)
+				return
+			}
+		}
+		err := Pulse(r.Context(), pc, d)
+		publishAction(ctx, id, action, err)
+		if err != nil {
+			rec.Error = err.Error()
+			log.Print("pulse: error from device: ", err)
+			http.Error(w, "Error controlling device", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "ok")
+		return
+	case "state":
+		sr, ok := dev.(StateReader)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Must use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if !allowed(access.ActionState) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+		defer cancel()
+		st, err := sr.State(ctx)
+		if errors.Is(err, ErrStateUnknown) {
+			http.Error(w, "Device state unknown", http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			rec.Error = err.Error()
+			log.Print("state: error from device: ", err)
+			http.Error(w, "Error reading device state", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&st); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
 	}
 	http.NotFound(w, r)
 }
@@ -1,8 +1,15 @@
 package device
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
 )
@@ -67,3 +74,178 @@ func TestForUser(t *testing.T) {
 		t.Errorf("bob:\n\tgot: %+v\n\twant: %+v", got, want)
 	}
 }
+
+type powerDevice struct {
+	Base
+
+	mu      sync.Mutex
+	history []bool
+	err     error // returned by Power, after recording it
+}
+
+func (p *powerDevice) Power(ctx context.Context, on bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.history = append(p.history, on)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.err
+}
+
+func (p *powerDevice) getHistory() []bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]bool(nil), p.history...)
+}
+
+// Tests that the off step happens even though the request context is cancelled.
+func TestPulse(t *testing.T) {
+	dev := &powerDevice{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // simulate client disconnect
+	if err := Pulse(ctx, dev, 10*time.Millisecond); err != nil {
+		t.Fatalf("Pulse: %v", err)
+	}
+
+	if got, want := dev.getHistory(), []bool{true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("before off: got %v, want %v", got, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, want := dev.getHistory(), []bool{true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after off: got %v, want %v", got, want)
+	}
+}
+
+// Tests that the off step happens even if the on step reports an error,
+// e.g. because the device's response was lost.
+func TestPulseOnError(t *testing.T) {
+	dev := &powerDevice{err: errors.New("timeout")}
+	if err := Pulse(context.Background(), dev, 10*time.Millisecond); err == nil {
+		t.Errorf("Pulse: got no error")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, want := dev.getHistory(), []bool{true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after off: got %v, want %v", got, want)
+	}
+}
+
+// Tests that overlapping pulses result in a single off step.
+func TestPulseOverlap(t *testing.T) {
+	dev := &powerDevice{}
+	Pulse(context.Background(), dev, 20*time.Millisecond)
+	Pulse(context.Background(), dev, 40*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if got, want := dev.getHistory(), []bool{true, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first pulse should be superseded: got %v, want %v", got, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, want := dev.getHistory(), []bool{true, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after off: got %v, want %v", got, want)
+	}
+}
+
+func TestServePulse(t *testing.T) {
+	dev := &powerDevice{Base: Base{Name: "Strike", Pulse: Duration(10 * time.Millisecond)}}
+	dl := DeviceList{"strike": dev}
+	ctx := (&access.User{Username: "alice"}).NewContext(context.Background())
+
+	for _, tc := range []struct {
+		method, url string
+		want        int
+	}{
+		{"GET", "/api/device/strike/pulse", http.StatusMethodNotAllowed},
+		{"POST", "/api/device/strike/pulse?duration=forever", http.StatusBadRequest},
+		{"POST", "/api/device/strike/pulse?duration=1h", http.StatusBadRequest},
+		{"POST", "/api/device/strike/pulse?duration=10ms", http.StatusOK},
+		{"POST", "/api/device/strike/pulse", http.StatusOK},
+		{"POST", "/api/device/missing/pulse", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		dl.ServeHTTP(w, r)
+		if got := w.Result().StatusCode; got != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.url, got, tc.want)
+		}
+	}
+}
+
+type stateDevice struct {
+	Base
+	st  DeviceState
+	err error
+}
+
+func (s *stateDevice) State(ctx context.Context) (DeviceState, error) {
+	return s.st, s.err
+}
+
+func TestServeState(t *testing.T) {
+	dl := DeviceList{
+		"open":    &stateDevice{Base: Base{Name: "Open"}, st: DeviceState{On: true}},
+		"unknown": &stateDevice{Base: Base{Name: "Unknown"}, err: ErrStateUnknown},
+		"plain":   &Base{Name: "Plain"},
+	}
+	ctx := (&access.User{Username: "alice"}).NewContext(context.Background())
+
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{"/api/device/open/state", http.StatusOK},
+		{"/api/device/unknown/state", http.StatusServiceUnavailable},
+		{"/api/device/plain/state", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", tc.url, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		dl.ServeHTTP(w, r)
+		if got := w.Result().StatusCode; got != tc.want {
+			t.Errorf("GET %s: got %d, want %d", tc.url, got, tc.want)
+		}
+	}
+
+	// The device list includes states where known:
+	r := httptest.NewRequest("GET", "/api/device/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	dl.ServeHTTP(w, r)
+	var got DeviceListResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if st := got["open"].State; st == nil || !st.On {
+		t.Errorf("open: got state %+v, want on", st)
+	}
+	if st := got["unknown"].State; st != nil {
+		t.Errorf("unknown: got state %+v, want nil", st)
+	}
+}
+
+func TestServeActionACL(t *testing.T) {
+	dl := DeviceList{
+		"roller-door": &powerDevice{Base: Base{
+			Name: "Roller Door",
+			ACL: &access.ACL{
+				Actions: map[access.Action]*access.ACL{
+					access.ActionPowerOn: {Deny: access.List{Users: []access.Username{"viewer"}}},
+				},
+			},
+		}},
+	}
+	ctx := (&access.User{Username: "viewer"}).NewContext(context.Background())
+
+	for _, tc := range []struct {
+		method, url string
+		want        int
+	}{
+		{"GET", "/api/device/", http.StatusOK},
+		{"POST", "/api/device/roller-door/power/on", http.StatusForbidden},
+		{"POST", "/api/device/roller-door/power/off", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		dl.ServeHTTP(w, r)
+		if got := w.Result().StatusCode; got != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// Duration is a time.Duration which may be configured in JSON either as a
+// string (e.g. "3s") or as an integer number of nanoseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(v []byte) error {
+	var s string
+	err := json.Unmarshal(v, &s)
+	if err != nil {
+		var errU *json.UnmarshalTypeError
+		if errors.As(err, &errU) {
+			if errU.Type.Kind() == reflect.String {
+				// String failed, try again as time.Duration:
+				var di time.Duration
+				if err := json.Unmarshal(v, &di); err == nil {
+					*d = Duration(di)
+					return nil
+				}
+				// Return original error if second try failed.
+			}
+		}
+		return err
+	}
+
+	pd, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(pd)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,274 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+const (
+	// eventBufLen is how many events may be queued for a slow listener
+	// before further events are discarded.
+	eventBufLen = 16
+
+	// DefaultPollInterval is how often device states are checked for changes
+	// while anybody is listening for events.
+	DefaultPollInterval = 10 * time.Second
+)
+
+// eventKeepAlive is how often a comment is sent to idle event streams, so
+// that proxies don't close them, and the user is checked again. It is
+// replaced by tests.
+var eventKeepAlive = 15 * time.Second
+
+type EventType string
+
+const (
+	EventState  EventType = "state"  // device state changed
+	EventAction EventType = "action" // user performed an action on a device
+	EventGuest  EventType = "guest"  // guest performed an action on a device
+)
+
+type Event struct {
+	Type   EventType       `json:"type"`
+	Device ID              `json:"device"`
+	Time   time.Time       `json:"time"`
+	User   access.Username `json:"user,omitempty"`
+	// Parent is the user who invited the guest, for EventGuest.
+	Parent access.Username `json:"parent,omitempty"`
+	Action string          `json:"action,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	State  *DeviceState    `json:"state,omitempty"`
+}
+
+// Events distributes events to listeners. The zero value is ready to use.
+type Events struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// DefaultEvents receives events from all devices.
+var DefaultEvents Events
+
+// Publish sends ev to every listener. It never blocks: if a listener's
+// buffer is full, the event is discarded for that listener.
+func (e *Events) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for c := range e.subs {
+		select {
+		case c <- ev:
+		default:
+			log.Printf("Events: discarded %s event for slow listener", ev.Type)
+		}
+	}
+}
+
+// Subscribe returns a channel of events. Call cancel when finished,
+// after which the channel is closed.
+func (e *Events) Subscribe() (events <-chan Event, cancel func()) {
+	c := make(chan Event, eventBufLen)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs == nil {
+		e.subs = make(map[chan Event]struct{})
+	}
+	e.subs[c] = struct{}{}
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			delete(e.subs, c)
+			close(c)
+		})
+	}
+}
+
+// Listeners returns the number of current listeners.
+func (e *Events) Listeners() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.subs)
+}
+
+// publishAction records the result of an action performed by the user in ctx.
+func publishAction(ctx context.Context, id ID, action string, err error) {
+	ev := Event{
+		Type:   EventAction,
+		Device: id,
+		Action: action,
+	}
+	if u, ok := access.FromContext(ctx); ok {
+		ev.User = u.Username
+	}
+	if parent, ok := access.ParentFromContext(ctx); ok {
+		ev.Type = EventGuest
+		ev.Parent = parent
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	DefaultEvents.Publish(ev)
+}
+
+// ServeEvents streams events as Server-Sent Events, filtered to the devices
+// the user is allowed to access.
+//
+// The stream ends when the session expires. The user is also checked again
+// on every keepalive, so that it ends soon after the session is deleted, the
+// user is disabled, or they can no longer view any device.
+func (d DeviceList) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	u, ok := access.FromContext(r.Context())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Must use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's WriteTimeout:
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Events: can't disable write deadline: %v", err)
+	}
+
+	d = d.InScope(r.Context())
+	events, cancel := DefaultEvents.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Events: streaming not supported: %v", err)
+		return
+	}
+
+	var expired <-chan time.Time
+	if s, ok := session.FromContext(r.Context()); ok {
+		t := time.NewTimer(time.Until(s.Expiry))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired:
+			return
+		case <-keepAlive.C:
+			if u = d.recheck(r.Context(), u); u == nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev := <-events:
+			action := access.ActionView
+			if ev.Type == EventState {
+				action = access.ActionState
+			}
+			if !d.userCan(ev.Device, u, action) {
+				continue
+			}
+			data, err := json.Marshal(&ev)
+			if err != nil {
+				log.Printf("Events: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// recheck returns the user of an event stream as they are now, or nil if
+// they are no longer valid, or can't view any of the devices.
+func (d DeviceList) recheck(ctx context.Context, u *access.User) *access.User {
+	if rc, ok := access.RecheckFromContext(ctx); ok {
+		current, err := rc(ctx)
+		if err != nil {
+			log.Printf("Events: user[%s] no longer valid: %v", u.Username, err)
+			return nil
+		}
+		u = current
+	}
+	t := time.Now()
+	for _, dev := range d {
+		if dev.GetACL().UserCanAt(u, access.ActionView, t) == nil {
+			return u
+		}
+	}
+	log.Printf("Events: user[%s] can no longer view any device", u.Username)
+	return nil
+}
+
+// PollStates checks the state of each StateReader device every interval,
+// and publishes an event when it changes. Devices are only polled while
+// anybody is listening. StatePusher devices publish their own events
+// instead, and are not polled. PollStates returns when ctx is cancelled.
+func (d DeviceList) PollStates(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	polled := make(DeviceList)
+	for id, dev := range d {
+		if sp, ok := dev.(StatePusher); ok {
+			go sp.PushStates(ctx, id, &DefaultEvents)
+		} else {
+			polled[id] = dev
+		}
+	}
+	d = polled
+	last := make(map[ID]bool)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if DefaultEvents.Listeners() == 0 {
+			last = make(map[ID]bool) // states may change unobserved
+			continue
+		}
+		l := make(DeviceListResponse)
+		for id := range d {
+			l[id] = DeviceResponse{}
+		}
+		d.withState(ctx, l, nil)
+		for id, dr := range l {
+			if dr.State == nil {
+				continue
+			}
+			if on, ok := last[id]; ok && on == dr.State.On {
+				continue
+			}
+			last[id] = dr.State.On
+			DefaultEvents.Publish(Event{
+				Type:   EventState,
+				Device: id,
+				State:  dr.State,
+			})
+		}
+	}
+}
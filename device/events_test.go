@@ -0,0 +1,122 @@
+package device
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+// Tests that events are only streamed for devices the user can access.
+func TestServeEvents(t *testing.T) {
+	dl := DeviceList{
+		"public": &Base{Name: "Public"},
+		"secret": &Base{Name: "Secret", ACL: &access.ACL{Default: "deny"}},
+	}
+	u := &access.User{Username: "alice"}
+	ctx, cancel := context.WithCancel(u.NewContext(context.Background()))
+
+	r := httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dl.ServeEvents(w, r)
+	}()
+
+	for DefaultEvents.Listeners() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	DefaultEvents.Publish(Event{Type: EventAction, Device: "secret", Action: "power/on"})
+	DefaultEvents.Publish(Event{Type: EventAction, Device: "public", Action: "pulse"})
+	DefaultEvents.Publish(Event{Type: EventState, Device: "public", State: &DeviceState{On: true}})
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	if got, want := w.Result().Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Content-Type: got %s, want %s", got, want)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, `"secret"`) {
+		t.Errorf("event for inaccessible device was streamed:\n%s", body)
+	}
+	if !strings.Contains(body, "event: action\ndata: ") || !strings.Contains(body, `"action":"pulse"`) {
+		t.Errorf("action event missing:\n%s", body)
+	}
+	if !strings.Contains(body, "event: state\ndata: ") || !strings.Contains(body, `"on":true`) {
+		t.Errorf("state event missing:\n%s", body)
+	}
+	if n := DefaultEvents.Listeners(); n != 0 {
+		t.Errorf("Listeners after disconnect: got %d, want 0", n)
+	}
+}
+
+// Tests that actions by guests are published with the inviting user.
+func TestPublishGuestAction(t *testing.T) {
+	events, cancel := DefaultEvents.Subscribe()
+	defer cancel()
+
+	ctx := (&access.User{Username: "guest"}).NewContext(context.Background())
+	ctx = access.NewContextParent(ctx, "alice")
+	publishAction(ctx, "gate", "pulse", nil)
+
+	ev := <-events
+	if ev.Type != EventGuest || ev.User != "guest" || ev.Parent != "alice" || ev.Device != "gate" {
+		t.Errorf("got %+v, want guest event from alice's guest", ev)
+	}
+}
+
+// Tests that event streams end when the session expires, or when the user
+// is no longer valid or allowed to view any device.
+func TestServeEventsEnds(t *testing.T) {
+	orig := eventKeepAlive
+	eventKeepAlive = 5 * time.Millisecond
+	t.Cleanup(func() { eventKeepAlive = orig })
+
+	dl := DeviceList{"gate": &Base{Name: "Gate", ACL: &access.ACL{
+		Deny:    access.List{Users: []access.Username{"mallory"}},
+		Default: "allow",
+	}}}
+	u := &access.User{Username: "alice"}
+	serve := func(ctx context.Context) bool {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		r := httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx)
+		dl.ServeEvents(httptest.NewRecorder(), r)
+		return ctx.Err() == nil // ended by ServeEvents, not the timeout
+	}
+
+	ctx := u.NewContext(context.Background())
+	s := &session.Session{Username: "alice", Expiry: time.Now().Add(20 * time.Millisecond)}
+	if !serve(s.NewContext(ctx)) {
+		t.Errorf("stream continued after session expired")
+	}
+
+	revoked := access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+		return nil, session.ErrSessionExpired
+	})
+	if !serve(revoked) {
+		t.Errorf("stream continued after session was no longer valid")
+	}
+
+	denied := access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+		return &access.User{Username: "mallory"}, nil
+	})
+	if !serve(denied) {
+		t.Errorf("stream continued after user could no longer view any device")
+	}
+
+	valid := access.NewContextRecheck(ctx, func(ctx context.Context) (*access.User, error) {
+		return u, nil
+	})
+	ctx, cancel := context.WithTimeout(valid, 50*time.Millisecond)
+	defer cancel()
+	if serve(ctx) {
+		t.Errorf("stream ended while user was still valid")
+	}
+}
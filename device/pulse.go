@@ -0,0 +1,77 @@
+package device
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPulse is used if the device has no pulse duration configured.
+	DefaultPulse = 3 * time.Second
+	// MaxPulse is the longest duration a user may request.
+	MaxPulse = 1 * time.Minute
+
+	// pulseTimeout bounds each step, as neither is cancelled by the request.
+	pulseTimeout = 30 * time.Second
+)
+
+// pulses tracks the pending off step for each device, so that overlapping
+// pulses extend the on period rather than cutting it short.
+var pulses struct {
+	mu sync.Mutex
+	m  map[PowerControl]*time.Timer
+}
+
+// detached keeps the values of a context, but not its cancellation, like
+// context.WithoutCancel in Go 1.21.
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// Pulse turns pc on, and schedules it to be turned off after d.
+//
+// Neither step is cancelled if the client disconnects. The off step is
+// scheduled even if the on step fails, as the device may have switched on
+// even though its response was lost.
+func Pulse(ctx context.Context, pc PowerControl, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(detached{ctx}, pulseTimeout)
+	defer cancel()
+	err := pc.Power(ctx, true)
+	ScheduleOff(pc, d)
+	return err
+}
+
+// ScheduleOff turns pc off after d, superseding any off step already pending.
+// Devices which switch themselves off after a delay may use it, so that a
+// later Pulse replaces their off step rather than adding a second one.
+func ScheduleOff(pc PowerControl, d time.Duration) {
+	pulses.mu.Lock()
+	defer pulses.mu.Unlock()
+	if pulses.m == nil {
+		pulses.m = make(map[PowerControl]*time.Timer)
+	}
+	if t, ok := pulses.m[pc]; ok {
+		t.Stop() // superseded by this pulse
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		pulses.mu.Lock()
+		if pulses.m[pc] != t {
+			pulses.mu.Unlock()
+			return // superseded by a later pulse
+		}
+		delete(pulses.m, pc)
+		pulses.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), pulseTimeout)
+		defer cancel()
+		if err := pc.Power(ctx, false); err != nil {
+			log.Printf("pulse: error turning off device after %s: %v", d, err)
+		}
+	})
+	pulses.m[pc] = t
+}
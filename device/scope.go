@@ -0,0 +1,68 @@
+package device
+
+import (
+	"context"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+type scopeKey int
+
+var ctxScopeKey scopeKey
+
+// NewContextScope returns a copy of ctx which limits the devices available
+// to the request to ids, such as for a guest invited to specific devices.
+func NewContextScope(ctx context.Context, ids []ID) context.Context {
+	return context.WithValue(ctx, ctxScopeKey, ids)
+}
+
+func ScopeFromContext(ctx context.Context) (ids []ID, ok bool) {
+	ids, ok = ctx.Value(ctxScopeKey).([]ID)
+	return
+}
+
+// InScope returns the subset of d that is in the scope of ctx.
+// If ctx has no scope, d is returned unchanged.
+func (d DeviceList) InScope(ctx context.Context) DeviceList {
+	ids, ok := ScopeFromContext(ctx)
+	if !ok {
+		return d
+	}
+	sd := make(DeviceList)
+	for _, id := range ids {
+		if dev, ok := d[id]; ok {
+			sd[id] = dev
+		}
+	}
+	return sd
+}
+
+type actionsKey int
+
+var ctxActionsKey actionsKey
+
+// NewContextActions returns a copy of ctx which limits the device actions
+// available to the request, such as for an API token which may only pulse.
+func NewContextActions(ctx context.Context, actions []access.Action) context.Context {
+	return context.WithValue(ctx, ctxActionsKey, actions)
+}
+
+func ActionsFromContext(ctx context.Context) (actions []access.Action, ok bool) {
+	actions, ok = ctx.Value(ctxActionsKey).([]access.Action)
+	return
+}
+
+// actionInScope reports whether ctx allows action. Viewing is always
+// allowed, as is every action if ctx has no action scope.
+func actionInScope(ctx context.Context, action access.Action) bool {
+	actions, ok := ActionsFromContext(ctx)
+	if !ok || action == access.ActionView {
+		return true
+	}
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
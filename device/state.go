@@ -0,0 +1,81 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+// stateTimeout bounds how long a device list waits for device states.
+const stateTimeout = 5 * time.Second
+
+var ErrStateUnknown = errors.New("device state unknown")
+
+// StateReader is implemented by devices which can report their current state.
+type StateReader interface {
+	State(ctx context.Context) (DeviceState, error)
+}
+
+// StatePusher is implemented by devices which are notified of their state
+// changes, and so needn't be polled.
+type StatePusher interface {
+	// PushStates publishes an EventState for the device, identified by id,
+	// to events whenever its state changes, until ctx is cancelled.
+	PushStates(ctx context.Context, id ID, events *Events)
+}
+
+type DeviceState struct {
+	// On is true if the device is powered on (or the door is open).
+	On bool `json:"on"`
+
+	// Updated is when the state was observed. For cached states
+	// (e.g. retained MQTT messages), this may be in the past.
+	Updated time.Time `json:"updated"`
+}
+
+// withState fetches the state of each device in l concurrently.
+// Devices whose state can't be read, or which u may not read, are left
+// without a state. If u is nil, all states are read.
+func (d DeviceList) withState(ctx context.Context, l DeviceListResponse, u *access.User) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	states := make(map[ID]DeviceState)
+	for id := range l {
+		sr, ok := d[id].(StateReader)
+		if !ok {
+			continue
+		}
+		if u != nil && !d.userCan(id, u, access.ActionState) {
+			continue
+		}
+		wg.Add(1)
+		go func(id ID) {
+			defer wg.Done()
+			st, err := sr.State(ctx)
+			if err != nil {
+				if !errors.Is(err, ErrStateUnknown) {
+					log.Printf("Device[%s] state: %v", id, err)
+				}
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			states[id] = st
+		}(id)
+	}
+	wg.Wait()
+
+	for id, st := range states {
+		st := st
+		dr := l[id]
+		dr.State = &st
+		l[id] = dr
+	}
+}
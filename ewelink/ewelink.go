@@ -12,6 +12,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -184,9 +185,11 @@ func (e *Ewelink) newRequestInternal(ctx context.Context, url string, payload an
 func (e *Ewelink) ApiCall(req *http.Request, target any) (err error) {
 	if debug.Debug() {
 		log.Printf("> %s %s %+v", req.Method, req.URL, req.Header)
-		if body, err := req.GetBody(); err == nil && body != nil {
-			io.Copy(log.Writer(), body)
-			body.Close()
+		if req.GetBody != nil {
+			if body, err := req.GetBody(); err == nil && body != nil {
+				io.Copy(log.Writer(), body)
+				body.Close()
+			}
 		}
 	}
 	resp, err := http.DefaultClient.Do(req)
@@ -275,6 +278,46 @@ func (d *Device) Power(ctx context.Context, on bool) error {
 	return err
 }
 
+type StatusResponse struct {
+	Params PowerRequestParams `json:"params"`
+}
+
+// State gets the current switch state using the thing status API.
+func (d *Device) State(ctx context.Context) (device.DeviceState, error) {
+	params := "switch"
+	if d.Outlet != nil {
+		params = "switches"
+	}
+	q := url.Values{
+		"type":   {"1"}, // 1 = Device, 2 = Group
+		"id":     {d.DeviceID},
+		"params": {params},
+	}
+	req, err := d.ewelink().NewRequest(ctx, "/v2/device/thing/status?"+q.Encode(), nil)
+	if err != nil {
+		return device.DeviceState{}, err
+	}
+	var status StatusResponse
+	if err := d.ewelink().ApiCall(req, &status); err != nil {
+		return device.DeviceState{}, err
+	}
+	st := device.DeviceState{Updated: time.Now()}
+	if d.Outlet == nil {
+		if status.Params.Switch == "" {
+			return device.DeviceState{}, device.ErrStateUnknown
+		}
+		st.On = status.Params.Switch == "on"
+		return st, nil
+	}
+	for _, sw := range status.Params.Switches {
+		if sw.Outlet == *d.Outlet {
+			st.On = sw.Switch == "on"
+			return st, nil
+		}
+	}
+	return device.DeviceState{}, device.ErrStateUnknown
+}
+
 func CalcSignature(message, secret []byte) string {
 	h := hmac.New(sha256.New, secret)
 	h.Write(message)
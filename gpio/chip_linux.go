@@ -0,0 +1,142 @@
+//go:build linux
+
+package gpio
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Definitions from <linux/gpio.h> (GPIO character device uAPI v2).
+const (
+	linesMax      = 64
+	maxNameSize   = 32
+	numAttrsMax   = 10
+	lineFlagInput = 1 << 2
+	lineFlagOut   = 1 << 3
+	lineFlagLow   = 1 << 1
+
+	attrIDOutputValues = 2
+)
+
+type lineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // union of flags, values, debounce_period_us
+}
+
+type lineConfigAttribute struct {
+	Attr lineAttribute
+	Mask uint64
+}
+
+type lineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [numAttrsMax]lineConfigAttribute
+}
+
+type lineRequest struct {
+	Offsets         [linesMax]uint32
+	Consumer        [maxNameSize]byte
+	Config          lineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type lineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+// _IOWR('\xB4', nr, size)
+func iowr(nr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xB4<<8 | nr
+}
+
+var (
+	ioctlGetLine   = iowr(0x07, unsafe.Sizeof(lineRequest{}))
+	ioctlGetValues = iowr(0x0E, unsafe.Sizeof(lineValues{}))
+	ioctlSetValues = iowr(0x0F, unsafe.Sizeof(lineValues{}))
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type cdevChip struct {
+	f *os.File
+}
+
+func openChip(path string) (Chip, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &cdevChip{f}, nil
+}
+
+func (c *cdevChip) RequestLine(offset uint32, cfg LineConfig) (Line, error) {
+	var req lineRequest
+	req.Offsets[0] = offset
+	req.NumLines = 1
+	copy(req.Consumer[:maxNameSize-1], consumer)
+	if cfg.Output {
+		req.Config.Flags |= lineFlagOut
+		if cfg.Initial {
+			req.Config.NumAttrs = 1
+			req.Config.Attrs[0] = lineConfigAttribute{
+				Attr: lineAttribute{ID: attrIDOutputValues, Value: 1},
+				Mask: 1,
+			}
+		}
+	} else {
+		req.Config.Flags |= lineFlagInput
+	}
+	if cfg.ActiveLow {
+		req.Config.Flags |= lineFlagLow
+	}
+	if err := ioctl(c.f.Fd(), ioctlGetLine, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("GPIO_V2_GET_LINE_IOCTL: %w", err)
+	}
+	return &cdevLine{os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s:%d", c.f.Name(), offset))}, nil
+}
+
+func (c *cdevChip) Close() error {
+	return c.f.Close()
+}
+
+type cdevLine struct {
+	f *os.File
+}
+
+func (l *cdevLine) SetValue(active bool) error {
+	v := lineValues{Mask: 1}
+	if active {
+		v.Bits = 1
+	}
+	if err := ioctl(l.f.Fd(), ioctlSetValues, unsafe.Pointer(&v)); err != nil {
+		return fmt.Errorf("GPIO_V2_LINE_SET_VALUES_IOCTL: %w", err)
+	}
+	return nil
+}
+
+func (l *cdevLine) Value() (bool, error) {
+	v := lineValues{Mask: 1}
+	if err := ioctl(l.f.Fd(), ioctlGetValues, unsafe.Pointer(&v)); err != nil {
+		return false, fmt.Errorf("GPIO_V2_LINE_GET_VALUES_IOCTL: %w", err)
+	}
+	return v.Bits&1 != 0, nil
+}
+
+func (l *cdevLine) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package gpio
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// Tests that the structs match the kernel ABI sizes.
+func TestABISizes(t *testing.T) {
+	if got, want := unsafe.Sizeof(lineRequest{}), uintptr(592); got != want {
+		t.Errorf("sizeof(gpio_v2_line_request): got %d, want %d", got, want)
+	}
+	if got, want := unsafe.Sizeof(lineValues{}), uintptr(16); got != want {
+		t.Errorf("sizeof(gpio_v2_line_values): got %d, want %d", got, want)
+	}
+	if got, want := ioctlGetLine, uintptr(0xC250B407); got != want {
+		t.Errorf("GPIO_V2_GET_LINE_IOCTL: got %#x, want %#x", got, want)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gpio
+
+func openChip(path string) (Chip, error) {
+	return nil, ErrUnsupported
+}
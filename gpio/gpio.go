@@ -0,0 +1,226 @@
+package gpio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/device"
+)
+
+const consumer = "unlockr"
+
+var ErrUnsupported = errors.New("gpio: character device uAPI not supported on this platform")
+
+// Chip is a GPIO controller, such as /dev/gpiochip0.
+// It is an interface so that tests may substitute a fake chip.
+type Chip interface {
+	RequestLine(offset uint32, cfg LineConfig) (Line, error)
+	Close() error
+}
+
+// Line is a single requested GPIO line.
+type Line interface {
+	// SetValue sets the logical value of an output line.
+	// If the line is active-low, the physical level is inverted by the kernel.
+	SetValue(active bool) error
+
+	// Value reads the logical value of the line.
+	Value() (active bool, err error)
+
+	Close() error
+}
+
+type LineConfig struct {
+	Output    bool
+	ActiveLow bool
+	// Initial is the logical value for output lines when requested.
+	Initial bool
+}
+
+// OpenChip is used to open a chip by path. Tests may replace it.
+var OpenChip func(path string) (Chip, error) = openChip
+
+type Device struct {
+	device.Base
+
+	// Chip is the GPIO chip path, e.g. "/dev/gpiochip0" or "gpiochip0". Required.
+	Chip string `json:"chip"`
+
+	// Line is the line offset on Chip which drives the relay.
+	Line uint32 `json:"line"`
+
+	// ActiveLow inverts the output, for relay boards which activate on low.
+	ActiveLow bool `json:"activelow"`
+
+	// Sensor is an optional input line used to read back the door state.
+	Sensor *Input `json:"sensor,omitempty"`
+
+	mu         sync.Mutex
+	chip       Chip
+	sensorChip Chip // only set if Sensor.Chip differs from Chip
+	out        Line
+	sensor     Line
+}
+
+type Input struct {
+	// Chip defaults to the Device's Chip if empty.
+	Chip      string `json:"chip"`
+	Line      uint32 `json:"line"`
+	ActiveLow bool   `json:"activelow"`
+}
+
+// chipPath allows short names like "gpiochip0" to be used.
+func chipPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	if !strings.ContainsRune(name, filepath.Separator) {
+		return filepath.Join("/dev", name)
+	}
+	return name
+}
+
+// output returns the output line, requesting it on first use.
+// Must be called with mu held.
+func (d *Device) output() (Line, error) {
+	if d.out != nil {
+		return d.out, nil
+	}
+	if d.chip == nil {
+		if d.Chip == "" {
+			return nil, errors.New("gpio: chip is a required parameter")
+		}
+		c, err := OpenChip(chipPath(d.Chip))
+		if err != nil {
+			return nil, err
+		}
+		d.chip = c
+	}
+	l, err := d.chip.RequestLine(d.Line, LineConfig{
+		Output:    true,
+		ActiveLow: d.ActiveLow,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gpio: requesting line %d: %w", d.Line, err)
+	}
+	d.out = l
+	return l, nil
+}
+
+// input returns the sensor line, requesting it on first use.
+// Must be called with mu held.
+func (d *Device) input() (Line, error) {
+	if d.sensor != nil {
+		return d.sensor, nil
+	}
+	if d.Sensor == nil {
+		return nil, errors.New("gpio: sensor is not configured")
+	}
+	chip := d.chip
+	if path := chipPath(d.Sensor.Chip); path != "" && path != chipPath(d.Chip) {
+		if d.sensorChip == nil {
+			c, err := OpenChip(path)
+			if err != nil {
+				return nil, err
+			}
+			d.sensorChip = c
+		}
+		chip = d.sensorChip
+	} else if chip == nil {
+		c, err := OpenChip(chipPath(d.Chip))
+		if err != nil {
+			return nil, err
+		}
+		d.chip, chip = c, c
+	}
+	l, err := chip.RequestLine(d.Sensor.Line, LineConfig{
+		ActiveLow: d.Sensor.ActiveLow,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gpio: requesting sensor line %d: %w", d.Sensor.Line, err)
+	}
+	d.sensor = l
+	return l, nil
+}
+
+// Power sets the line. If Base.Pulse is set, powering on releases the line
+// again after that duration (like a relay's inching mode); the pulse action
+// replaces the release with its own.
+func (d *Device) Power(ctx context.Context, on bool) (err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("Gpio[%s] power on=%v; error: %v", d.GetName(), on, err)
+			return
+		}
+		log.Printf("Gpio[%s] power on=%v; success", d.GetName(), on)
+	}()
+
+	if pulse := d.GetPulse(); on && pulse > 0 {
+		// The release must happen regardless of ctx, otherwise the door
+		// would be left unlocked. It is scheduled first, so that it also
+		// happens if the line switched on despite an error:
+		device.ScheduleOff(d, pulse)
+	}
+	return d.setValue(on)
+}
+
+func (d *Device) setValue(on bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l, err := d.output()
+	if err != nil {
+		return err
+	}
+	return l.SetValue(on)
+}
+
+// SensorActive reads the sensor input line, returning true if it is active.
+func (d *Device) SensorActive(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l, err := d.input()
+	if err != nil {
+		return false, err
+	}
+	return l.Value()
+}
+
+// State reports the sensor input, if configured. Active means open.
+func (d *Device) State(ctx context.Context) (device.DeviceState, error) {
+	if d.Sensor == nil {
+		return device.DeviceState{}, device.ErrStateUnknown
+	}
+	active, err := d.SensorActive(ctx)
+	if err != nil {
+		return device.DeviceState{}, err
+	}
+	return device.DeviceState{On: active, Updated: time.Now()}, nil
+}
+
+// Close releases the requested lines and chip.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, l := range []Line{d.out, d.sensor} {
+		if l != nil {
+			errs = append(errs, l.Close())
+		}
+	}
+	for _, c := range []Chip{d.chip, d.sensorChip} {
+		if c != nil {
+			errs = append(errs, c.Close())
+		}
+	}
+	d.out, d.sensor, d.chip, d.sensorChip = nil, nil, nil, nil
+	return errors.Join(errs...)
+}
+
+var _ device.PowerControl = (*Device)(nil)
+var _ device.StateReader = (*Device)(nil)
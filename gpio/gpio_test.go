@@ -0,0 +1,191 @@
+package gpio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/device"
+)
+
+type fakeChip struct {
+	mu     sync.Mutex
+	lines  map[uint32]*fakeLine
+	closed bool
+}
+
+type fakeLine struct {
+	chip    *fakeChip
+	cfg     LineConfig
+	history []bool // values written to the line
+	value   bool
+}
+
+func newFakeChip() *fakeChip {
+	return &fakeChip{lines: make(map[uint32]*fakeLine)}
+}
+
+func (c *fakeChip) RequestLine(offset uint32, cfg LineConfig) (Line, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := &fakeLine{chip: c, cfg: cfg, value: cfg.Initial}
+	c.lines[offset] = l
+	return l, nil
+}
+
+// history returns the values written to a line.
+func (c *fakeChip) history(offset uint32) []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bool(nil), c.lines[offset].history...)
+}
+
+func (c *fakeChip) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (l *fakeLine) SetValue(active bool) error {
+	l.chip.mu.Lock()
+	defer l.chip.mu.Unlock()
+	l.value = active
+	l.history = append(l.history, active)
+	return nil
+}
+
+func (l *fakeLine) Value() (bool, error) {
+	l.chip.mu.Lock()
+	defer l.chip.mu.Unlock()
+	return l.value, nil
+}
+
+func (l *fakeLine) Close() error {
+	return nil
+}
+
+func useFakeChip(t *testing.T) *fakeChip {
+	chip := newFakeChip()
+	orig := OpenChip
+	OpenChip = func(path string) (Chip, error) {
+		if path != "/dev/gpiochip0" {
+			t.Errorf("OpenChip: got %s, want /dev/gpiochip0", path)
+		}
+		return chip, nil
+	}
+	t.Cleanup(func() { OpenChip = orig })
+	return chip
+}
+
+func TestGpioPower(t *testing.T) {
+	chip := useFakeChip(t)
+	d := &Device{
+		Base:      device.Base{Name: "Gpio"},
+		Chip:      "gpiochip0",
+		Line:      17,
+		ActiveLow: true,
+	}
+
+	var p device.PowerControl = d
+	if err := p.Power(context.Background(), true); err != nil {
+		t.Fatalf("Power(on): %v", err)
+	}
+	if err := p.Power(context.Background(), false); err != nil {
+		t.Fatalf("Power(off): %v", err)
+	}
+
+	l, ok := chip.lines[17]
+	if !ok {
+		t.Fatal("line 17 was not requested")
+	}
+	if want := (LineConfig{Output: true, ActiveLow: true}); l.cfg != want {
+		t.Errorf("LineConfig: got %+v, want %+v", l.cfg, want)
+	}
+	if want := []bool{true, false}; !reflect.DeepEqual(l.history, want) {
+		t.Errorf("history: got %v, want %v", l.history, want)
+	}
+
+	if err := d.Close(); err != nil || !chip.closed {
+		t.Errorf("Close: got err=%v closed=%v, want nil and true", err, chip.closed)
+	}
+}
+
+func TestGpioPulse(t *testing.T) {
+	chip := useFakeChip(t)
+	d := &Device{
+		Base: device.Base{Pulse: device.Duration(10 * time.Millisecond)},
+		Chip: "/dev/gpiochip0",
+		Line: 4,
+	}
+
+	// Pulse must complete even if the context is already cancelled:
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Power(ctx, true); err != nil {
+		t.Fatalf("Power(on): %v", err)
+	}
+	if want := []bool{true}; !reflect.DeepEqual(chip.history(4), want) {
+		t.Errorf("before release: got %v, want %v", chip.history(4), want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if want := []bool{true, false}; !reflect.DeepEqual(chip.history(4), want) {
+		t.Errorf("after release: got %v, want %v", chip.history(4), want)
+	}
+}
+
+// Tests that the pulse action uses the requested duration rather than Pulse,
+// and returns once the line is on.
+func TestGpioServePulse(t *testing.T) {
+	chip := useFakeChip(t)
+	dl := device.DeviceList{"strike": &Device{
+		Base: device.Base{Name: "Strike", Pulse: device.Duration(time.Second)},
+		Chip: "gpiochip0",
+		Line: 4,
+	}}
+	ctx := (&access.User{Username: "alice"}).NewContext(context.Background())
+
+	start := time.Now()
+	r := httptest.NewRequest("POST", "/api/device/strike/pulse?duration=20ms", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	dl.ServeHTTP(w, r)
+	if got := w.Result().StatusCode; got != http.StatusOK {
+		t.Fatalf("pulse: got status %d, want %d", got, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Errorf("pulse: request took %s, want it to return before the pulse ends", elapsed)
+	}
+	if want := []bool{true}; !reflect.DeepEqual(chip.history(4), want) {
+		t.Errorf("before release: got %v, want %v", chip.history(4), want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if want := []bool{true, false}; !reflect.DeepEqual(chip.history(4), want) {
+		t.Errorf("after release: got %v, want %v", chip.history(4), want)
+	}
+}
+
+func TestGpioSensor(t *testing.T) {
+	chip := useFakeChip(t)
+	d := &Device{
+		Chip:   "gpiochip0",
+		Line:   17,
+		Sensor: &Input{Line: 27},
+	}
+
+	active, err := d.SensorActive(context.Background())
+	if err != nil || active {
+		t.Fatalf("SensorActive: got %v, %v, want false, nil", active, err)
+	}
+	if cfg := chip.lines[27].cfg; cfg.Output {
+		t.Errorf("sensor line requested as output: %+v", cfg)
+	}
+
+	chip.lines[27].value = true
+	if active, err := d.SensorActive(context.Background()); err != nil || !active {
+		t.Errorf("SensorActive: got %v, %v, want true, nil", active, err)
+	}
+}
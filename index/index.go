@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/auth"
 	"jeremy.visser.name/go/unlockr/auth/guest"
 	"jeremy.visser.name/go/unlockr/device"
 )
@@ -24,10 +25,13 @@ type IndexResponse struct {
 	Devices device.DeviceListResponse `json:"devices"`
 	Guest   *GuestResponse            `json:"guest,omitempty"`
 	Epoch   int64                     `json:"epoch"`
+
+	// Auth lists the auth methods, if more than one is configured.
+	Auth []string `json:"auth,omitempty"`
 }
 
 type GuestResponse struct {
-	Lifetime guest.Lifetime `json:"lifetime"`
+	Lifetime time.Duration `json:"lifetime"` // in nanoseconds
 }
 
 func (idx *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,10 +48,11 @@ func (idx *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Nickname: u.Nickname,
 			// We don't return the Groups or PasswordHash fields.
 		},
-		Devices: idx.DL.ForUser(u),
+		Devices: idx.DL.InScope(r.Context()).ForUser(u),
 		Guest:   idx.GuestConfig(r.Context()),
 		Epoch:   epoch,
 	}
+	ir.Auth, _ = auth.MethodsFromContext(r.Context())
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&ir); err != nil {
@@ -61,7 +66,7 @@ func (idx *Index) GuestConfig(ctx context.Context) *GuestResponse {
 	cfg, ok := guest.ConfigFromContext(ctx)
 	if ok {
 		return &GuestResponse{
-			Lifetime: cfg.Lifetime,
+			Lifetime: time.Duration(cfg.Lifetime),
 		}
 	}
 	return nil
@@ -125,7 +125,7 @@ func TestIndex(t *testing.T) {
 // Tests that the index contains a valid guest lifetime if set:
 func TestIndexGuest(t *testing.T) {
 	g := guest.Config{
-		Lifetime: guest.Lifetime(42 * time.Hour),
+		Lifetime: device.Duration(42 * time.Hour),
 	}
 	ctx := g.NewContext(context.Background())
 
@@ -138,7 +138,7 @@ func TestIndexGuest(t *testing.T) {
 		Devices: device.DeviceListResponse{},
 		User:    u,
 		Guest: &GuestResponse{
-			Lifetime: g.Lifetime,
+			Lifetime: 42 * time.Hour,
 		},
 		Epoch: epoch,
 	}
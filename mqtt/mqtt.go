@@ -53,6 +53,17 @@ type Mqtt struct {
 
 	subs   listenGroup[Message]
 	topics map[Topic]struct{}
+
+	// last holds the most recent message received on each topic, and is
+	// used for reading device state. Topics are watched once subscribed.
+	last    map[Topic]received
+	watched map[Topic]struct{}
+	lastMu  sync.Mutex
+}
+
+type received struct {
+	Message
+	Time time.Time
 }
 
 func (m *Mqtt) clientID() string {
@@ -75,6 +86,7 @@ func (m *Mqtt) readLoop(c *mqtt.Client) {
 	}
 	go func() {
 		defer m.rmu.Unlock()
+		defer m.disconnected()
 		pub := make(chan Message, BufLen)
 		defer close(pub)
 		go m.subs.publish(pub)
@@ -85,8 +97,10 @@ func (m *Mqtt) readLoop(c *mqtt.Client) {
 				return
 			}
 			log.Printf("Mqtt <- %s = %s", topic, payload)
+			msg := Message{Payload(payload), Topic(topic)}
+			m.remember(msg)
 			select {
-			case pub <- Message{Payload(payload), Topic(topic)}:
+			case pub <- msg:
 				continue
 			default:
 				log.Printf("Mqtt: discarded 1 message due to full buffer (%d messages queued)", BufLen)
@@ -96,6 +110,15 @@ func (m *Mqtt) readLoop(c *mqtt.Client) {
 	c.PublishRetained(nil, []byte(statusOnline), m.statusTopic())
 }
 
+// disconnected is called when readLoop exits. Subscriptions may not survive
+// the reconnect, so subscribers are closed, and must subscribe again.
+func (m *Mqtt) disconnected() {
+	m.subs.closeAll()
+	m.lastMu.Lock()
+	defer m.lastMu.Unlock()
+	m.watched = nil
+}
+
 func (m *Mqtt) client() (*mqtt.Client, error) {
 	m.cmu.Lock()
 	defer m.cmu.Unlock()
@@ -164,16 +187,81 @@ func (m *Mqtt) subscribe(quit <-chan struct{}, topicFilter Topic) (msgs <-chan M
 	if err != nil {
 		return nil, err
 	}
+	// Listen before subscribing, so retained messages aren't missed:
+	msgs = m.subs.subscribe(quit)
 	if _, ok := m.topics[topicFilter]; !ok {
 		if err := c.Subscribe(quit, string(topicFilter)); err != nil {
 			log.Printf("Mqtt.subscribe: %v", err)
+			go func() {
+				for range msgs {
+					// clear backlog until quit is closed
+				}
+			}()
 			return nil, err
 		}
 	}
-	msgs = m.subs.subscribe(quit)
 	return msgs, nil
 }
 
+// remember stores msg as the most recent message for its topic.
+func (m *Mqtt) remember(msg Message) {
+	m.lastMu.Lock()
+	defer m.lastMu.Unlock()
+	if m.last == nil {
+		m.last = make(map[Topic]received)
+	}
+	m.last[msg.Topic] = received{msg, time.Now()}
+}
+
+func (m *Mqtt) lastMessage(topic Topic) (r received, ok bool, watched bool) {
+	m.lastMu.Lock()
+	defer m.lastMu.Unlock()
+	r, ok = m.last[topic]
+	_, watched = m.watched[topic]
+	return
+}
+
+// markWatched records that topic is subscribed to, so its last message is
+// always current.
+func (m *Mqtt) markWatched(topic Topic) {
+	m.lastMu.Lock()
+	defer m.lastMu.Unlock()
+	if m.watched == nil {
+		m.watched = make(map[Topic]struct{})
+	}
+	m.watched[topic] = struct{}{}
+}
+
+// watch returns the last message received on topic.
+//
+// The first call subscribes to topic and waits for a (typically retained)
+// message. Later calls return immediately, as the subscription remains active.
+func (m *Mqtt) watch(ctx context.Context, topic Topic) (received, error) {
+	if r, ok, watched := m.lastMessage(topic); ok {
+		return r, nil
+	} else if watched {
+		return received{}, device.ErrStateUnknown
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	msgs, err := m.subscribe(ctx.Done(), topic)
+	if err != nil {
+		return received{}, err
+	}
+	m.markWatched(topic)
+
+	for msg := range msgs {
+		if msg.Topic == topic {
+			cancel() // close channel, but loop to clear backlog
+		}
+	}
+	if r, ok, _ := m.lastMessage(topic); ok {
+		return r, nil
+	}
+	return received{}, device.ErrStateUnknown
+}
+
 var DefaultMqtt Mqtt
 
 type Expect struct {
@@ -218,7 +306,13 @@ func (e *Expect) Run(ctx context.Context, mq *Mqtt) (err error) {
 type Device struct {
 	device.Base
 	PowerCmd *Expect
-	*Mqtt    `json:"-"`
+
+	// StateMsg is optional, and describes the topic containing the device
+	// state, and the payload which means "on". If unset, the PowerCmd.Recv
+	// topic is used, with a payload of "ON" if unspecified.
+	StateMsg *Message `json:"state"`
+
+	*Mqtt `json:"-"`
 }
 
 func (d *Device) mqtt() *Mqtt {
@@ -238,6 +332,89 @@ func (d *Device) Power(ctx context.Context, on bool) (err error) {
 	return d.PowerCmd.Run(ctx, d.mqtt())
 }
 
+func (d *Device) stateMessage() Message {
+	var sm Message
+	switch {
+	case d.StateMsg != nil:
+		sm = *d.StateMsg
+	case d.PowerCmd != nil && d.PowerCmd.Recv != nil:
+		sm = *d.PowerCmd.Recv
+	}
+	if sm.Payload == "" {
+		sm.Payload = "ON"
+	}
+	return sm
+}
+
+// State returns the state from the last message on the state topic.
+// For this to work after a restart, the device should publish it retained.
+func (d *Device) State(ctx context.Context) (device.DeviceState, error) {
+	sm := d.stateMessage()
+	if sm.Topic == "" {
+		return device.DeviceState{}, device.ErrStateUnknown
+	}
+	r, err := d.mqtt().watch(ctx, sm.Topic)
+	if err != nil {
+		return device.DeviceState{}, err
+	}
+	return device.DeviceState{
+		On:      r.Payload == sm.Payload,
+		Updated: r.Time,
+	}, nil
+}
+
+// PushStates subscribes to the state topic, and publishes an event to
+// events whenever a message on it changes the device's state. If the
+// subscription fails, or ends because the connection was lost, it is retried
+// every device.DefaultPollInterval until ctx is cancelled.
+func (d *Device) PushStates(ctx context.Context, id device.ID, events *device.Events) {
+	sm := d.stateMessage()
+	if sm.Topic == "" {
+		return
+	}
+	m := d.mqtt()
+	for {
+		msgs, err := m.subscribe(ctx.Done(), sm.Topic)
+		if err == nil {
+			m.markWatched(sm.Topic)
+			pushStates(msgs, sm, id, events)
+			err = errors.New("subscription ended")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Mqtt[%s] push states: %v", d.GetName(), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(device.DefaultPollInterval):
+		}
+	}
+}
+
+// pushStates reads msgs until closed, publishing an event for each message
+// on sm.Topic which changes the state.
+func pushStates(msgs <-chan Message, sm Message, id device.ID, events *device.Events) {
+	var last *bool
+	for msg := range msgs {
+		if msg.Topic != sm.Topic {
+			continue
+		}
+		on := msg.Payload == sm.Payload
+		if last != nil && *last == on {
+			continue
+		}
+		last = &on
+		events.Publish(device.Event{
+			Type:   device.EventState,
+			Device: id,
+			State:  &device.DeviceState{On: on, Updated: time.Now()},
+		})
+	}
+}
+
+var _ device.StatePusher = (*Device)(nil)
+
 type listenGroup[T any] struct {
 	m  map[chan T]struct{}
 	mu sync.Mutex
@@ -258,12 +435,24 @@ func (g *listenGroup[T]) subscribe(quit <-chan struct{}) (msgsR <-chan T) {
 		<-quit // block until done
 		g.mu.Lock()
 		defer g.mu.Unlock()
-		delete(g.m, msgs)
-		close(msgs)
+		if _, ok := g.m[msgs]; ok { // not already closed by closeAll
+			delete(g.m, msgs)
+			close(msgs)
+		}
 	}()
 	return msgs
 }
 
+// closeAll unsubscribes all listeners, closing their channels.
+func (g *listenGroup[T]) closeAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for msgs := range g.m {
+		delete(g.m, msgs)
+		close(msgs)
+	}
+}
+
 // publish accepts a channel, and consumes messages until it is closed.
 // Each subscriber receives a copy of the message.
 func (g *listenGroup[T]) publish(messages <-chan T) {
@@ -1,7 +1,11 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"testing"
+
+	"jeremy.visser.name/go/unlockr/device"
 )
 
 type T int
@@ -76,3 +80,85 @@ func TestListenGroupUnsubscribe(t *testing.T) {
 	}
 	lg.mu.Unlock()
 }
+
+// Tests that closeAll closes listeners, and that quitting afterwards is safe.
+func TestListenGroupCloseAll(t *testing.T) {
+	var lg listenGroup[T]
+
+	done := make(chan struct{})
+	m := lg.subscribe(done)
+	lg.closeAll()
+	if _, ok := <-m; ok {
+		t.Errorf("channel not closed by closeAll")
+	}
+	close(done) // must not close m again
+
+	lg.mu.Lock()
+	if got, want := len(lg.m), 0; got != want {
+		t.Errorf("len(lg.m): got %d, want %d", got, want)
+	}
+	lg.mu.Unlock()
+}
+
+// Tests that state is read from the last message, without a server.
+func TestDeviceState(t *testing.T) {
+	mq := new(Mqtt)
+	d := &Device{
+		PowerCmd: &Expect{
+			Send: &Message{Topic: "cmnd/gate/POWER", Payload: "ON"},
+			Recv: &Message{Topic: "stat/gate/POWER"},
+		},
+		Mqtt: mq,
+	}
+
+	mq.remember(Message{Topic: "stat/gate/POWER", Payload: "OFF"})
+	if st, err := d.State(context.Background()); err != nil || st.On {
+		t.Errorf("State: got %+v, %v, want off", st, err)
+	}
+	mq.remember(Message{Topic: "stat/gate/POWER", Payload: "ON"})
+	if st, err := d.State(context.Background()); err != nil || !st.On {
+		t.Errorf("State: got %+v, %v, want on", st, err)
+	}
+
+	// Watched topics without a message are unknown, rather than waiting again:
+	d.StateMsg = &Message{Topic: "stat/gate/SENSOR", Payload: "OPEN"}
+	mq.watched = map[Topic]struct{}{"stat/gate/SENSOR": {}}
+	if _, err := d.State(context.Background()); !errors.Is(err, device.ErrStateUnknown) {
+		t.Errorf("State: got %v, want %v", err, device.ErrStateUnknown)
+	}
+}
+
+// Tests that state changes are published as messages arrive.
+func TestPushStates(t *testing.T) {
+	var events device.Events
+	evs, cancel := events.Subscribe()
+	defer cancel()
+
+	msgs := make(chan Message, 8)
+	for _, msg := range []Message{
+		{Topic: "stat/gate/POWER", Payload: "OFF"},
+		{Topic: "stat/other/POWER", Payload: "ON"},
+		{Topic: "stat/gate/POWER", Payload: "OFF"}, // unchanged
+		{Topic: "stat/gate/POWER", Payload: "ON"},
+	} {
+		msgs <- msg
+	}
+	close(msgs)
+	pushStates(msgs, Message{Topic: "stat/gate/POWER", Payload: "ON"}, "gate", &events)
+
+	for _, want := range []bool{false, true} {
+		select {
+		case ev := <-evs:
+			if ev.Type != device.EventState || ev.Device != "gate" || ev.State == nil || ev.State.On != want {
+				t.Errorf("got %+v, want state on=%v", ev, want)
+			}
+		default:
+			t.Fatalf("missing event, want state on=%v", want)
+		}
+	}
+	select {
+	case ev := <-evs:
+		t.Errorf("unexpected event %+v", ev)
+	default:
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"jeremy.visser.name/go/unlockr/device"
 )
@@ -13,6 +15,9 @@ type Device struct {
 
 	Chaotic int `json:"chaotic"`
 	chaos   int
+
+	mu    sync.Mutex
+	state *device.DeviceState
 }
 
 func (d *Device) isChaos() error {
@@ -31,5 +36,19 @@ func (d *Device) Power(ctx context.Context, on bool) error {
 		log.Printf("Noop[%s] had an error, incredibly: %v", d.GetName(), err)
 		return err
 	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = &device.DeviceState{On: on, Updated: time.Now()}
 	return nil
 }
+
+// State returns the state from the last successful Power call.
+// A device which has never been powered is reported as off.
+func (d *Device) State(ctx context.Context) (device.DeviceState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == nil {
+		return device.DeviceState{On: false, Updated: time.Now()}, nil
+	}
+	return *d.state, nil
+}
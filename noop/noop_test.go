@@ -35,3 +35,14 @@ func TestNoopPower(t *testing.T) {
 		t.Fatalf("Power: got %v, want !nil", err)
 	}
 }
+
+func TestNoopState(t *testing.T) {
+	var sr device.StateReader = &Device{}
+	if st, err := sr.State(context.Background()); err != nil || st.On {
+		t.Fatalf("State: got %+v, %v, want off", st, err)
+	}
+	sr.(device.PowerControl).Power(context.Background(), true)
+	if st, err := sr.State(context.Background()); err != nil || !st.On {
+		t.Errorf("State: got %+v, %v, want on", st, err)
+	}
+}
@@ -0,0 +1,255 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"jeremy.visser.name/go/unlockr/debug"
+	"jeremy.visser.name/go/unlockr/device"
+)
+
+// maxBody limits how much of the response is read when matching.
+const maxBody = 64 * 1024
+
+type Device struct {
+	device.Base
+
+	// PowerCmd is sent for both power on and off.
+	// The URL, Body and Form values are templates (see TemplateData).
+	PowerCmd *Request `json:"powercmd"`
+}
+
+type Request struct {
+	// Method defaults to "POST" if Body or Form is set, otherwise "GET".
+	Method string `json:"method"`
+
+	// URL is the full URL to request. Required.
+	URL string `json:"url"`
+
+	// Headers are added to the request.
+	Headers map[string]string `json:"headers"`
+
+	// Body is sent as-is after templating. If Content-Type isn't set
+	// in Headers, it defaults to "application/json".
+	Body string `json:"body"`
+
+	// Form is sent as an application/x-www-form-urlencoded body.
+	// It may not be used at the same time as Body.
+	Form map[string]string `json:"form"`
+
+	// Expect is optional. If nil, any 2xx response is a success.
+	Expect *Expect `json:"expect"`
+
+	// The parsed templates, set by Parse:
+	url, body *template.Template
+	form      map[string]*template.Template
+}
+
+type Expect struct {
+	// Status is the expected HTTP status code. Zero means any 2xx.
+	Status int `json:"status"`
+
+	// Match is a regular expression which must match the response body.
+	// Empty string matches any body.
+	Match string `json:"match"`
+
+	match *regexp.Regexp // compiled by Request.Parse
+}
+
+// TemplateData is passed to templates in the Request.
+// e.g. {"body": "{\"relay\": \"{{.State}}\"}"}
+type TemplateData struct {
+	On    bool
+	State string // "on" or "off"
+}
+
+func newTemplateData(on bool) TemplateData {
+	if on {
+		return TemplateData{On: true, State: "on"}
+	}
+	return TemplateData{On: false, State: "off"}
+}
+
+func parse(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(text)
+}
+
+func execute(t *template.Template, data TemplateData) (string, error) {
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// UnmarshalJSON parses the templates as the config is loaded,
+// so that mistakes are reported at startup.
+func (req *Request) UnmarshalJSON(v []byte) error {
+	type plain Request // without this method
+	if err := json.Unmarshal(v, (*plain)(req)); err != nil {
+		return err
+	}
+	return req.Parse()
+}
+
+// Parse checks the request, and parses its templates and Expect.Match.
+// It must be called before NewRequest, unless the request was loaded from JSON.
+func (req *Request) Parse() error {
+	if req.URL == "" {
+		return fmt.Errorf("url is a required parameter")
+	}
+	if req.Body != "" && req.Form != nil {
+		return fmt.Errorf("body and form are mutually exclusive")
+	}
+	var err error
+	if req.url, err = parse(req.URL); err != nil {
+		return fmt.Errorf("url template: %w", err)
+	}
+	req.body = nil
+	if req.Body != "" {
+		if req.body, err = parse(req.Body); err != nil {
+			return fmt.Errorf("body template: %w", err)
+		}
+	}
+	req.form = nil
+	if req.Form != nil {
+		req.form = make(map[string]*template.Template, len(req.Form))
+		for k, v := range req.Form {
+			if req.form[k], err = parse(v); err != nil {
+				return fmt.Errorf("form template [%s]: %w", k, err)
+			}
+		}
+	}
+	if e := req.Expect; e != nil {
+		e.match = nil
+		if e.Match != "" {
+			if e.match, err = regexp.Compile(e.Match); err != nil {
+				return fmt.Errorf("expect match: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewRequest builds a http.Request by filling in the templates with data.
+func (req *Request) NewRequest(ctx context.Context, data TemplateData) (*http.Request, error) {
+	if req.url == nil {
+		return nil, errors.New("request has not been parsed")
+	}
+	u, err := execute(req.url, data)
+	if err != nil {
+		return nil, fmt.Errorf("url template: %w", err)
+	}
+
+	var body io.Reader
+	var contentType string
+	switch {
+	case req.form != nil:
+		form := make(url.Values)
+		for k, t := range req.form {
+			v, err := execute(t, data)
+			if err != nil {
+				return nil, fmt.Errorf("form template [%s]: %w", k, err)
+			}
+			form.Set(k, v)
+		}
+		body = strings.NewReader(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case req.body != nil:
+		b, err := execute(req.body, data)
+		if err != nil {
+			return nil, fmt.Errorf("body template: %w", err)
+		}
+		body = strings.NewReader(b)
+		contentType = "application/json"
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "GET"
+		if body != nil {
+			method = "POST"
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range req.Headers {
+		r.Header.Set(k, v)
+	}
+	return r, nil
+}
+
+// Check returns an error if resp doesn't meet the expectations.
+func (e *Expect) Check(resp *http.Response) error {
+	if e == nil || e.Status == 0 {
+		if sc := resp.StatusCode; sc < 200 || sc > 299 {
+			return fmt.Errorf("got HTTP code %d, want 2xx", sc)
+		}
+	} else if resp.StatusCode != e.Status {
+		return fmt.Errorf("got HTTP code %d, want %d", resp.StatusCode, e.Status)
+	}
+	if e == nil || e.Match == "" {
+		return nil
+	}
+	if e.match == nil {
+		return errors.New("expect match has not been compiled")
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return err
+	}
+	if !e.match.Match(body) {
+		return fmt.Errorf("response body did not match %q", e.Match)
+	}
+	return nil
+}
+
+// Run sends the request, and checks the response against Expect.
+func (req *Request) Run(ctx context.Context, data TemplateData) error {
+	r, err := req.NewRequest(ctx, data)
+	if err != nil {
+		return err
+	}
+	if debug.Debug() {
+		log.Printf("> %s %s %+v", r.Method, r.URL, r.Header)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, io.LimitReader(resp.Body, maxBody)) // allow connection reuse
+	if debug.Debug() {
+		log.Printf("< %s %+v", resp.Status, resp.Header)
+	}
+	return req.Expect.Check(resp)
+}
+
+func (d *Device) Power(ctx context.Context, on bool) error {
+	if d.PowerCmd == nil {
+		return fmt.Errorf("Rest[%s]: powercmd is not configured", d.GetName())
+	}
+	if err := d.PowerCmd.Run(ctx, newTemplateData(on)); err != nil {
+		log.Printf("Rest[%s] power on=%v; error: %v", d.GetName(), on, err)
+		return err
+	}
+	log.Printf("Rest[%s] power on=%v; success", d.GetName(), on)
+	return nil
+}
+
+var _ device.PowerControl = (*Device)(nil)
@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"jeremy.visser.name/go/unlockr/device"
+)
+
+func TestRestPower(t *testing.T) {
+	var gotMethod, gotPath, gotBody, gotType, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotMethod, gotPath, gotBody = r.Method, r.URL.Path, string(body)
+		gotType, gotAuth = r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		io.WriteString(w, `{"relay":"done"}`)
+	}))
+	defer srv.Close()
+
+	var d Device
+	cfg := `{"name":"Rest","powercmd":{` +
+		`"url":"` + srv.URL + `/relay/{{.State}}",` +
+		`"headers":{"Authorization":"Bearer secret"},` +
+		`"body":"{\"on\":{{.On}}}",` +
+		`"expect":{"status":200,"match":"\"done\""}}}`
+	if err := json.Unmarshal([]byte(cfg), &d); err != nil {
+		t.Fatal(err)
+	}
+	dl := device.DeviceList{"one": &d}
+
+	p, ok := dl["one"].(device.PowerControl)
+	if !ok {
+		t.Fatal("Device doesn't have PowerControl")
+	}
+	if err := p.Power(context.Background(), true); err != nil {
+		t.Fatalf("Power: got %v, want nil", err)
+	}
+	if gotMethod != "POST" || gotPath != "/relay/on" || gotBody != `{"on":true}` {
+		t.Errorf("request: got %s %s %s, want POST /relay/on {\"on\":true}", gotMethod, gotPath, gotBody)
+	}
+	if gotType != "application/json" || gotAuth != "Bearer secret" {
+		t.Errorf("headers: got Content-Type=%s Authorization=%s", gotType, gotAuth)
+	}
+}
+
+func TestRestForm(t *testing.T) {
+	var gotState, gotType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotState, gotType = r.FormValue("state"), r.Header.Get("Content-Type")
+	}))
+	defer srv.Close()
+
+	d := &Device{
+		PowerCmd: &Request{
+			URL:  srv.URL,
+			Form: map[string]string{"state": "{{.State}}"},
+		},
+	}
+	if err := d.PowerCmd.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Power(context.Background(), false); err != nil {
+		t.Fatalf("Power: got %v, want nil", err)
+	}
+	if gotState != "off" || gotType != "application/x-www-form-urlencoded" {
+		t.Errorf("form: got state=%s Content-Type=%s", gotState, gotType)
+	}
+}
+
+func TestRestExpectFail(t *testing.T) {
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, "nope")
+	}))
+	defer srv.Close()
+
+	d := &Device{PowerCmd: &Request{URL: srv.URL}}
+	if err := d.PowerCmd.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Power(context.Background(), true); err == nil {
+		t.Errorf("Power: got nil, want error due to HTTP code %d", status)
+	}
+
+	status = http.StatusOK
+	d.PowerCmd.Expect = &Expect{Match: "^ok$"}
+	if err := d.PowerCmd.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Power(context.Background(), true); err == nil {
+		t.Errorf("Power: got nil, want error due to body mismatch")
+	}
+}
+
+func TestRestBadConfig(t *testing.T) {
+	for _, cfg := range []string{
+		`{}`,
+		`{"url":"http://x/{{.State"}`,
+		`{"url":"http://x/","body":"{{.Nope}"}`,
+		`{"url":"http://x/","form":{"state":"{{"}}`,
+		`{"url":"http://x/","body":"x","form":{}}`,
+		`{"url":"http://x/","expect":{"match":"("}}`,
+	} {
+		var req Request
+		if err := json.Unmarshal([]byte(cfg), &req); err == nil {
+			t.Errorf("%s: got nil error", cfg)
+		}
+	}
+}
@@ -3,6 +3,7 @@ CREATE TABLE IF NOT EXISTS `unlockr_users` (
   `username` varchar(30) NOT NULL,
   `nickname` varchar(30) NOT NULL,
   `password_hash` varchar(255) NOT NULL,
+  `disabled` tinyint(1) NOT NULL DEFAULT 0,
 
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -19,10 +20,13 @@ CREATE TABLE IF NOT EXISTS `unlockr_group_memberships` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 CREATE TABLE IF NOT EXISTS `unlockr_sessions` (
-  `id` varchar(50) NOT NULL,
+  `id` varchar(100) NOT NULL,
   `username` varchar(30) NOT NULL,
   `expiry` BIGINT UNSIGNED NOT NULL,
   `extra` JSON,
+  `device` varchar(255) NOT NULL DEFAULT '',
+  `addr` varchar(45) NOT NULL DEFAULT '',
+  `last_seen` BIGINT UNSIGNED NOT NULL DEFAULT 0,
 
   PRIMARY KEY (`id`),
   UNIQUE KEY (`id`),
@@ -31,3 +35,48 @@ CREATE TABLE IF NOT EXISTS `unlockr_sessions` (
     REFERENCES `unlockr_users` (`username`)
     ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `unlockr_otp` (
+  `username` varchar(30) NOT NULL,
+  `secret` varchar(100) NOT NULL,
+  `enabled` BOOLEAN NOT NULL DEFAULT FALSE,
+  `recovery_codes` JSON,
+  `last_counter` BIGINT NOT NULL DEFAULT 0,
+
+  PRIMARY KEY (`username`),
+  FOREIGN KEY (`username`)
+    REFERENCES `unlockr_users` (`username`)
+    ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `unlockr_passkeys` (
+  `id` VARBINARY(1023) NOT NULL,
+  `username` varchar(30) NOT NULL,
+  `user_handle` VARBINARY(64) NOT NULL,
+  `public_key` BLOB NOT NULL,
+  `sign_count` INT UNSIGNED NOT NULL DEFAULT 0,
+  `name` varchar(100) NOT NULL DEFAULT '',
+  `created` BIGINT NOT NULL,
+
+  PRIMARY KEY (`id`),
+  INDEX (`username`),
+  INDEX (`user_handle`),
+  FOREIGN KEY (`username`)
+    REFERENCES `unlockr_users` (`username`)
+    ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `unlockr_audit_log` (
+  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `time` BIGINT NOT NULL,
+  `username` varchar(30) NOT NULL,
+  `parent` varchar(30) NOT NULL DEFAULT '',
+  `device` varchar(100) NOT NULL,
+  `action` varchar(100) NOT NULL,
+  `status` SMALLINT UNSIGNED NOT NULL,
+  `error` TEXT,
+  `remote_addr` varchar(100) NOT NULL,
+
+  PRIMARY KEY (`id`),
+  KEY (`time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
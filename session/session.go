@@ -3,13 +3,17 @@ package session
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"jeremy.visser.name/go/unlockr/access"
@@ -23,6 +27,13 @@ const cookieName = "Unlockr-Session"
 const cookiePath = "/api"
 const tokenLength = 30
 const sameSite = http.SameSiteStrictMode
+const lastSeenInterval = 1 * time.Hour
+
+// TokenPrefix marks bearer tokens whose sessions are stored under a hash of
+// the token, so that the session store doesn't reveal them. Unprefixed
+// tokens are stored as is. (Session IDs are standard base64, which can't
+// contain the prefix.)
+const TokenPrefix = "unlockr_"
 
 type SessionId string
 
@@ -30,6 +41,16 @@ type SessionStore interface {
 	Session(ctx context.Context, id SessionId) (*Session, error)
 	SaveSession(ctx context.Context, id SessionId, s *Session) error
 	CleanSessions(ctx context.Context) error
+
+	// SessionsByParent returns the unexpired sessions whose Extra has a
+	// "Parent" field equal to parent, i.e. the guest passes parent issued.
+	SessionsByParent(ctx context.Context, parent access.Username) (map[SessionId]*Session, error)
+
+	// SessionsForUser returns the unexpired sessions whose Username is u.
+	SessionsForUser(ctx context.Context, u access.Username) (map[SessionId]*Session, error)
+
+	// DeleteSession removes a session, so that it can no longer be used.
+	DeleteSession(ctx context.Context, id SessionId) error
 }
 
 type Session struct {
@@ -39,10 +60,28 @@ type Session struct {
 	// Extra is metadata stored with the Session. Because it may end up in
 	// persistent storage, its underlying type is []byte.
 	Extra Extra
+
+	// Device is the User-Agent which created the session, and Addr and
+	// LastSeen are the address it was last used from, and when. Both are
+	// only updated every lastSeenInterval, and are only informational.
+	Device   string
+	Addr     string
+	LastSeen time.Time
 }
 
 type Extra json.RawMessage
 
+// Parent returns the "Parent" field of e, or "" if it has none.
+func (e Extra) Parent() access.Username {
+	var p struct {
+		Parent access.Username
+	}
+	if err := json.Unmarshal(e, &p); err != nil {
+		return ""
+	}
+	return p.Parent
+}
+
 func (s *Session) IsExpired() bool {
 	return time.Now().After(s.Expiry)
 }
@@ -67,6 +106,61 @@ func (s *Session) renew() {
 	}
 }
 
+// seen records that s was used by r, returning the session to use for the
+// request. At most once every lastSeenInterval, an updated copy is saved;
+// s itself may be shared with other requests (e.g. by a cache), so it is
+// never modified.
+func (s *Session) seen(r *http.Request, id SessionId, ss SessionStore) *Session {
+	if time.Since(s.LastSeen) < lastSeenInterval {
+		return s
+	}
+	seen, err := Update(r.Context(), id, ss, func(u *Session) error {
+		u.Addr = remoteHost(r)
+		u.LastSeen = time.Now()
+		return nil
+	})
+	if err != nil {
+		log.Printf("saving session last seen time failed: %v", err)
+		return s
+	}
+	return seen
+}
+
+// updateMu serialises Update. It only does so within this process: like the
+// session cache, it assumes a single instance of Unlockr uses the session
+// store, so updates may be lost if several share a database.
+var updateMu sync.Mutex
+
+// Update fetches session id again, and saves a copy of it modified by fn,
+// unless fn returns an error. Updates are serialised, so that concurrent
+// updates of different fields (such as the last seen time, and a guest pass's
+// remaining uses) don't overwrite each other.
+func Update(ctx context.Context, id SessionId, ss SessionStore, fn func(s *Session) error) (*Session, error) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	s, err := ss.Session(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	updated := *s
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	if err := ss.SaveSession(ctx, id, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (s *Session) Expire(ctx context.Context, w http.ResponseWriter, id SessionId, ss SessionStore) {
 	s.Expiry = time.Time{} // zero-value
 	_ = ss.SaveSession(ctx, id, s)
@@ -93,8 +187,14 @@ func FromRequest(ctx context.Context, r *http.Request, ss SessionStore) (context
 
 	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && t > "" {
 		id = SessionId(t) // used by guests
+		if strings.HasPrefix(t, TokenPrefix) {
+			id = HashedID(t) // used by API tokens
+		}
 	} else if c, err := getCookie(r, cookieName); err == nil {
 		id = SessionId(c.Value) // used by regular users
+		if strings.HasPrefix(c.Value, TokenPrefix) {
+			return nil, "", nil, fmt.Errorf("%w: tokens must be sent as a bearer token", ErrNoSession)
+		}
 	} else {
 		return nil, "", nil, fmt.Errorf("%w: %w", ErrNoSession, err)
 	}
@@ -108,10 +208,23 @@ func FromRequest(ctx context.Context, r *http.Request, ss SessionStore) (context
 		go ss.CleanSessions(context.Background())
 		return nil, "", nil, ErrSessionExpired
 	}
+	s = s.seen(r, id, ss)
 
 	return s.NewContext(ctx), id, s, nil
 }
 
+// Get fetches the session id, returning ErrSessionExpired if it has expired.
+func Get(ctx context.Context, id SessionId, ss SessionStore) (*Session, error) {
+	s, err := ss.Session(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsExpired() {
+		return nil, ErrSessionExpired
+	}
+	return s, nil
+}
+
 // Register registers a new session and sets a cookie for the user.
 //
 // extra may be nil if not needed. Currently, extra is used for storing
@@ -121,6 +234,9 @@ func Register(u access.Username, extra Extra, w http.ResponseWriter, r *http.Req
 		Username: u,
 		Expiry:   time.Now().Add(Lifetime),
 		Extra:    extra,
+		Device:   r.UserAgent(),
+		Addr:     remoteHost(r),
+		LastSeen: time.Now(),
 	}
 
 	id, err := New(r.Context(), s, ss)
@@ -132,6 +248,15 @@ func Register(u access.Username, extra Extra, w http.ResponseWriter, r *http.Req
 	return id, nil
 }
 
+// CurrentID returns the ID of the session in r's cookie, if any.
+func CurrentID(r *http.Request) (SessionId, bool) {
+	c, err := getCookie(r, cookieName)
+	if err != nil {
+		return "", false
+	}
+	return SessionId(c.Value), true
+}
+
 func Logout(w http.ResponseWriter, r *http.Request, ss SessionStore) {
 	c, err := r.Cookie(cookieName)
 	if err != nil {
@@ -158,6 +283,28 @@ func New(ctx context.Context, s *Session, ss SessionStore) (SessionId, error) {
 	return id, err
 }
 
+// NewToken saves s to the SessionStore under a hash of a new token, which is
+// returned to the caller along with the session's ID. The token can't be
+// recovered later.
+func NewToken(ctx context.Context, s *Session, ss SessionStore) (token string, id SessionId, err error) {
+	buf := make([]byte, tokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = TokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	id = HashedID(token)
+	if err := ss.SaveSession(ctx, id, s); err != nil {
+		return "", "", err
+	}
+	return token, id, nil
+}
+
+// HashedID returns the ID of the session for a prefixed token.
+func HashedID(token string) SessionId {
+	sum := sha256.Sum256([]byte(token))
+	return SessionId(TokenPrefix + hex.EncodeToString(sum[:]))
+}
+
 func newID(ctx context.Context, ss SessionStore) (SessionId, error) {
 	buf := make([]byte, tokenLength)
 	if _, err := rand.Read(buf); err != nil {
@@ -0,0 +1,89 @@
+package session_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/session"
+	"jeremy.visser.name/go/unlockr/store"
+)
+
+// Tests that the last seen time is saved to a copy, not the cached session,
+// and only once per interval regardless of the address.
+func TestSeen(t *testing.T) {
+	ctx := context.Background()
+	ss := &store.SessionStoreCache{}
+	lastSeen := time.Now().Add(-2 * time.Hour)
+	s := &session.Session{Username: "alice", Expiry: time.Now().Add(time.Hour), Addr: "198.51.100.1", LastSeen: lastSeen}
+	if err := ss.SaveSession(ctx, "id", s); err != nil {
+		t.Fatal(err)
+	}
+	use := func(addr string) *session.Session {
+		r := httptest.NewRequest("GET", "/api/user", nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("Authorization", "Bearer id")
+		_, _, s, err := session.FromRequest(ctx, r, ss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if got := use("192.0.2.1"); got == s || got.Addr != "192.0.2.1" || !got.LastSeen.After(lastSeen) {
+		t.Errorf("first use: got %+v", got)
+	}
+	if s.Addr != "198.51.100.1" || !s.LastSeen.Equal(lastSeen) {
+		t.Errorf("shared session was modified: %+v", s)
+	}
+	saved, _ := ss.Session(ctx, "id")
+	if got := use("192.0.2.2"); got != saved || got.Addr != "192.0.2.1" {
+		t.Errorf("second use within interval: got %+v, want %+v", got, saved)
+	}
+}
+
+// staleStore returns stale from its first Session call, as if the session
+// was updated after the request fetched it.
+type staleStore struct {
+	session.SessionStore
+	stale *session.Session
+}
+
+func (s *staleStore) Session(ctx context.Context, id session.SessionId) (*session.Session, error) {
+	if stale := s.stale; stale != nil {
+		s.stale = nil
+		return stale, nil
+	}
+	return s.SessionStore.Session(ctx, id)
+}
+
+// Tests that saving the last seen time doesn't overwrite an update to Extra
+// made since the request fetched the session, e.g. a guest pass's uses.
+func TestSeenKeepsExtra(t *testing.T) {
+	ctx := context.Background()
+	cache := &store.SessionStoreCache{}
+	stale := &session.Session{Username: "guest", Expiry: time.Now().Add(time.Hour), Extra: session.Extra(`{"Uses":1}`)}
+	updated := *stale
+	updated.Extra = session.Extra(`{"Uses":0}`)
+	if err := cache.SaveSession(ctx, "id", &updated); err != nil {
+		t.Fatal(err)
+	}
+	ss := &staleStore{SessionStore: cache, stale: stale}
+
+	r := httptest.NewRequest("GET", "/api/user", nil)
+	r.Header.Set("Authorization", "Bearer id")
+	if _, _, _, err := session.FromRequest(ctx, r, ss); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := cache.Session(ctx, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(saved.Extra), `{"Uses":0}`; got != want {
+		t.Errorf("Extra: got %s, want %s", got, want)
+	}
+	if saved.LastSeen.IsZero() {
+		t.Errorf("LastSeen was not saved")
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/audit"
+)
+
+var ErrNoAudit = errors.New("audit log not configured")
+
+// SaveRecord appends r to the JSON lines file at AuditPath.
+func (f *FileStore) SaveRecord(ctx context.Context, r *audit.Record) error {
+	if f.AuditPath == "" {
+		return ErrNoAudit
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f.auditMu.Lock()
+	defer f.auditMu.Unlock()
+	file, err := os.OpenFile(f.AuditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Records reads the whole audit file, so is only suitable for small
+// deployments. Use DBStore for anything larger.
+func (f *FileStore) Records(ctx context.Context, before time.Time, limit int, match func(*audit.Record) bool) ([]audit.Record, error) {
+	if f.AuditPath == "" {
+		return nil, ErrNoAudit
+	}
+	f.auditMu.Lock()
+	defer f.auditMu.Unlock()
+	file, err := os.Open(f.AuditPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // nothing recorded yet
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []audit.Record
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", f.AuditPath, n, err)
+		}
+		if r.Time.Before(before) && (match == nil || match(&r)) {
+			records = append(records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first, and of those recorded at the same time, the last saved:
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (d *DBStore) SaveRecord(ctx context.Context, r *audit.Record) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().AuditSave == "" {
+		return ErrNoAudit
+	}
+	_, err = db.ExecContext(ctx,
+		d.queries().AuditSave,
+		r.Time.UnixMicro(),
+		r.User,
+		r.Parent,
+		r.Device,
+		r.Action,
+		r.Status,
+		r.Error,
+		r.RemoteAddr,
+	)
+	return err
+}
+
+// Records fetches pages of limit records until enough match. Pages are
+// fetched by offset rather than time, so that records with the same time
+// aren't skipped.
+func (d *DBStore) Records(ctx context.Context, before time.Time, limit int, match func(*audit.Record) bool) ([]audit.Record, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().Audit == "" {
+		return nil, ErrNoAudit
+	}
+	records := make([]audit.Record, 0)
+	for offset := 0; len(records) < limit; offset += limit {
+		page, err := d.recordsPage(ctx, db, before, limit, offset)
+		if err != nil {
+			return nil, err
+		}
+		for i := range page {
+			if len(records) < limit && (match == nil || match(&page[i])) {
+				records = append(records, page[i])
+			}
+		}
+		if len(page) < limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (d *DBStore) recordsPage(ctx context.Context, db *sql.DB, before time.Time, limit, offset int) ([]audit.Record, error) {
+	rows, err := db.QueryContext(ctx, d.queries().Audit, before.UnixMicro(), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	var records []audit.Record
+	for rows.Next() {
+		var r audit.Record
+		var t int64
+		if err := rows.Scan(&t, &r.User, &r.Parent, &r.Device, &r.Action, &r.Status, &r.Error, &r.RemoteAddr); err != nil {
+			return nil, err
+		}
+		r.Time = time.UnixMicro(t)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Enforce the interface:
+var _ audit.AuditStore = (*FileStore)(nil)
+var _ audit.AuditStore = (*DBStore)(nil)
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/audit"
+)
+
+func TestFileStoreRecords(t *testing.T) {
+	ctx := context.Background()
+	f := &FileStore{AuditPath: t.TempDir() + "/audit.jsonl"}
+	if records, err := f.Records(ctx, time.Now(), 10, nil); err != nil || len(records) != 0 {
+		t.Errorf("no file: got %+v %v", records, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for i, action := range []string{"pulse", "power/on", "power/off", "power/on"} {
+		rec := &audit.Record{Time: now, User: "alice", Device: "door", Action: action, Status: 200}
+		if i == 0 {
+			rec.Time = now.Add(-time.Minute)
+		}
+		if err := f.SaveRecord(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Newest first, including records with the same time:
+	records, err := f.Records(ctx, now.Add(time.Second), 10, nil)
+	if err != nil || len(records) != 4 || records[0].Action != "power/on" || records[1].Action != "power/off" || records[3].Action != "pulse" {
+		t.Errorf("Records: got %+v %v", records, err)
+	}
+	isOn := func(r *audit.Record) bool { return r.Action == "power/on" }
+	if records, err := f.Records(ctx, now.Add(time.Second), 10, isOn); err != nil || len(records) != 2 {
+		t.Errorf("Records, filtered: got %+v %v", records, err)
+	}
+	if records, err := f.Records(ctx, now, 10, nil); err != nil || len(records) != 1 || records[0].Action != "pulse" {
+		t.Errorf("Records before: got %+v %v", records, err)
+	}
+}
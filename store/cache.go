@@ -62,6 +62,28 @@ func (c *UserStoreCache) User(ctx context.Context, u access.Username) (*access.U
 	}
 }
 
+// Authenticate is passed to the underlying UserStore if it's an
+// access.Authenticator, caching the result. Otherwise the user's
+// PasswordHash is checked.
+func (c *UserStoreCache) Authenticate(ctx context.Context, u access.Username, password string) (*access.User, error) {
+	c.init()
+	a, ok := c.UserStore.(access.Authenticator)
+	if !ok {
+		return access.Authenticate(ctx, userStoreOnly{c}, u, password)
+	}
+	user, err := a.Authenticate(ctx, u, password)
+	if err != nil {
+		return nil, err
+	}
+	c.uc.Add(u, user)
+	return user, nil
+}
+
+// userStoreOnly hides the Authenticate method of a UserStore.
+type userStoreOnly struct {
+	access.UserStore
+}
+
 // CacheUser stores an existing user in the cache.
 func (c *UserStoreCache) CacheUser(username access.Username, user *access.User) {
 	c.init()
@@ -137,3 +159,52 @@ func (c *SessionStoreCache) CleanSessions(ctx context.Context) error {
 	}
 	return nil
 }
+
+// SessionsByParent is answered by the underlying SessionStore if there is
+// one, otherwise from the sessions in memory.
+func (c *SessionStoreCache) SessionsByParent(ctx context.Context, parent access.Username) (map[session.SessionId]*session.Session, error) {
+	c.init()
+	if c.SessionStore != nil {
+		return c.SessionStore.SessionsByParent(ctx, parent)
+	}
+	sessions := make(map[session.SessionId]*session.Session)
+	for _, k := range c.sc.Keys() {
+		s, ok := c.sc.Peek(k)
+		if !ok || s.IsExpired() {
+			continue
+		}
+		if s.Extra.Parent() == parent {
+			sessions[k] = s
+		}
+	}
+	return sessions, nil
+}
+
+// SessionsForUser is answered by the underlying SessionStore if there is
+// one, otherwise from the sessions in memory.
+func (c *SessionStoreCache) SessionsForUser(ctx context.Context, u access.Username) (map[session.SessionId]*session.Session, error) {
+	c.init()
+	if c.SessionStore != nil {
+		return c.SessionStore.SessionsForUser(ctx, u)
+	}
+	sessions := make(map[session.SessionId]*session.Session)
+	for _, k := range c.sc.Keys() {
+		s, ok := c.sc.Peek(k)
+		if !ok || s.IsExpired() {
+			continue
+		}
+		if s.Username == u {
+			sessions[k] = s
+		}
+	}
+	return sessions, nil
+}
+
+func (c *SessionStoreCache) DeleteSession(ctx context.Context, id session.SessionId) error {
+	c.init()
+	c.sc.Remove(id)
+	if c.SessionStore != nil {
+		return c.SessionStore.DeleteSession(ctx, id)
+	}
+	return nil
+}
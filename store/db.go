@@ -30,13 +30,50 @@ type DBStore struct {
 
 const sessionCleanInterval = 1 * time.Hour
 
+var ErrNoSessionsByParent = errors.New("sessionsbyparent query not configured")
+var ErrNoSessionsForUser = errors.New("sessionsforuser query not configured")
+
 type DBQueries struct {
 	// SQL query to retrieve user details.
 	// Must return a single row with columns:
-	//   password_hash (string), nickname (string)
+	//   username (string), password_hash (string), nickname (string),
+	//   and optionally disabled (bool)
 	// WHERE username = ?
 	User string `json:"user"`
 
+	// SQL query to retrieve all users. Optional, but required to manage
+	// users. Must return multiple rows with the same columns as User.
+	Users string `json:"users,omitempty"`
+
+	// SQL query to create a user. Optional.
+	// Must insert the following values:
+	//   username (string), password_hash (string), nickname (string),
+	//   disabled (bool)
+	UserAdd string `json:"useradd,omitempty"`
+
+	// SQL query to update a user. Optional.
+	// Must set the nickname and disabled columns from the values:
+	//   nickname (string), disabled (bool), username (string)
+	UserUpdate string `json:"userupdate,omitempty"`
+
+	// SQL query to delete a user. Optional.
+	// WHERE username = ?
+	UserDelete string `json:"userdelete,omitempty"`
+
+	// SQL queries to remove all of a user's group memberships, and to add
+	// one. Optional, but required to change groups.
+	// GroupMembershipsDelete: WHERE username = ?
+	// GroupMembershipAdd must insert the values:
+	//   username (string), group_name (string)
+	GroupMembershipsDelete string `json:"groupmembershipsdelete,omitempty"`
+	GroupMembershipAdd     string `json:"groupmembershipadd,omitempty"`
+
+	// SQL query to update a user's password. Optional, but required for
+	// password changes.
+	// Must set the password hash from the values:
+	//   password_hash (string), username (string)
+	PasswordSave string `json:"passwordsave,omitempty"`
+
 	// SQL query to retrieve group memberships.
 	// Must return multiple rows with single column:
 	//   group_name (string)
@@ -45,7 +82,8 @@ type DBQueries struct {
 
 	// SQL query to retrieve a session.
 	// Must return a single row with columns:
-	//   session_id (string), username (string), expiry (unix-timestamp), extra (json)
+	//   username (string), expiry (unix-timestamp), extra (json),
+	//   and optionally device (string), addr (string), last_seen (unix-timestamp)
 	// WHERE session_id = ?
 	Session string `json:"session"`
 
@@ -56,6 +94,82 @@ type DBQueries struct {
 	// Must insert the following values:
 	//	 session_id (string), username (string), expiry (unix-timestamp)
 	SessionSave string `json:"sessionsave"`
+
+	// SQL query to update where and when a session was last used. Optional.
+	// Must set the columns returned by Session from the values:
+	//   device (string), addr (string), last_seen (unix-timestamp), session_id (string)
+	SessionInfoSave string `json:"sessioninfosave,omitempty"`
+
+	// SQL query to delete a session. Optional; if not set, sessions are
+	// expired instead.
+	// WHERE session_id = ?
+	SessionDelete string `json:"sessiondelete,omitempty"`
+
+	// SQL query to retrieve the unexpired guest sessions issued by a user.
+	// Optional, but required to list guest passes.
+	// Must return multiple rows with columns:
+	//   session_id (string), username (string), expiry (unix-timestamp), extra (json)
+	// WHERE the "Parent" field of extra = ?
+	SessionsByParent string `json:"sessionsbyparent,omitempty"`
+
+	// SQL query to retrieve a user's unexpired sessions. Optional, but
+	// required to list sessions.
+	// Must return multiple rows with the columns of Session, preceded by
+	// session_id (string)
+	// WHERE username = ?
+	SessionsForUser string `json:"sessionsforuser,omitempty"`
+
+	// SQL query to retrieve a user's one-time password. Optional.
+	// Must return a single row with columns:
+	//   secret (string), enabled (bool), recovery_codes (json), last_counter (int)
+	// WHERE username = ?
+	OTP string `json:"otp,omitempty"`
+
+	// SQL query to create or update a user's one-time password. Optional.
+	// Must insert the following values:
+	//   username (string), secret (string), enabled (bool),
+	//   recovery_codes (json), last_counter (int)
+	OTPSave string `json:"otpsave,omitempty"`
+
+	// SQL query to remove a user's one-time password. Optional.
+	// WHERE username = ?
+	OTPDelete string `json:"otpdelete,omitempty"`
+
+	// SQL query to retrieve a user's passkeys. Optional.
+	// Must return zero or more rows with columns:
+	//   id (bytes), user_handle (bytes), public_key (bytes),
+	//   sign_count (int), name (string), created (unix-timestamp)
+	// WHERE username = ?
+	Passkeys string `json:"passkeys,omitempty"`
+
+	// SQL query to create or update a passkey. Optional.
+	// Must insert the following values:
+	//   id (bytes), username (string), user_handle (bytes),
+	//   public_key (bytes), sign_count (int), name (string),
+	//   created (unix-timestamp)
+	PasskeySave string `json:"passkeysave,omitempty"`
+
+	// SQL query to remove a passkey. Optional.
+	// WHERE username = ? AND id = ?
+	PasskeyDelete string `json:"passkeydelete,omitempty"`
+
+	// SQL query to find whose passkeys have a user handle. Optional.
+	// Must return a single row with a username column.
+	// WHERE user_handle = ?
+	PasskeyUser string `json:"passkeyuser,omitempty"`
+
+	// SQL query to append an audit record. Optional.
+	// Must insert the following values:
+	//   time (unix-microseconds), username (string), parent (string),
+	//   device (string), action (string), status (int), error (string),
+	//   remote_addr (string)
+	AuditSave string `json:"auditsave,omitempty"`
+
+	// SQL query to retrieve audit records. Optional.
+	// Must return multiple rows with the same columns as AuditSave,
+	// newest first, in a consistent order (e.g. by time, then id),
+	// WHERE time < ? LIMIT ? OFFSET ?
+	Audit string `json:"audit,omitempty"`
 }
 
 func (d *DBStore) getDB() (*sql.DB, error) {
@@ -81,6 +195,9 @@ func (d *DBStore) User(ctx context.Context, u access.Username) (*access.User, er
 	if err != nil {
 		return nil, err
 	}
+	if user.Disabled {
+		return nil, access.ErrUserDisabled
+	}
 	user.Groups, err = d.groups(ctx, u)
 	if err != nil {
 		return nil, err
@@ -96,14 +213,32 @@ func (d *DBStore) user(ctx context.Context, u access.Username) (*access.User, er
 	if err != nil {
 		return nil, err
 	}
-	user := new(access.User)
-	err = db.QueryRowContext(ctx, d.queries().User, u).Scan(
-		&user.Username, &user.PasswordHash, &user.Nickname,
-	)
+	rows, err := db.QueryContext(ctx, d.queries().User, u)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, err
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("DB query failed: %w", err)
 		}
+		return nil, sql.ErrNoRows
+	}
+	return scanUser(rows)
+}
+
+// scanUser scans the columns of the User query, where disabled is optional.
+func scanUser(rows *sql.Rows) (*access.User, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	user := new(access.User)
+	dest := []any{&user.Username, &user.PasswordHash, &user.Nickname}
+	if len(cols) > len(dest) {
+		dest = append(dest, &user.Disabled)
+	}
+	if err := rows.Scan(dest...); err != nil {
 		return nil, fmt.Errorf("DB query failed: %w", err)
 	}
 	return user, nil
@@ -141,21 +276,21 @@ func (d *DBStore) Session(ctx context.Context, id session.SessionId) (*session.S
 		return nil, err
 	}
 
-	s := new(session.Session)
-	s.Extra = session.Extra{}
-	var expiry int64
-	err = db.QueryRowContext(ctx,
-		d.queries().Session,
-		id,
-	).Scan(
-		&s.Username, &expiry, &s.Extra)
+	rows, err := db.QueryContext(ctx, d.queries().Session, id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, session.ErrNoSession
-		}
 		return nil, fmt.Errorf("DB query failed: %w", err)
 	}
-	s.Expiry = time.Unix(expiry, 0)
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("DB query failed: %w", err)
+		}
+		return nil, session.ErrNoSession
+	}
+	s, err := scanSession(rows, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	go d.CleanSessions(context.Background())
 	if s.IsExpired() {
@@ -164,6 +299,38 @@ func (d *DBStore) Session(ctx context.Context, id session.SessionId) (*session.S
 	return s, nil
 }
 
+// scanSession scans the columns of the Session query, preceded by the
+// session ID if id is not nil. The device, addr and last_seen columns are
+// optional.
+func scanSession(rows *sql.Rows, id *session.SessionId) (*session.Session, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	s := new(session.Session)
+	var expiry int64
+	var extra []byte // may be NULL
+	var device, addr sql.NullString
+	var lastSeen sql.NullInt64
+	dest := []any{&s.Username, &expiry, &extra}
+	if id != nil {
+		dest = append([]any{id}, dest...)
+	}
+	if len(cols) > len(dest) {
+		dest = append(dest, &device, &addr, &lastSeen)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	s.Expiry = time.Unix(expiry, 0)
+	s.Extra = append(session.Extra{}, extra...)
+	s.Device, s.Addr = device.String, addr.String
+	if lastSeen.Int64 > 0 {
+		s.LastSeen = time.Unix(lastSeen.Int64, 0)
+	}
+	return s, nil
+}
+
 // CleanSessions removes the expired sessions from the DB.
 // If ctx is nil, context.Background() is used.
 // It can safely be called as a goroutine, ensuring only one deletion.
@@ -209,6 +376,89 @@ func (d *DBStore) SaveSession(ctx context.Context, id session.SessionId, s *sess
 		s.Expiry.Unix(),
 		s.Extra,
 	)
+	if err == nil && d.queries().SessionInfoSave != "" {
+		var lastSeen int64
+		if !s.LastSeen.IsZero() {
+			lastSeen = s.LastSeen.Unix()
+		}
+		_, err = db.ExecContext(ctx,
+			d.queries().SessionInfoSave,
+			s.Device,
+			s.Addr,
+			lastSeen,
+			id,
+		)
+	}
 	go d.CleanSessions(context.Background())
 	return err
 }
+
+// DeleteSession removes a session from the DB, or expires it if the
+// sessiondelete query isn't configured.
+func (d *DBStore) DeleteSession(ctx context.Context, id session.SessionId) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().SessionDelete == "" {
+		s, err := d.Session(ctx, id)
+		if err != nil {
+			return err
+		}
+		s.Expiry = time.Time{}
+		return d.SaveSession(ctx, id, s)
+	}
+	if _, err := db.ExecContext(ctx, d.queries().SessionDelete, id); err != nil {
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	return nil
+}
+
+func (d *DBStore) SessionsByParent(ctx context.Context, parent access.Username) (map[session.SessionId]*session.Session, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().SessionsByParent == "" {
+		return nil, ErrNoSessionsByParent
+	}
+	rows, err := db.QueryContext(ctx, d.queries().SessionsByParent, parent)
+	if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+func (d *DBStore) SessionsForUser(ctx context.Context, u access.Username) (map[session.SessionId]*session.Session, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().SessionsForUser == "" {
+		return nil, ErrNoSessionsForUser
+	}
+	rows, err := db.QueryContext(ctx, d.queries().SessionsForUser, u)
+	if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+// scanSessions returns the unexpired sessions in rows, which have the
+// session ID before the columns of the Session query.
+func scanSessions(rows *sql.Rows) (map[session.SessionId]*session.Session, error) {
+	sessions := make(map[session.SessionId]*session.Session)
+	for rows.Next() {
+		var id session.SessionId
+		s, err := scanSession(rows, &id)
+		if err != nil {
+			return nil, err
+		}
+		if !s.IsExpired() {
+			sessions[id] = s
+		}
+	}
+	return sessions, rows.Err()
+}
@@ -6,13 +6,38 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"sync"
 
 	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
 )
 
 type FileStore struct {
 	Path string `json:"path"`
 	data *FileStoreData
+	mu   sync.Mutex // guards data, and writes to Path
+
+	// AuditPath is optional. If set, device actions are appended to it
+	// as JSON lines.
+	AuditPath string `json:"auditpath,omitempty"`
+	auditMu   sync.Mutex
+
+	// OTPPath is optional. If set, users' one-time password secrets are
+	// stored in it, so it should only be readable by Unlockr.
+	OTPPath string `json:"otppath,omitempty"`
+	otpMu   sync.Mutex
+
+	// PasskeyPath is optional. If set, users' passkeys are stored in it.
+	PasskeyPath string `json:"passkeypath,omitempty"`
+	passkeyMu   sync.Mutex
+
+	// SessionPath is optional. If set, sessions are stored in it, so that
+	// logins and guest passes survive restarts. It holds session tokens,
+	// so should only be readable by Unlockr.
+	SessionPath    string `json:"sessionpath,omitempty"`
+	sessions       map[session.SessionId]*fileSession
+	sessionEntries int // lines in the file, including out of date ones
+	sessionMu      sync.Mutex
 }
 
 type FileStoreData struct {
@@ -39,6 +64,8 @@ func (f *FileStore) load() error {
 }
 
 func (f *FileStore) User(ctx context.Context, u access.Username) (*access.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if err := f.load(); err != nil {
 		return nil, err
 	}
@@ -49,6 +76,9 @@ func (f *FileStore) User(ctx context.Context, u access.Username) (*access.User,
 	if !ok {
 		return nil, sql.ErrNoRows
 	}
+	if user.Disabled {
+		return nil, access.ErrUserDisabled
+	}
 	// Populate username from map key:
 	user.Username = u
 	return user, nil
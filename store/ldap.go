@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/debug"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPStore looks up users in an LDAP directory such as Active Directory,
+// and verifies passwords by binding as the user.
+type LDAPStore struct {
+	// URL is the directory server, e.g. "ldaps://dc1.example.com".
+	URL string `json:"url"`
+
+	// StartTLS upgrades an ldap:// connection to TLS.
+	StartTLS bool `json:"starttls,omitempty"`
+
+	// BindDN and BindPassword are used to search for users.
+	// If BindDN is empty, searches are made anonymously.
+	BindDN       string `json:"binddn,omitempty"`
+	BindPassword string `json:"bindpassword,omitempty"`
+
+	// BaseDN is where users are searched for, e.g. "DC=example,DC=com".
+	BaseDN string `json:"basedn"`
+
+	// UserFilter finds a user, with %s replaced by the username.
+	// Defaults to "(sAMAccountName=%s)", as used by Active Directory.
+	UserFilter string `json:"userfilter,omitempty"`
+
+	// UsernameAttr is the user's canonical username, which is used instead
+	// of the username as it was typed. Defaults to "sAMAccountName".
+	UsernameAttr string `json:"usernameattr,omitempty"`
+
+	// NicknameAttr defaults to "displayName".
+	NicknameAttr string `json:"nicknameattr,omitempty"`
+
+	// GroupAttr lists the user's groups, either as DNs (whose first
+	// value is used, e.g. the CN) or as plain names. Defaults to "memberOf".
+	GroupAttr string `json:"groupattr,omitempty"`
+}
+
+func (l *LDAPStore) User(ctx context.Context, u access.Username) (*access.User, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	user, _, err := l.search(conn, u)
+	return user, err
+}
+
+// Authenticate finds the user, then binds as them to check the password.
+func (l *LDAPStore) Authenticate(ctx context.Context, u access.Username, password string) (*access.User, error) {
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which succeeds:
+		return nil, access.ErrBadPassword
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	user, dn, err := l.search(conn, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(dn, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, fmt.Errorf("%w: %w", access.ErrBadPassword, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	return user, nil
+}
+
+// dial connects and binds with the search credentials.
+func (l *LDAPStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connection failed: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if l.StartTLS {
+		host, _, _ := strings.Cut(strings.TrimPrefix(l.URL, "ldap://"), ":")
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	if l.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(l.BindDN, l.BindPassword)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("LDAP bind as %s failed: %w", l.BindDN, err)
+	}
+	return conn, nil
+}
+
+// search returns the user and their DN.
+func (l *LDAPStore) search(conn *ldap.Conn, u access.Username) (*access.User, string, error) {
+	filter := l.UserFilter
+	if filter == "" {
+		filter = "(sAMAccountName=%s)"
+	}
+	usernameAttr := l.UsernameAttr
+	if usernameAttr == "" {
+		usernameAttr = "sAMAccountName"
+	}
+	nicknameAttr := l.NicknameAttr
+	if nicknameAttr == "" {
+		nicknameAttr = "displayName"
+	}
+	groupAttr := l.GroupAttr
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+
+	req := ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, // only 1 is wanted, but 2 tells us if the filter is ambiguous
+		int(ldapTimeout/time.Second),
+		false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(string(u))),
+		[]string{usernameAttr, nicknameAttr, groupAttr},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("LDAP search failed: %w", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, "", sql.ErrNoRows
+	case 1:
+	default:
+		return nil, "", errors.New("LDAP search matched multiple users")
+	}
+
+	e := res.Entries[0]
+	// The directory may match case insensitively, so use its own spelling:
+	username := e.GetAttributeValue(usernameAttr)
+	if username == "" {
+		return nil, "", fmt.Errorf("LDAP entry %s has no %s", e.DN, usernameAttr)
+	}
+	user := &access.User{
+		Username: access.Username(username),
+		Nickname: e.GetAttributeValue(nicknameAttr),
+		Groups:   make(access.Groups, 0),
+	}
+	if user.Nickname == "" {
+		user.Nickname = username
+	}
+	for _, g := range e.GetAttributeValues(groupAttr) {
+		user.Groups = append(user.Groups, groupName(g))
+	}
+	if debug.Debug() {
+		log.Printf("got user[%s] from LDAP: %s %+v", user.Username, e.DN, user)
+	}
+	return user, e.DN, nil
+}
+
+// groupName returns the first value of a group DN, e.g. "Staff" for
+// "CN=Staff,OU=Groups,DC=example,DC=com". Other values are returned as is.
+func groupName(g string) access.GroupName {
+	dn, err := ldap.ParseDN(g)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return access.GroupName(g)
+	}
+	return access.GroupName(dn.RDNs[0].Attributes[0].Value)
+}
+
+// Enforce the interfaces:
+var _ access.UserStore = (*LDAPStore)(nil)
+var _ access.Authenticator = (*LDAPStore)(nil)
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+type ldapEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// testLDAP is a tiny LDAP server, supporting just enough for LDAPStore:
+// simple binds, and searches for a single attribute value.
+type testLDAP struct {
+	ln      net.Listener
+	entries map[string]ldapEntry // by DN
+}
+
+func newTestLDAP(t *testing.T, entries map[string]ldapEntry) *testLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAP{ln: ln, entries: entries}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAP) URL() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *testLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if e, ok := s.entries[dn]; (ok && e.password == password) || (dn == "" && password == "") {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for dn, e := range s.entries {
+				if !e.matches(filter) {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, vals := range e.attrs {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range vals {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				entry.AppendChild(attrs)
+				conn.Write(ldapMessage(id, entry).Bytes())
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// matches supports filters like "(sAMAccountName=alice)", optionally within
+// an "(&...)". Like Active Directory, values are matched case insensitively.
+func (e ldapEntry) matches(filter string) bool {
+	for name, vals := range e.attrs {
+		for _, v := range vals {
+			if strings.Contains(strings.ToLower(filter), strings.ToLower("("+name+"="+v+")")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func TestLDAPStore(t *testing.T) {
+	srv := newTestLDAP(t, map[string]ldapEntry{
+		"CN=unlockr,CN=Users,DC=example,DC=com": {
+			password: "service",
+			attrs:    map[string][]string{"sAMAccountName": {"unlockr"}},
+		},
+		"CN=Alice Montague,CN=Users,DC=example,DC=com": {
+			password: "wherefore",
+			attrs: map[string][]string{
+				"sAMAccountName": {"alice"},
+				"displayName":    {"Alice Montague"},
+				"memberOf": {
+					"CN=Staff,OU=Groups,DC=example,DC=com",
+					"CN=admin,OU=Groups,DC=example,DC=com",
+				},
+			},
+		},
+	})
+	l := &LDAPStore{
+		URL:          srv.URL(),
+		BindDN:       "CN=unlockr,CN=Users,DC=example,DC=com",
+		BindPassword: "service",
+		BaseDN:       "DC=example,DC=com",
+	}
+	ctx := context.Background()
+	want := &access.User{
+		Username: "alice",
+		Nickname: "Alice Montague",
+		Groups:   access.Groups{"Staff", "admin"},
+	}
+
+	if u, err := l.User(ctx, "alice"); err != nil || !reflect.DeepEqual(u, want) {
+		t.Errorf("User: got %+v, %v, want %+v", u, err, want)
+	}
+	// The username is spelt as the directory has it, not as typed:
+	if u, err := l.User(ctx, "ALICE"); err != nil || !reflect.DeepEqual(u, want) {
+		t.Errorf("User(ALICE): got %+v, %v, want %+v", u, err, want)
+	}
+	if _, err := l.User(ctx, "mallory"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("User(mallory): got %v, want %v", err, sql.ErrNoRows)
+	}
+
+	// Passwords are verified through the cache:
+	us := &UserStoreCache{UserStore: l}
+	if u, err := access.Authenticate(ctx, us, "alice", "wherefore"); err != nil || !reflect.DeepEqual(u, want) {
+		t.Errorf("Authenticate: got %+v, %v, want %+v", u, err, want)
+	}
+	for _, password := range []string{"", "art thou"} {
+		if _, err := access.Authenticate(ctx, us, "alice", password); !errors.Is(err, access.ErrBadPassword) {
+			t.Errorf("Authenticate(%q): got %v, want %v", password, err, access.ErrBadPassword)
+		}
+	}
+	if _, err := access.Authenticate(ctx, us, "mallory", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Authenticate(mallory): got %v, want %v", err, sql.ErrNoRows)
+	}
+
+	l.UsernameAttr = "uid"
+	if _, err := l.User(ctx, "alice"); err == nil {
+		t.Errorf("User without a username attribute: got nil error")
+	}
+	l.UsernameAttr = ""
+
+	l.BindPassword = "wrong"
+	if _, err := l.User(ctx, "alice"); err == nil {
+		t.Errorf("User with bad service password: got nil error")
+	}
+}
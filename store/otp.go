@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+var ErrNoOTPStore = errors.New("OTP storage not configured")
+
+// OTP reads the JSON file at OTPPath. Users without an entry have no OTP.
+func (f *FileStore) OTP(ctx context.Context, u access.Username) (*access.OTP, error) {
+	if f.OTPPath == "" {
+		return nil, access.ErrNoOTP
+	}
+	f.otpMu.Lock()
+	defer f.otpMu.Unlock()
+	otps, err := f.loadOTPs()
+	if err != nil {
+		return nil, err
+	}
+	o, ok := otps[u]
+	if !ok {
+		return nil, access.ErrNoOTP
+	}
+	return &o, nil
+}
+
+// SaveOTP rewrites the whole file at OTPPath.
+func (f *FileStore) SaveOTP(ctx context.Context, u access.Username, o *access.OTP) error {
+	if f.OTPPath == "" {
+		return ErrNoOTPStore
+	}
+	f.otpMu.Lock()
+	defer f.otpMu.Unlock()
+	otps, err := f.loadOTPs()
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		delete(otps, u)
+	} else {
+		otps[u] = *o
+	}
+	return writeJSONFile(f.OTPPath, otps, 0o600)
+}
+
+func (f *FileStore) loadOTPs() (map[access.Username]access.OTP, error) {
+	otps := make(map[access.Username]access.OTP)
+	data, err := os.ReadFile(f.OTPPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return otps, nil // nobody enrolled yet
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &otps); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.OTPPath, err)
+	}
+	return otps, nil
+}
+
+// writeJSONFile replaces path with v atomically, so that a crash can't
+// leave it half-written.
+func writeJSONFile(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), perm)
+}
+
+// writeFile is writeJSONFile for data which is already encoded.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *DBStore) OTP(ctx context.Context, u access.Username) (*access.OTP, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().OTP == "" {
+		return nil, access.ErrNoOTP
+	}
+	o := new(access.OTP)
+	var codes []byte
+	err = db.QueryRowContext(ctx, d.queries().OTP, u).Scan(
+		&o.Secret, &o.Enabled, &codes, &o.LastCounter,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, access.ErrNoOTP
+	} else if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	if len(codes) > 0 {
+		if err := json.Unmarshal(codes, &o.RecoveryCodes); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (d *DBStore) SaveOTP(ctx context.Context, u access.Username, o *access.OTP) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().OTPSave == "" || d.queries().OTPDelete == "" {
+		return ErrNoOTPStore
+	}
+	if o == nil {
+		_, err = db.ExecContext(ctx, d.queries().OTPDelete, u)
+		return err
+	}
+	codes, err := json.Marshal(o.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		d.queries().OTPSave,
+		u,
+		o.Secret,
+		o.Enabled,
+		codes,
+		o.LastCounter,
+	)
+	return err
+}
+
+// OTP is passed to the underlying UserStore. It is never cached, as
+// codes must only be accepted once.
+func (c *UserStoreCache) OTP(ctx context.Context, u access.Username) (*access.OTP, error) {
+	otps, ok := c.UserStore.(access.OTPStore)
+	if !ok {
+		return nil, access.ErrNoOTP
+	}
+	return otps.OTP(ctx, u)
+}
+
+func (c *UserStoreCache) SaveOTP(ctx context.Context, u access.Username, o *access.OTP) error {
+	otps, ok := c.UserStore.(access.OTPStore)
+	if !ok {
+		return ErrNoOTPStore
+	}
+	return otps.SaveOTP(ctx, u, o)
+}
+
+// Enforce the interface:
+var _ access.OTPStore = (*FileStore)(nil)
+var _ access.OTPStore = (*DBStore)(nil)
+var _ access.OTPStore = (*UserStoreCache)(nil)
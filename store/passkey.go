@@ -0,0 +1,238 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+var ErrNoPasskeyStore = errors.New("passkey storage not configured")
+
+// Passkeys reads the JSON file at PasskeyPath.
+func (f *FileStore) Passkeys(ctx context.Context, u access.Username) ([]access.Passkey, error) {
+	if f.PasskeyPath == "" {
+		return nil, nil
+	}
+	f.passkeyMu.Lock()
+	defer f.passkeyMu.Unlock()
+	passkeys, err := f.loadPasskeys()
+	if err != nil {
+		return nil, err
+	}
+	return passkeys[u], nil
+}
+
+func (f *FileStore) SavePasskey(ctx context.Context, u access.Username, p *access.Passkey) error {
+	if f.PasskeyPath == "" {
+		return ErrNoPasskeyStore
+	}
+	f.passkeyMu.Lock()
+	defer f.passkeyMu.Unlock()
+	passkeys, err := f.loadPasskeys()
+	if err != nil {
+		return err
+	}
+	for i := range passkeys[u] {
+		if bytes.Equal(passkeys[u][i].ID, p.ID) {
+			passkeys[u][i] = *p
+			return writeJSONFile(f.PasskeyPath, passkeys, 0o600)
+		}
+	}
+	passkeys[u] = append(passkeys[u], *p)
+	return writeJSONFile(f.PasskeyPath, passkeys, 0o600)
+}
+
+func (f *FileStore) DeletePasskey(ctx context.Context, u access.Username, id []byte) error {
+	if f.PasskeyPath == "" {
+		return access.ErrNoPasskey
+	}
+	f.passkeyMu.Lock()
+	defer f.passkeyMu.Unlock()
+	passkeys, err := f.loadPasskeys()
+	if err != nil {
+		return err
+	}
+	for i, p := range passkeys[u] {
+		if bytes.Equal(p.ID, id) {
+			passkeys[u] = append(passkeys[u][:i:i], passkeys[u][i+1:]...)
+			if len(passkeys[u]) == 0 {
+				delete(passkeys, u)
+			}
+			return writeJSONFile(f.PasskeyPath, passkeys, 0o600)
+		}
+	}
+	return access.ErrNoPasskey
+}
+
+func (f *FileStore) PasskeyUser(ctx context.Context, handle []byte) (access.Username, error) {
+	if f.PasskeyPath == "" {
+		return "", access.ErrNoPasskey
+	}
+	f.passkeyMu.Lock()
+	defer f.passkeyMu.Unlock()
+	passkeys, err := f.loadPasskeys()
+	if err != nil {
+		return "", err
+	}
+	for u, pks := range passkeys {
+		for _, p := range pks {
+			if bytes.Equal(p.UserHandle, handle) {
+				return u, nil
+			}
+		}
+	}
+	return "", access.ErrNoPasskey
+}
+
+func (f *FileStore) loadPasskeys() (map[access.Username][]access.Passkey, error) {
+	passkeys := make(map[access.Username][]access.Passkey)
+	data, err := os.ReadFile(f.PasskeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return passkeys, nil // nobody registered yet
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &passkeys); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.PasskeyPath, err)
+	}
+	return passkeys, nil
+}
+
+func (d *DBStore) Passkeys(ctx context.Context, u access.Username) ([]access.Passkey, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().Passkeys == "" {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, d.queries().Passkeys, u)
+	if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	var passkeys []access.Passkey
+	for rows.Next() {
+		var p access.Passkey
+		var created int64
+		if err := rows.Scan(
+			&p.ID,
+			&p.UserHandle,
+			&p.PublicKey,
+			&p.SignCount,
+			&p.Name,
+			&created,
+		); err != nil {
+			return nil, fmt.Errorf("DB query failed: %w", err)
+		}
+		p.Created = time.Unix(created, 0)
+		passkeys = append(passkeys, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	return passkeys, nil
+}
+
+func (d *DBStore) SavePasskey(ctx context.Context, u access.Username, p *access.Passkey) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().PasskeySave == "" {
+		return ErrNoPasskeyStore
+	}
+	_, err = db.ExecContext(ctx,
+		d.queries().PasskeySave,
+		p.ID,
+		u,
+		p.UserHandle,
+		p.PublicKey,
+		p.SignCount,
+		p.Name,
+		p.Created.Unix(),
+	)
+	return err
+}
+
+func (d *DBStore) DeletePasskey(ctx context.Context, u access.Username, id []byte) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().PasskeyDelete == "" {
+		return ErrNoPasskeyStore
+	}
+	res, err := db.ExecContext(ctx, d.queries().PasskeyDelete, u, id)
+	if err != nil {
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return access.ErrNoPasskey
+	}
+	return nil
+}
+
+func (d *DBStore) PasskeyUser(ctx context.Context, handle []byte) (access.Username, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return "", err
+	}
+	if d.queries().PasskeyUser == "" {
+		return "", access.ErrNoPasskey
+	}
+	var u access.Username
+	err = db.QueryRowContext(ctx, d.queries().PasskeyUser, handle).Scan(&u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", access.ErrNoPasskey
+	} else if err != nil {
+		return "", fmt.Errorf("DB query failed: %w", err)
+	}
+	return u, nil
+}
+
+// Passkeys are passed to the underlying UserStore, uncached, as their
+// signature counters must be up to date.
+func (c *UserStoreCache) Passkeys(ctx context.Context, u access.Username) ([]access.Passkey, error) {
+	pks, ok := c.UserStore.(access.PasskeyStore)
+	if !ok {
+		return nil, nil
+	}
+	return pks.Passkeys(ctx, u)
+}
+
+func (c *UserStoreCache) SavePasskey(ctx context.Context, u access.Username, p *access.Passkey) error {
+	pks, ok := c.UserStore.(access.PasskeyStore)
+	if !ok {
+		return ErrNoPasskeyStore
+	}
+	return pks.SavePasskey(ctx, u, p)
+}
+
+func (c *UserStoreCache) DeletePasskey(ctx context.Context, u access.Username, id []byte) error {
+	pks, ok := c.UserStore.(access.PasskeyStore)
+	if !ok {
+		return access.ErrNoPasskey
+	}
+	return pks.DeletePasskey(ctx, u, id)
+}
+
+func (c *UserStoreCache) PasskeyUser(ctx context.Context, handle []byte) (access.Username, error) {
+	pks, ok := c.UserStore.(access.PasskeyStore)
+	if !ok {
+		return "", access.ErrNoPasskey
+	}
+	return pks.PasskeyUser(ctx, handle)
+}
+
+// Enforce the interface:
+var _ access.PasskeyStore = (*FileStore)(nil)
+var _ access.PasskeyStore = (*DBStore)(nil)
+var _ access.PasskeyStore = (*UserStoreCache)(nil)
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+var ErrNoSessionStore = errors.New("session storage not configured")
+
+// sessionCompactMin is the fewest entries in the file at SessionPath
+// before it is compacted.
+const sessionCompactMin = 100
+
+// fileSession is a session as stored at SessionPath, with Extra kept as
+// readable JSON.
+type fileSession struct {
+	Username access.Username `json:"username"`
+	Expiry   time.Time       `json:"expiry"`
+	Extra    json.RawMessage `json:"extra,omitempty"`
+	Device   string          `json:"device,omitempty"`
+	Addr     string          `json:"addr,omitempty"`
+	LastSeen time.Time       `json:"lastseen"`
+}
+
+func newFileSession(s *session.Session) *fileSession {
+	return &fileSession{
+		Username: s.Username,
+		Expiry:   s.Expiry,
+		Extra:    json.RawMessage(s.Extra),
+		Device:   s.Device,
+		Addr:     s.Addr,
+		LastSeen: s.LastSeen,
+	}
+}
+
+func (fs *fileSession) session() *session.Session {
+	return &session.Session{
+		Username: fs.Username,
+		Expiry:   fs.Expiry,
+		Extra:    session.Extra(fs.Extra),
+		Device:   fs.Device,
+		Addr:     fs.Addr,
+		LastSeen: fs.LastSeen,
+	}
+}
+
+func (fs *fileSession) isExpired() bool {
+	return time.Now().After(fs.Expiry)
+}
+
+// sessionEntry is a line of the file at SessionPath. Later entries for
+// an ID replace earlier ones, and entries without a Session delete it.
+type sessionEntry struct {
+	ID      session.SessionId `json:"id"`
+	Session *fileSession      `json:"session,omitempty"`
+}
+
+// Session reads the file at SessionPath, which is only read once. Saved
+// and deleted sessions are appended to it as JSON lines, and it is
+// rewritten once most of its lines are out of date.
+func (f *FileStore) Session(ctx context.Context, id session.SessionId) (*session.Session, error) {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return nil, err
+	}
+	fs, ok := f.sessions[id]
+	if !ok {
+		return nil, session.ErrNoSession
+	}
+	if fs.isExpired() {
+		return nil, session.ErrSessionExpired
+	}
+	return fs.session(), nil
+}
+
+func (f *FileStore) SaveSession(ctx context.Context, id session.SessionId, s *session.Session) error {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return err
+	}
+	fs := newFileSession(s)
+	f.sessions[id] = fs
+	return f.appendSession(id, fs)
+}
+
+// CleanSessions removes the expired sessions from the file. They are also
+// left out whenever it is rewritten.
+func (f *FileStore) CleanSessions(ctx context.Context) error {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return err
+	}
+	for _, fs := range f.sessions {
+		if fs.isExpired() {
+			return f.writeSessions()
+		}
+	}
+	return nil
+}
+
+func (f *FileStore) SessionsByParent(ctx context.Context, parent access.Username) (map[session.SessionId]*session.Session, error) {
+	return f.findSessions(func(s *session.Session) bool {
+		return s.Extra.Parent() == parent
+	})
+}
+
+func (f *FileStore) SessionsForUser(ctx context.Context, u access.Username) (map[session.SessionId]*session.Session, error) {
+	return f.findSessions(func(s *session.Session) bool {
+		return s.Username == u
+	})
+}
+
+func (f *FileStore) DeleteSession(ctx context.Context, id session.SessionId) error {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return err
+	}
+	if _, ok := f.sessions[id]; !ok {
+		return nil
+	}
+	delete(f.sessions, id)
+	return f.appendSession(id, nil)
+}
+
+// findSessions returns the unexpired sessions for which match is true.
+func (f *FileStore) findSessions(match func(*session.Session) bool) (map[session.SessionId]*session.Session, error) {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return nil, err
+	}
+	sessions := make(map[session.SessionId]*session.Session)
+	for id, fs := range f.sessions {
+		if s := fs.session(); !fs.isExpired() && match(s) {
+			sessions[id] = s
+		}
+	}
+	return sessions, nil
+}
+
+func (f *FileStore) loadSessions() error {
+	if f.SessionPath == "" {
+		return ErrNoSessionStore
+	}
+	if f.sessions != nil {
+		return nil
+	}
+	sessions := make(map[session.SessionId]*fileSession)
+	file, err := os.Open(f.SessionPath)
+	if errors.Is(err, os.ErrNotExist) {
+		f.sessions = sessions // nobody logged in yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries := 0
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// Left by a crash while appending, so don't append after it:
+			log.Printf("%s: ignoring incomplete last line", f.SessionPath)
+			f.sessions = sessions
+			return f.writeSessions()
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var e sessionEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%s: %w", f.SessionPath, err)
+		}
+		if e.Session != nil {
+			sessions[e.ID] = e.Session
+		} else {
+			delete(sessions, e.ID)
+		}
+		entries++
+	}
+	for id, fs := range sessions {
+		if fs.isExpired() {
+			delete(sessions, id) // until the file is next rewritten
+		}
+	}
+	f.sessions = sessions
+	f.sessionEntries = entries
+	return nil
+}
+
+// appendSession adds an entry for the session to the file, or deletes it
+// if fs is nil. The file is rewritten instead if it has become mostly
+// out of date.
+func (f *FileStore) appendSession(id session.SessionId, fs *fileSession) error {
+	if f.sessionEntries >= sessionCompactMin && f.sessionEntries >= 2*len(f.sessions) {
+		return f.writeSessions()
+	}
+	line, err := json.Marshal(&sessionEntry{ID: id, Session: fs})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.SessionPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		f.sessions = nil // reload, which rewrites any partial line
+		return err
+	}
+	f.sessionEntries++
+	return file.Close()
+}
+
+// writeSessions replaces the file with the unexpired sessions.
+func (f *FileStore) writeSessions() error {
+	var data []byte
+	for id, fs := range f.sessions {
+		if fs.isExpired() {
+			delete(f.sessions, id)
+			continue
+		}
+		line, err := json.Marshal(&sessionEntry{ID: id, Session: fs})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := writeFile(f.SessionPath, data, 0o600); err != nil {
+		return err
+	}
+	f.sessionEntries = len(f.sessions)
+	return nil
+}
+
+var _ session.SessionStore = (*FileStore)(nil)
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+func TestFileStoreSessions(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir() + "/sessions.json"
+	f := &FileStore{SessionPath: path}
+	if _, err := f.Session(ctx, "nobody"); !errors.Is(err, session.ErrNoSession) {
+		t.Errorf("no file: got %v, want %v", err, session.ErrNoSession)
+	}
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	for id, s := range map[session.SessionId]*session.Session{
+		"alice1":  {Username: "alice", Expiry: expiry, Device: "Phone"},
+		"alice2":  {Username: "alice", Expiry: expiry},
+		"guest":   {Username: "guest", Expiry: expiry, Extra: session.Extra(`{"Parent":"alice"}`)},
+		"expired": {Username: "bob", Expiry: time.Now().Add(-time.Hour)},
+	} {
+		if err := f.SaveSession(ctx, id, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.DeleteSession(ctx, "alice2"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("file mode: got %v %v", fi, err)
+	}
+
+	// Sessions survive a restart:
+	f = &FileStore{SessionPath: path}
+	s, err := f.Session(ctx, "alice1")
+	if err != nil || s.Username != "alice" || s.Device != "Phone" || !s.Expiry.Equal(expiry) || len(s.Extra) != 0 {
+		t.Errorf("alice1: got %+v %v", s, err)
+	}
+	for _, id := range []session.SessionId{"alice2", "expired"} {
+		if _, err := f.Session(ctx, id); !errors.Is(err, session.ErrNoSession) {
+			t.Errorf("%s: got %v, want %v", id, err, session.ErrNoSession)
+		}
+	}
+	if sessions, err := f.SessionsForUser(ctx, "alice"); err != nil || len(sessions) != 1 || sessions["alice1"] == nil {
+		t.Errorf("SessionsForUser: got %v %v", sessions, err)
+	}
+	if sessions, err := f.SessionsByParent(ctx, "alice"); err != nil || len(sessions) != 1 || sessions["guest"] == nil {
+		t.Errorf("SessionsByParent: got %v %v", sessions, err)
+	}
+
+	// Saves are appended, and the file is compacted once it's mostly out of date:
+	lines := func() int {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+	before := lines()
+	for i := 0; i < 3*sessionCompactMin; i++ {
+		s.LastSeen = expiry.Add(time.Duration(i) * time.Second)
+		if err := f.SaveSession(ctx, "alice1", s); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && lines() != before+1 {
+			t.Errorf("after save: got %d lines, want %d", lines(), before+1)
+		}
+	}
+	if n := lines(); n > sessionCompactMin {
+		t.Errorf("after %d saves: got %d lines, want at most %d", 3*sessionCompactMin, n, sessionCompactMin)
+	}
+	f = &FileStore{SessionPath: path}
+	if s, err := f.Session(ctx, "alice1"); err != nil || !s.LastSeen.Equal(expiry.Add((3*sessionCompactMin-1)*time.Second)) {
+		t.Errorf("alice1 after compaction: got %+v %v", s, err)
+	}
+	if _, err := f.Session(ctx, "guest"); err != nil {
+		t.Errorf("guest after compaction: got %v", err)
+	}
+
+	// A partly written last line is ignored:
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":"torn","sess`)
+	file.Close()
+	f = &FileStore{SessionPath: path}
+	if _, err := f.Session(ctx, "alice1"); err != nil {
+		t.Errorf("after partial line: got %v", err)
+	}
+	if err := f.SaveSession(ctx, "alice2", s); err != nil {
+		t.Fatal(err)
+	}
+	f = &FileStore{SessionPath: path}
+	if _, err := f.Session(ctx, "alice2"); err != nil {
+		t.Errorf("saved after partial line: got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"jeremy.visser.name/go/unlockr/access"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a DBStore in an SQLite database file, which needs no
+// server. Its tables and queries are built in, and the tables are created
+// or migrated when it is opened.
+type SQLiteStore struct {
+	// Path is the database file, which is created if it doesn't exist.
+	Path string `json:"path"`
+
+	// Import is optional. If set, and the database has no users, the users
+	// in this file (as used by FileStore) are added to it, e.g. to create
+	// the first admin.
+	Import string `json:"import,omitempty"`
+
+	DBStore `json:"-"`
+}
+
+// sqliteMigrations are applied in order to bring the database up to date.
+// The number applied is kept in PRAGMA user_version. Never change one
+// which has been released; add another instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		username TEXT NOT NULL PRIMARY KEY,
+		nickname TEXT NOT NULL DEFAULT '',
+		password_hash TEXT NOT NULL DEFAULT '',
+		disabled INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE group_memberships (
+		username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		group_name TEXT NOT NULL,
+		PRIMARY KEY (username, group_name)
+	);
+	CREATE TABLE sessions (
+		id TEXT NOT NULL PRIMARY KEY,
+		username TEXT NOT NULL, -- may be an OAuth user or guest, not in users
+		expiry INTEGER NOT NULL,
+		extra BLOB,
+		device TEXT NOT NULL DEFAULT '',
+		addr TEXT NOT NULL DEFAULT '',
+		last_seen INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessions_username ON sessions (username);
+	CREATE TABLE otp (
+		username TEXT NOT NULL PRIMARY KEY REFERENCES users (username) ON DELETE CASCADE,
+		secret TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		recovery_codes BLOB,
+		last_counter INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE passkeys (
+		id BLOB NOT NULL PRIMARY KEY,
+		username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		user_handle BLOB NOT NULL,
+		public_key BLOB NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL
+	);
+	CREATE INDEX passkeys_username ON passkeys (username);
+	CREATE INDEX passkeys_user_handle ON passkeys (user_handle);
+	CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY,
+		time INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		parent TEXT NOT NULL DEFAULT '',
+		device TEXT NOT NULL,
+		action TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL
+	);
+	CREATE INDEX audit_log_time ON audit_log (time);`,
+}
+
+// sqliteExtraParent is the "Parent" field of a session's extra column, or
+// NULL if it isn't JSON.
+const sqliteExtraParent = `CASE WHEN json_valid(CAST(extra AS TEXT)) THEN json_extract(CAST(extra AS TEXT), '$.Parent') END`
+
+var sqliteQueries = DBQueries{
+	User:                   "SELECT username, password_hash, nickname, disabled FROM users WHERE username = ?",
+	Users:                  "SELECT username, password_hash, nickname, disabled FROM users",
+	UserAdd:                "INSERT INTO users (username, password_hash, nickname, disabled) VALUES (?, ?, ?, ?)",
+	UserUpdate:             "UPDATE users SET nickname = ?, disabled = ? WHERE username = ?",
+	UserDelete:             "DELETE FROM users WHERE username = ?",
+	GroupMembershipsDelete: "DELETE FROM group_memberships WHERE username = ?",
+	GroupMembershipAdd:     "INSERT OR IGNORE INTO group_memberships (username, group_name) VALUES (?, ?)",
+	PasswordSave:           "UPDATE users SET password_hash = ? WHERE username = ?",
+	GroupMemberships:       "SELECT group_name FROM group_memberships WHERE username = ? ORDER BY group_name",
+	Session:                "SELECT username, expiry, extra, device, addr, last_seen FROM sessions WHERE id = ?",
+	SessionClean:           "DELETE FROM sessions WHERE expiry < CAST(strftime('%s', 'now') AS INTEGER)",
+	SessionSave:            "INSERT INTO sessions (id, username, expiry, extra) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET expiry = excluded.expiry, extra = excluded.extra",
+	SessionInfoSave:        "UPDATE sessions SET device = ?, addr = ?, last_seen = ? WHERE id = ?",
+	SessionDelete:          "DELETE FROM sessions WHERE id = ?",
+	SessionsByParent:       "SELECT id, username, expiry, extra, device, addr, last_seen FROM sessions WHERE " + sqliteExtraParent + " = ?",
+	SessionsForUser:        "SELECT id, username, expiry, extra, device, addr, last_seen FROM sessions WHERE username = ?",
+	OTP:                    "SELECT secret, enabled, recovery_codes, last_counter FROM otp WHERE username = ?",
+	OTPSave:                "INSERT INTO otp (username, secret, enabled, recovery_codes, last_counter) VALUES (?, ?, ?, ?, ?) ON CONFLICT (username) DO UPDATE SET secret = excluded.secret, enabled = excluded.enabled, recovery_codes = excluded.recovery_codes, last_counter = excluded.last_counter",
+	OTPDelete:              "DELETE FROM otp WHERE username = ?",
+	Passkeys:               "SELECT id, user_handle, public_key, sign_count, name, created FROM passkeys WHERE username = ? ORDER BY created",
+	PasskeySave:            "INSERT INTO passkeys (id, username, user_handle, public_key, sign_count, name, created) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET sign_count = excluded.sign_count, name = excluded.name",
+	PasskeyDelete:          "DELETE FROM passkeys WHERE username = ? AND id = ?",
+	PasskeyUser:            "SELECT username FROM passkeys WHERE user_handle = ? LIMIT 1",
+	AuditSave:              "INSERT INTO audit_log (time, username, parent, device, action, status, error, remote_addr) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	Audit:                  "SELECT time, username, parent, device, action, status, error, remote_addr FROM audit_log WHERE time < ? ORDER BY time DESC, id DESC LIMIT ? OFFSET ?",
+}
+
+// Open opens the database, creating it if needed, and migrates its tables
+// to the latest version. It must be called before s is used.
+func (s *SQLiteStore) Open(ctx context.Context) error {
+	if s.Path == "" {
+		return errors.New("sqlite: path is required")
+	}
+	// The database holds password hashes and session tokens:
+	f, err := os.OpenFile(s.Path, os.O_RDONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	queries := sqliteQueries
+	s.Driver = "sqlite"
+	s.DataSourceName = s.Path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)"
+	s.Queries = &queries
+	db, err := s.getDB()
+	if err != nil {
+		return err
+	}
+	if err := s.migrate(ctx, db); err != nil {
+		return fmt.Errorf("%s: %w", s.Path, err)
+	}
+	if s.Import != "" {
+		if err := s.importUsers(ctx); err != nil {
+			return fmt.Errorf("importing %s: %w", s.Import, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than this version of Unlockr supports (%d)",
+			version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migrating to schema version %d: %w", i+1, err)
+		}
+		log.Printf("migrated %s to schema version %d", s.Path, i+1)
+	}
+	return nil
+}
+
+// importUsers adds the users from Import if there are none yet.
+func (s *SQLiteStore) importUsers(ctx context.Context) error {
+	existing, err := s.Users(ctx)
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+	users, err := (&FileStore{Path: s.Import}).Users(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		u := u
+		if err := s.AddUser(ctx, &u); err != nil {
+			return err
+		}
+	}
+	log.Printf("imported %d users from %s", len(users), s.Import)
+	return nil
+}
+
+// Enforce the interfaces:
+var _ access.UserStoreWriter = (*SQLiteStore)(nil)
+var _ access.OTPStore = (*SQLiteStore)(nil)
+var _ access.PasskeyStore = (*SQLiteStore)(nil)
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"jeremy.visser.name/go/unlockr/access"
+	"jeremy.visser.name/go/unlockr/audit"
+	"jeremy.visser.name/go/unlockr/session"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	users := `{"users":{"alice":{"nickname":"Alice","password_hash":"hash","groups":["admin","montagues"]}}}`
+	if err := os.WriteFile(dir+"/users.json", []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *SQLiteStore {
+		s := &SQLiteStore{Path: dir + "/unlockr.db", Import: dir + "/users.json"}
+		if err := s.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.db.Close() })
+		return s
+	}
+	s := open()
+	if fi, err := os.Stat(s.Path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("file mode: got %v %v", fi, err)
+	}
+
+	// Users are imported, and can be managed:
+	u, err := s.User(ctx, "alice")
+	if err != nil || u.Nickname != "Alice" || u.PasswordHash != "hash" || !reflect.DeepEqual(u.Groups, access.Groups{"admin", "montagues"}) {
+		t.Errorf("imported user: got %+v %v", u, err)
+	}
+	if err := s.AddUser(ctx, &access.User{Username: "bob", Nickname: "Bob", Groups: access.Groups{"capulets"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser(ctx, &access.User{Username: "bob"}); !errors.Is(err, access.ErrUserExists) {
+		t.Errorf("duplicate user: got %v, want %v", err, access.ErrUserExists)
+	}
+	if err := s.UpdateUser(ctx, &access.User{Username: "bob", Nickname: "Robert", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User(ctx, "bob"); !errors.Is(err, access.ErrUserDisabled) {
+		t.Errorf("disabled user: got %v, want %v", err, access.ErrUserDisabled)
+	}
+	if err := s.SetPasswordHash(ctx, "alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions, including guest passes:
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	for id, sess := range map[session.SessionId]*session.Session{
+		"alice1": {Username: "alice", Expiry: expiry, Device: "Phone", Addr: "192.0.2.1", LastSeen: expiry},
+		"alice2": {Username: "alice", Expiry: expiry},
+		"guest":  {Username: "guest", Expiry: expiry, Extra: session.Extra(`{"Parent":"alice"}`)},
+	} {
+		if err := s.SaveSession(ctx, id, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteSession(ctx, "alice2"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := s.SessionsForUser(ctx, "alice"); err != nil || len(sessions) != 1 || sessions["alice1"].Device != "Phone" || !sessions["alice1"].LastSeen.Equal(expiry) {
+		t.Errorf("SessionsForUser: got %v %v", sessions, err)
+	}
+	if sessions, err := s.SessionsByParent(ctx, "alice"); err != nil || len(sessions) != 1 || sessions["guest"] == nil {
+		t.Errorf("SessionsByParent: got %v %v", sessions, err)
+	}
+
+	// OTP and passkeys:
+	if err := s.SaveOTP(ctx, "alice", &access.OTP{Secret: "secret", Enabled: true, LastCounter: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePasskey(ctx, "alice", &access.Passkey{ID: []byte{1}, UserHandle: []byte{3}, PublicKey: []byte{2}, Name: "Phone", Created: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := s.PasskeyUser(ctx, []byte{3}); err != nil || u != "alice" {
+		t.Errorf("PasskeyUser: got %q %v", u, err)
+	}
+	if _, err := s.PasskeyUser(ctx, []byte{4}); !errors.Is(err, access.ErrNoPasskey) {
+		t.Errorf("PasskeyUser, unknown handle: got %v, want %v", err, access.ErrNoPasskey)
+	}
+
+	// Audit:
+	rec := &audit.Record{Time: expiry, User: "alice", Device: "door", Action: "pulse", Status: 200, RemoteAddr: "192.0.2.1"}
+	if err := s.SaveRecord(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := s.Records(ctx, expiry.Add(time.Second), 10, nil); err != nil || len(records) != 1 || records[0] != *rec {
+		t.Errorf("Records: got %+v %v", records, err)
+	}
+	// Records at the same time aren't skipped between pages:
+	for _, action := range []string{"power/on", "power/off", "power/on", "power/off"} {
+		rec := *rec
+		rec.Action = action
+		if err := s.SaveRecord(ctx, &rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isOff := func(r *audit.Record) bool { return r.Action == "power/off" }
+	if records, err := s.Records(ctx, expiry.Add(time.Second), 2, isOff); err != nil || len(records) != 2 || !isOff(&records[0]) || !isOff(&records[1]) {
+		t.Errorf("Records, filtered: got %+v %v", records, err)
+	}
+
+	// Everything survives reopening, without being imported again:
+	s.db.Close()
+	s = open()
+	if u, err := s.User(ctx, "alice"); err != nil || u.PasswordHash != "new" {
+		t.Errorf("reopened: got %+v %v", u, err)
+	}
+	if sess, err := s.Session(ctx, "alice1"); err != nil || sess.Addr != "192.0.2.1" || len(sess.Extra) != 0 {
+		t.Errorf("reopened session: got %+v %v", sess, err)
+	}
+	if o, err := s.OTP(ctx, "alice"); err != nil || o.Secret != "secret" || !o.Enabled || o.LastCounter != 3 {
+		t.Errorf("reopened OTP: got %+v %v", o, err)
+	}
+
+	// Deleting a user removes their groups, OTP and passkeys:
+	if err := s.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User(ctx, "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleted user: got %v, want %v", err, sql.ErrNoRows)
+	}
+	if pks, err := s.Passkeys(ctx, "alice"); err != nil || len(pks) != 0 {
+		t.Errorf("deleted user's passkeys: got %v %v", pks, err)
+	}
+	if _, err := s.OTP(ctx, "alice"); !errors.Is(err, access.ErrNoOTP) {
+		t.Errorf("deleted user's OTP: got %v, want %v", err, access.ErrNoOTP)
+	}
+}
+
+// Tests that the session IDs of API tokens fit in the MySQL schema, which
+// would otherwise reject or truncate them.
+func TestSchemaSessionID(t *testing.T) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile("(?s)CREATE TABLE IF NOT EXISTS `unlockr_sessions` \\(\\s*`id` varchar\\((\\d+)\\)").FindSubmatch(schema)
+	if m == nil {
+		t.Fatal("unlockr_sessions.id not found in schema.sql")
+	}
+	width, _ := strconv.Atoi(string(m[1]))
+	if id := session.HashedID(session.TokenPrefix + "token"); len(id) > width {
+		t.Errorf("unlockr_sessions.id is varchar(%d), but API token IDs are %d characters", width, len(id))
+	}
+}
@@ -0,0 +1,340 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"jeremy.visser.name/go/unlockr/access"
+)
+
+var ErrNoUserStoreWriter = errors.New("user updates not supported by this datastore")
+
+// rawUsers are the users in the file at Path, as raw JSON fields, so that
+// rewriting it keeps any fields we don't know about.
+type rawUsers map[access.Username]map[string]json.RawMessage
+
+// SetPasswordHash rewrites the file at Path.
+func (f *FileStore) SetPasswordHash(ctx context.Context, u access.Username, hash string) error {
+	return f.updateUsers(func(users rawUsers) error {
+		user, ok := users[u]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		return setRaw(user, "password_hash", hash, hash == "")
+	})
+}
+
+// Users returns a copy of the users in the file at Path.
+func (f *FileStore) Users(ctx context.Context) (access.Users, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	users := make(access.Users, len(f.data.Users))
+	for name, u := range f.data.Users {
+		u.Username = name
+		u.Groups = append(access.Groups(nil), u.Groups...)
+		users[name] = u
+	}
+	return users, nil
+}
+
+// AddUser rewrites the file at Path.
+func (f *FileStore) AddUser(ctx context.Context, u *access.User) error {
+	return f.updateUsers(func(users rawUsers) error {
+		if _, ok := users[u.Username]; ok {
+			return access.ErrUserExists
+		}
+		user := make(map[string]json.RawMessage)
+		if err := setRaw(user, "password_hash", u.PasswordHash, u.PasswordHash == ""); err != nil {
+			return err
+		}
+		users[u.Username] = user
+		return updateRaw(user, u)
+	})
+}
+
+// UpdateUser rewrites the file at Path.
+func (f *FileStore) UpdateUser(ctx context.Context, u *access.User) error {
+	return f.updateUsers(func(users rawUsers) error {
+		user, ok := users[u.Username]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		return updateRaw(user, u)
+	})
+}
+
+// DeleteUser rewrites the file at Path.
+func (f *FileStore) DeleteUser(ctx context.Context, u access.Username) error {
+	return f.updateUsers(func(users rawUsers) error {
+		if _, ok := users[u]; !ok {
+			return sql.ErrNoRows
+		}
+		delete(users, u)
+		return nil
+	})
+}
+
+// updateRaw sets the fields of user which UpdateUser replaces.
+func updateRaw(user map[string]json.RawMessage, u *access.User) error {
+	return errors.Join(
+		setRaw(user, "nickname", u.Nickname, false),
+		setRaw(user, "groups", u.Groups, len(u.Groups) == 0),
+		setRaw(user, "disabled", u.Disabled, !u.Disabled),
+	)
+}
+
+// setRaw sets the field k of user to v, or removes it if omit is true.
+func setRaw(user map[string]json.RawMessage, k string, v any, omit bool) error {
+	if omit {
+		delete(user, k)
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	user[k] = raw
+	return err
+}
+
+// updateUsers calls update with the users in the file at Path, and
+// rewrites it atomically if update succeeds.
+func (f *FileStore) updateUsers(update func(rawUsers) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	var users rawUsers
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", f.Path, err)
+	}
+	if err := json.Unmarshal(doc["users"], &users); err != nil {
+		return fmt.Errorf("%s: users: %w", f.Path, err)
+	}
+	for name, user := range users {
+		if user == nil {
+			users[name] = make(map[string]json.RawMessage)
+		}
+	}
+	if err := update(users); err != nil {
+		return err
+	}
+	if doc["users"], err = json.Marshal(users); err != nil {
+		return err
+	}
+	if err := writeJSONFile(f.Path, doc, info.Mode().Perm()); err != nil {
+		return err
+	}
+	f.data = nil // reload on next use
+	return nil
+}
+
+// SetPasswordHash uses the PasswordSave query, if configured.
+func (d *DBStore) SetPasswordHash(ctx context.Context, u access.Username, hash string) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	if d.queries().PasswordSave == "" {
+		return ErrNoUserStoreWriter
+	}
+	result, err := db.ExecContext(ctx, d.queries().PasswordSave, hash, u)
+	if err != nil {
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		// Some drivers don't count unchanged rows, so check:
+		if _, err := d.user(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Users uses the Users and GroupMemberships queries.
+func (d *DBStore) Users(ctx context.Context) (access.Users, error) {
+	db, err := d.getDB()
+	if err != nil {
+		return nil, err
+	}
+	if d.queries().Users == "" {
+		return nil, ErrNoUserStoreWriter
+	}
+	rows, err := db.QueryContext(ctx, d.queries().Users)
+	if err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	defer rows.Close()
+	users := make(access.Users)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users[u.Username] = *u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DB query failed: %w", err)
+	}
+	for name, u := range users {
+		if u.Groups, err = d.groups(ctx, name); err != nil {
+			return nil, err
+		}
+		users[name] = u
+	}
+	return users, nil
+}
+
+// AddUser uses the UserAdd and GroupMembershipAdd queries.
+func (d *DBStore) AddUser(ctx context.Context, u *access.User) error {
+	q := d.queries()
+	if q.UserAdd == "" || (len(u.Groups) > 0 && q.GroupMembershipAdd == "") {
+		return ErrNoUserStoreWriter
+	}
+	if _, err := d.user(ctx, u.Username); err == nil {
+		return access.ErrUserExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, q.UserAdd, u.Username, u.PasswordHash, u.Nickname, u.Disabled); err != nil {
+			return err
+		}
+		return d.addGroups(ctx, tx, u)
+	})
+}
+
+// UpdateUser uses the UserUpdate, GroupMembershipsDelete and
+// GroupMembershipAdd queries.
+func (d *DBStore) UpdateUser(ctx context.Context, u *access.User) error {
+	q := d.queries()
+	if q.UserUpdate == "" || q.GroupMembershipsDelete == "" || q.GroupMembershipAdd == "" {
+		return ErrNoUserStoreWriter
+	}
+	if _, err := d.user(ctx, u.Username); err != nil {
+		return err
+	}
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, q.UserUpdate, u.Nickname, u.Disabled, u.Username); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, q.GroupMembershipsDelete, u.Username); err != nil {
+			return err
+		}
+		return d.addGroups(ctx, tx, u)
+	})
+}
+
+// DeleteUser uses the UserDelete query, and GroupMembershipsDelete if
+// configured (i.e. if the DB doesn't cascade deletes).
+func (d *DBStore) DeleteUser(ctx context.Context, u access.Username) error {
+	q := d.queries()
+	if q.UserDelete == "" {
+		return ErrNoUserStoreWriter
+	}
+	if _, err := d.user(ctx, u); err != nil {
+		return err
+	}
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		if q.GroupMembershipsDelete != "" {
+			if _, err := tx.ExecContext(ctx, q.GroupMembershipsDelete, u); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, q.UserDelete, u)
+		return err
+	})
+}
+
+func (d *DBStore) addGroups(ctx context.Context, tx *sql.Tx, u *access.User) error {
+	for _, g := range u.Groups {
+		if _, err := tx.ExecContext(ctx, d.queries().GroupMembershipAdd, u.Username, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx calls f in a transaction, which is committed if f succeeds.
+func (d *DBStore) inTx(ctx context.Context, f func(*sql.Tx) error) error {
+	db, err := d.getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("DB query failed: %w", err)
+	}
+	return tx.Commit()
+}
+
+// SetPasswordHash and the other UserStoreWriter methods are passed to the
+// underlying UserStore, and the user is removed from the cache.
+func (c *UserStoreCache) SetPasswordHash(ctx context.Context, u access.Username, hash string) error {
+	c.init()
+	w, ok := c.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return ErrNoUserStoreWriter
+	}
+	defer c.uc.Remove(u)
+	return w.SetPasswordHash(ctx, u, hash)
+}
+
+// Users is passed to the underlying UserStore, and never cached.
+func (c *UserStoreCache) Users(ctx context.Context) (access.Users, error) {
+	w, ok := c.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return nil, ErrNoUserStoreWriter
+	}
+	return w.Users(ctx)
+}
+
+func (c *UserStoreCache) AddUser(ctx context.Context, u *access.User) error {
+	c.init()
+	w, ok := c.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return ErrNoUserStoreWriter
+	}
+	defer c.uc.Remove(u.Username)
+	return w.AddUser(ctx, u)
+}
+
+func (c *UserStoreCache) UpdateUser(ctx context.Context, u *access.User) error {
+	c.init()
+	w, ok := c.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return ErrNoUserStoreWriter
+	}
+	defer c.uc.Remove(u.Username)
+	return w.UpdateUser(ctx, u)
+}
+
+func (c *UserStoreCache) DeleteUser(ctx context.Context, u access.Username) error {
+	c.init()
+	w, ok := c.UserStore.(access.UserStoreWriter)
+	if !ok {
+		return ErrNoUserStoreWriter
+	}
+	defer c.uc.Remove(u)
+	return w.DeleteUser(ctx, u)
+}
+
+// Enforce the interface:
+var _ access.UserStoreWriter = (*FileStore)(nil)
+var _ access.UserStoreWriter = (*DBStore)(nil)
+var _ access.UserStoreWriter = (*UserStoreCache)(nil)
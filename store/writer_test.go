@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFileStoreSetPasswordHash(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	orig := `{"users":{"alice":{"nickname":"Alice","password_hash":"old","custom":[1,2]}},"other":"kept"}`
+	if err := os.WriteFile(path, []byte(orig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := &FileStore{Path: path}
+	if _, err := f.User(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetPasswordHash(context.Background(), "alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetPasswordHash(context.Background(), "bob", "new"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown user: got %v, want %v", err, sql.ErrNoRows)
+	}
+
+	u, err := f.User(context.Background(), "alice")
+	if err != nil || u.PasswordHash != "new" || u.Nickname != "Alice" {
+		t.Errorf("got %+v %v", u, err)
+	}
+	want := `{
+    "other": "kept",
+    "users": {
+        "alice": {
+            "custom": [
+                1,
+                2
+            ],
+            "nickname": "Alice",
+            "password_hash": "new"
+        }
+    }
+}
+`
+	if data, err := os.ReadFile(path); err != nil || string(data) != want {
+		t.Errorf("got %s %v, want %s", data, err, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("mode changed: %v %v", info.Mode(), err)
+	}
+}
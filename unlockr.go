@@ -11,9 +11,12 @@ import (
 	"syscall"
 	"time"
 
+	"jeremy.visser.name/go/unlockr/audit"
 	"jeremy.visser.name/go/unlockr/auth"
+	"jeremy.visser.name/go/unlockr/auth/apitoken"
 	"jeremy.visser.name/go/unlockr/auth/guest"
 	"jeremy.visser.name/go/unlockr/debug"
+	"jeremy.visser.name/go/unlockr/device"
 	"jeremy.visser.name/go/unlockr/index"
 )
 
@@ -48,45 +51,89 @@ func main() {
 	}
 	os.Chdir(filepath.Dir(*configPath)) // for relative paths within config
 
-	// Choose between OAuth or Password auth:
-	if cfg.Auth == nil {
+	// Choose between OAuth, Password or Header auth (or several):
+	if len(cfg.Auth) == 0 {
 		log.Fatal("Please specify an auth method in config.json.\n",
 			"Sample config:\n", configSample)
 	}
-	var authHandler http.Handler = cfg.Auth.Handler
+	var authHandler http.Handler = cfg.Auth.Handler()
 	var authMux http.ServeMux
+	var passwordAuth *auth.PasswordAuthHandler
+	var sessions auth.SessionsHandler
 	if us, ss, err := cfg.GetDataStores(); err != nil {
 		log.Fatal(err, "\nSample config:\n", configSample)
 	} else {
-		switch ah := authHandler.(type) {
-		case *auth.PasswordAuthHandler:
-			ah.UserStore = us
-			ah.SessionStore = ss
-			ah.Handler = &authMux
-		case *auth.OAuthHandler:
-			// UserStore is unused here
-			ah.SessionStore = ss
-			ah.Handler = &authMux
+		sessions.SessionStore = ss
+		for _, a := range cfg.Auth {
+			switch ah := a.Handler.(type) {
+			case *auth.PasswordAuthHandler:
+				ah.UserStore = us
+				ah.SessionStore = ss
+				ah.Handler = &authMux
+				passwordAuth = ah
+			case *auth.OAuthHandler:
+				// UserStore is unused here
+				ah.SessionStore = ss
+				ah.Handler = &authMux
+			case *auth.HeaderAuthHandler:
+				// Users come from the proxy, and need no sessions
+				ah.Handler = &authMux
+			}
 		}
 
 		if cfg.Guest.Enabled() {
-			authHandler = &guest.Handler{
+			gh := &guest.Handler{
 				Passthru:     authHandler,
 				Handler:      &authMux,
 				SessionStore: ss,
 				Config:       cfg.Guest,
 			}
+			if passwordAuth != nil {
+				gh.UserStore = us // for guests of password users
+			}
+			authHandler = gh
+		}
+
+		th := &apitoken.Handler{
+			Passthru:     authHandler,
+			Handler:      &authMux,
+			SessionStore: ss,
+		}
+		if passwordAuth != nil {
+			th.UserStore = us // for tokens of password users
 		}
+		authHandler = th
 	}
 
 	// Register authenticated paths with auth handler:
 	dl := cfg.GetDevices()
 	idx := &index.Index{DL: dl}
 	authMux.Handle("/api/index", idx)
-	authMux.Handle("/api/device/", dl)
+	as := cfg.GetAuditStore()
+	authMux.Handle("/api/device/", &audit.Handler{Handler: dl, AuditStore: as})
+	authMux.Handle("/api/audit", &audit.Handler{Handler: http.HandlerFunc(dl.ServeAudit), AuditStore: as})
+	authMux.HandleFunc("/api/events", dl.ServeEvents)
+	go dl.PollStates(context.Background(), device.DefaultPollInterval)
 	authMux.HandleFunc("/api/user", auth.ServeUser)
-	if gh, ok := authHandler.(*guest.Handler); ok {
+	authMux.Handle("/api/sessions", &sessions)
+	authMux.Handle("/api/sessions/", &sessions)
+	if passwordAuth != nil {
+		authMux.HandleFunc("/api/user/otp", passwordAuth.ServeOTP)
+		authMux.HandleFunc("/api/user/passkeys", passwordAuth.ServePasskeys)
+		authMux.HandleFunc("/api/user/passkeys/", passwordAuth.ServePasskeys)
+		authMux.HandleFunc("/api/user/password", passwordAuth.ServePassword)
+		authMux.HandleFunc("/api/admin/users", passwordAuth.ServeAdminUsers)
+		authMux.HandleFunc("/api/admin/users/", passwordAuth.ServeAdminUsers)
+	}
+	th := authHandler.(*apitoken.Handler)
+	th.Devices = dl
+	authMux.HandleFunc("/api/tokens", th.ServeTokens)
+	authMux.HandleFunc("/api/tokens/", th.ServeTokens)
+	if gh, ok := th.Passthru.(*guest.Handler); ok {
+		gh.Devices = dl
 		authMux.HandleFunc("/api/guest/token", gh.ServeGuestNew)
+		authMux.HandleFunc("/api/guest/tokens", gh.ServeGuestTokens)
+		authMux.HandleFunc("/api/guest/tokens/", gh.ServeGuestTokens)
 	}
 
 	// No caching on /api/: